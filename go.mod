@@ -2,4 +2,10 @@ module github.com/paul-at-nangalan/hf-adaptor
 
 go 1.23.0
 
-require github.com/paul-at-nangalan/errorhandler v0.0.0-20220524092750-75ec0f2eca41
+require (
+	github.com/paul-at-nangalan/errorhandler v0.0.0-20220524092750-75ec0f2eca41
+	golang.org/x/net v0.43.0
+	golang.org/x/sync v0.16.0
+)
+
+require golang.org/x/text v0.28.0 // indirect
@@ -2,14 +2,28 @@ package hf
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/paul-at-nangalan/errorhandler/handlers"
+	"golang.org/x/sync/errgroup"
 	"html"
 	"io"
 	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 type Role string
@@ -18,23 +32,197 @@ const (
 	ROLE_SYSTEM Role = "system"
 	ROLE_USER   Role = "user"
 	ROLE_AGENT  Role = "assistant"
+	ROLE_TOOL   Role = "tool" /// the result of a tool call
 )
 
 type Message struct {
-	Role         string        `json:"role"`
-	Content      string        `json:"content"` // Can be null if FunctionCall is present
-	FunctionCall *FunctionCall `json:"function_call,omitempty"`
+	Role         string         `json:"role"`
+	Content      string         `json:"content"` // Can be null if FunctionCall is present
+	FunctionCall *FunctionCall  `json:"function_call,omitempty"`
+	Name         string         `json:"name,omitempty"`         /// optional - labels the participant, e.g. in multi-agent conversations
+	ToolCalls    []FunctionCall `json:"tool_calls,omitempty"`   /// the calls made by an assistant message
+	ToolCallId   string         `json:"tool_call_id,omitempty"` /// the call a tool message is the result of
+	//// The content was (or is to be sent as) JSON null rather than "", as in assistant messages
+	//// with only tool calls. Ignored if Content is set. A message with calls and no content is
+	//// always sent with null content.
+	ContentNull bool `json:"-"`
+}
+
+// The assistant message that made calls, for the history sent with the calls' results. The calls
+// are sent as tool_calls, with null content.
+func NewAssistantToolCallMessage(calls []FunctionCall) Message {
+	return Message{
+		Role:        string(ROLE_AGENT),
+		ContentNull: true,
+		ToolCalls:   calls,
+	}
+}
+
+func (m Message) MarshalJSON() ([]byte, error) {
+	type message Message /// without the MarshalJSON method
+	//// Strict backends reject "" alongside calls
+	hascalls := len(m.ToolCalls) > 0 || m.FunctionCall != nil
+	if m.Content != "" || (!m.ContentNull && !hascalls) {
+		return json.Marshal(message(m))
+	}
+	return json.Marshal(struct {
+		message
+		Content *string `json:"content"`
+	}{message: message(m)})
+}
+
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type message Message /// without the UnmarshalJSON method
+	aux := struct {
+		*message
+		Content json.RawMessage `json:"content"`
+	}{message: (*message)(m)}
+	err := json.Unmarshal(data, &aux)
+	if err != nil {
+		return err
+	}
+	m.Content = ""
+	m.ContentNull = string(aux.Content) == "null"
+	if len(aux.Content) > 0 && !m.ContentNull {
+		return json.Unmarshal(aux.Content, &m.Content)
+	}
+	return nil
+}
+
+func NewNamedMessage(role Role, name string, content string) Message {
+	return Message{
+		Role:    string(role),
+		Name:    name,
+		Content: content,
+	}
 }
 
 type AIRequest struct {
 	Model    string    `json:"model"`
 	Messages []Message `json:"messages"`
 	Tools    []Tool    `json:"tools,omitempty"`
+	//// false to ask for at most one tool call per response, nil for the endpoint's default
+	ParallelToolCalls *bool  `json:"parallel_tool_calls,omitempty"`
+	User              string `json:"user,omitempty"`   /// identifies the end user, for the provider's abuse monitoring
+	Stream            bool   `json:"stream,omitempty"` /// send the response as server sent events, see SendRequestStreamTo
+	//// e.g. {"type": "json_object"} for JSON mode
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	//// Sampling parameters, inlined into the top level of the JSON
+	GenerationParameters
+	//// Non-standard fields (e.g. details, best_of) merged into the top level of the JSON.
+	//// The fields above take precedence if a key is in both.
+	Extra map[string]any `json:"-"`
+}
+
+// The sampling parameters of a chat completion. Nil fields are left out of the request, so the
+// endpoint's defaults apply.
+type GenerationParameters struct {
+	MaxTokens         *int     `json:"max_tokens,omitempty"`
+	Temperature       *float64 `json:"temperature,omitempty"`
+	TopP              *float64 `json:"top_p,omitempty"`
+	TopK              *int     `json:"top_k,omitempty"` /// not part of the OpenAI API, supported by TGI and vLLM
+	Stop              []string `json:"stop,omitempty"`
+	N                 *int     `json:"n,omitempty"`
+	Seed              *int64   `json:"seed,omitempty"`
+	PresencePenalty   *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty  *float64 `json:"frequency_penalty,omitempty"`
+	RepetitionPenalty *float64 `json:"repetition_penalty,omitempty"` /// not part of the OpenAI API, supported by TGI and vLLM
+}
+
+// A starting point for general chat - a moderate temperature and a cap on the response length.
+// Each call returns new pointers, so the result can be changed freely.
+func DefaultGenerationParameters() GenerationParameters {
+	maxtokens := 1024
+	temperature := 0.7
+	topp := 0.95
+	return GenerationParameters{
+		MaxTokens:   &maxtokens,
+		Temperature: &temperature,
+		TopP:        &topp,
+	}
+}
+
+type ResponseFormat struct {
+	Type string `json:"type"` /// text or json_object
+}
+
+func (r AIRequest) MarshalJSON() ([]byte, error) {
+	type aiRequest AIRequest /// without the MarshalJSON method
+	data, err := json.Marshal(aiRequest(r))
+	if err != nil || len(r.Extra) == 0 {
+		return data, err
+	}
+
+	merged := make(map[string]json.RawMessage)
+	err = json.Unmarshal(data, &merged)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range r.Extra {
+		if _, ok := merged[key]; ok {
+			continue
+		}
+		merged[key], err = json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding extra field %s: %w", key, err)
+		}
+	}
+	return json.Marshal(merged)
 }
 
 type ToolFunctionParameterProperties struct {
-	Type        string `json:"type"`
-	Description string `json:"description,omitempty"`
+	Type        string                           `json:"type,omitempty"` /// empty when AnyOf or OneOf is used
+	Description string                           `json:"description,omitempty"`
+	Enum        []string                         `json:"enum,omitempty"`  /// restrict a string parameter to a fixed set of values
+	Items       *ToolFunctionParameterProperties `json:"items,omitempty"` /// the element schema when Type is "array"
+	//// The child schemas when Type is "object"
+	Properties map[string]*ToolFunctionParameterProperties `json:"properties,omitempty"`
+	Required   []string                                    `json:"required,omitempty"`
+	//// Alternative schemas, for parameters that accept more than one type
+	AnyOf []*ToolFunctionParameterProperties `json:"anyOf,omitempty"`
+	OneOf []*ToolFunctionParameterProperties `json:"oneOf,omitempty"`
+}
+
+// Check that exactly one of Type, AnyOf and OneOf is set, here and in all child schemas
+func (p *ToolFunctionParameterProperties) Validate() error {
+	set := 0
+	if p.Type != "" {
+		set++
+	}
+	if len(p.AnyOf) > 0 {
+		set++
+	}
+	if len(p.OneOf) > 0 {
+		set++
+	}
+	if set == 0 {
+		return fmt.Errorf("one of type, anyOf or oneOf must be set")
+	}
+	if set > 1 {
+		return fmt.Errorf("type, anyOf and oneOf are mutually exclusive")
+	}
+
+	if p.Items != nil {
+		if err := p.Items.Validate(); err != nil {
+			return fmt.Errorf("items: %w", err)
+		}
+	}
+	for name, child := range p.Properties {
+		if err := child.Validate(); err != nil {
+			return fmt.Errorf("property %s: %w", name, err)
+		}
+	}
+	for i, alt := range p.AnyOf {
+		if err := alt.Validate(); err != nil {
+			return fmt.Errorf("anyOf[%d]: %w", i, err)
+		}
+	}
+	for i, alt := range p.OneOf {
+		if err := alt.Validate(); err != nil {
+			return fmt.Errorf("oneOf[%d]: %w", i, err)
+		}
+	}
+	return nil
 }
 
 type ToolFunctionParameters struct {
@@ -59,6 +247,33 @@ type ToolParameter struct {
 	Type        string /// string, int ....
 	Description string
 	Required    bool
+	Enum        []string        /// optional - the allowed values, e.g. "celsius", "fahrenheit"
+	ItemType    string          /// the element type when Type is "array", e.g. string
+	Children    []ToolParameter /// the properties when Type is "object"
+}
+
+func newParameterProperties(param ToolParameter) ToolFunctionParameterProperties {
+	properties := ToolFunctionParameterProperties{
+		Type:        param.Type,
+		Description: param.Description,
+		Enum:        param.Enum,
+	}
+	if param.Type == "array" {
+		properties.Items = &ToolFunctionParameterProperties{
+			Type: param.ItemType,
+		}
+	}
+	if param.Type == "object" && len(param.Children) > 0 {
+		properties.Properties = make(map[string]*ToolFunctionParameterProperties)
+		for _, child := range param.Children {
+			childproperties := newParameterProperties(child)
+			properties.Properties[child.Name] = &childproperties
+			if child.Required {
+				properties.Required = append(properties.Required, child.Name)
+			}
+		}
+	}
+	return properties
 }
 
 func NewTool(name string, description string, params []ToolParameter) Tool {
@@ -76,10 +291,7 @@ func NewTool(name string, description string, params []ToolParameter) Tool {
 		}
 		required := make([]string, 0)
 		for _, property := range params {
-			function.Parameters.Properties[property.Name] = ToolFunctionParameterProperties{
-				Type:        property.Type,
-				Description: property.Description,
-			}
+			function.Parameters.Properties[property.Name] = newParameterProperties(property)
 			if property.Required {
 				required = append(required, property.Name)
 			}
@@ -101,66 +313,414 @@ type FunctionCall struct {
 	} `json:"function"`
 }
 
+// Unmarshal the JSON arguments string into dest
+func (fc FunctionCall) UnmarshalArguments(dest any) error {
+	err := json.Unmarshal([]byte(fc.Function.Arguments), dest)
+	if err != nil {
+		return fmt.Errorf("error unmarshalling arguments for function %s: %w", fc.Function.Name, err)
+	}
+	return nil
+}
+
+// The arguments as an untyped map
+func (fc FunctionCall) ArgumentsMap() (map[string]any, error) {
+	args := make(map[string]any)
+	err := fc.UnmarshalArguments(&args)
+	if err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
 type BaseAdaptor struct {
+	adaptorConfig
+	modellock sync.RWMutex
+	model     string
+	client    *http.Client
+	breaker   *circuitBreaker /// nil unless WithCircuitBreaker is used
+
+	owntransport bool          /// false if the transport is shared, e.g. with the adaptor this was cloned from
+	tokens       *tokenSource  /// nil unless WithTokenRefresher is used, in which case it replaces apiKey
+	warmup       *autoWarmup   /// nil unless WithAutoWarmup is used
+	slots        chan struct{} /// nil unless WithMaxConcurrent is used, holds one value per request in flight
+	closed       atomic.Bool   /// set by Close, requests then fail with ErrAdaptorClosed
+}
+
+// The settings a clone copies as they are. The rest of BaseAdaptor is state of its own, which a
+// clone starts afresh.
+type adaptorConfig struct {
 	apiURL     string
 	apiKey     string
-	model      string
-	client     *http.Client
 	maxretries int
+
+	attempttimeout  time.Duration /// 0 for no per attempt timeout
+	refreshbuffer   time.Duration /// how long before the token expires it is refreshed, see WithTokenRefreshBuffer
+	historypolicy   HistoryPolicy
+	injectedclient  bool         /// true if the client came from WithHTTPClient, it is then never copied or changed
+	retrydecider    RetryDecider /// nil for DefaultRetryDecider
+	validatehistory bool
+	lenientroles    bool /// map role aliases, see NormalizeRoles
+
+	idempotencykeygen  func() string  /// nil for no idempotency key unless WithIdempotencyKey is used
+	checksumheader     string         /// empty unless WithResponseChecksum is used
+	hashidempotencykey bool           /// derive the idempotency key from the request, see WithRequestHashIdempotencyKey
+	fallbackmodels     []string       /// tried in turn if a request to the model fails, see WithModelFallback
+	organization       string         /// the OpenAI-Organization header, left out if empty
+	project            string         /// the OpenAI-Project header, left out if empty
+	encoder            RequestEncoder /// nil for JSONEncoder
+
+	nosystemmessage bool /// the system message only comes from the history, see WithNoSystemMessage
+	debug           bool /// log response bodies as they are read, see WithDebug
+
+	unavailabledelay time.Duration /// the wait before retrying a 503, unless a RetryDecider is used
+	retrybudget      time.Duration /// 0 for no limit on the time spent retrying, see WithRetryBudget
+	log              *slog.Logger  /// nil for slog.Default()
 }
 
-func NewBaseAdaptor(apiurl, apikey, model string, maxretries int) *BaseAdaptor {
-	return &BaseAdaptor{
-		apiURL:     apiurl,
-		apiKey:     apikey,
-		model:      model,
-		client:     &http.Client{},
-		maxretries: maxretries,
+func NewBaseAdaptor(apiurl, apikey, model string, maxretries int, opts ...Option) *BaseAdaptor {
+	c := &BaseAdaptor{
+		adaptorConfig: adaptorConfig{
+			apiURL:     apiurl,
+			apiKey:     apikey,
+			maxretries: maxretries,
+
+			unavailabledelay: 30 * time.Second,
+			refreshbuffer:    30 * time.Second,
+		},
+		model:  model,
+		client: &http.Client{},
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	return c
 }
 
-func (c *BaseAdaptor) sendWithRetry(reqData any) (*http.Response, error) {
-	for i := 0; i < c.maxretries; i++ {
-		body := &bytes.Buffer{}
-		err := json.NewEncoder(body).Encode(reqData)
+// A copy with its own mutable state. The connection pool is shared until an option changes the transport.
+func (c *BaseAdaptor) clone(opts []Option) *BaseAdaptor {
+	client := c.client
+	if !c.injectedclient {
+		copied := *c.client
+		client = &copied
+	}
+	cl := &BaseAdaptor{
+		adaptorConfig: c.adaptorConfig,
+		model:         c.Model(),
+		client:        client,
+	}
+	if c.slots != nil {
+		cl.slots = make(chan struct{}, cap(c.slots))
+	}
+	if c.warmup != nil {
+		cl.warmup = &autoWarmup{ctx: c.warmup.ctx, message: c.warmup.message}
+	}
+	if c.breaker != nil {
+		cl.breaker = newCircuitBreaker(c.breaker.threshold, c.breaker.cooldown)
+	}
+	if c.tokens != nil {
+		cl.tokens = newTokenSource(c.tokens.refresher, c.tokens.buffer)
+	}
+	for _, opt := range opts {
+		opt(cl)
+	}
+	return cl
+}
+
+// Switch the model used for subsequent requests, e.g. for canary experiments
+func (c *BaseAdaptor) SetModel(model string) {
+	c.modellock.Lock()
+	defer c.modellock.Unlock()
+	c.model = model
+}
+
+func (c *BaseAdaptor) Model() string {
+	c.modellock.RLock()
+	defer c.modellock.RUnlock()
+	return c.model
+}
+
+var ErrAdaptorClosed = errors.New("adaptor is closed")
+
+// Close the idle connections and refuse any further requests with ErrAdaptorClosed. Requests
+// already in flight are left to finish. Safe to call more than once, only the first call does
+// anything. Clones are not closed, though a clone sharing the connection pool loses its idle
+// connections too.
+func (c *BaseAdaptor) Close() error {
+	if c.closed.Swap(true) {
+		return nil
+	}
+	c.client.CloseIdleConnections()
+	return nil
+}
+
+func (c *BaseAdaptor) logger() *slog.Logger {
+	if c.log == nil {
+		return slog.Default()
+	}
+	return c.log
+}
+
+type contextKey int
+
+const retryAttemptKey contextKey = iota
+
+// The attempt (1 for the first, 2 for the first retry ...) a request is being sent for, or 0 if
+// the context isn't from a request sent by an adaptor. For use in a custom http.RoundTripper
+// (see WithTransport), e.g. to add an X-Retry-Attempt header.
+func RetryAttemptFromContext(ctx context.Context) int {
+	attempt, _ := ctx.Value(retryAttemptKey).(int)
+	return attempt
+}
+
+// Decides whether a response should be retried, and how long to wait first. The body can be read,
+// it is buffered for the extractor.
+type RetryDecider func(resp *http.Response) (retry bool, wait time.Duration)
+
+// The built in retry decision - wait 30 seconds and retry while the service is not ready (503)
+func DefaultRetryDecider(resp *http.Response) (bool, time.Duration) {
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return true, 30 * time.Second
+	}
+	return false, 0
+}
+
+func (c *BaseAdaptor) sendWithRetry(ctx context.Context, reqData any, rc *requestConfig) (*http.Response, error) {
+	if c.closed.Load() {
+		return nil, ErrAdaptorClosed
+	}
+	if c.slots == nil {
+		return c.sendWithBreaker(ctx, reqData, rc)
+	}
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	//// The request is in flight until its body is closed, which may happen more than once
+	release := sync.OnceFunc(func() { <-c.slots })
+	resp, err := c.sendWithBreaker(ctx, reqData, rc)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: release}
+	return resp, nil
+}
+
+func (c *BaseAdaptor) sendWithBreaker(ctx context.Context, reqData any, rc *requestConfig) (*http.Response, error) {
+	if c.breaker == nil {
+		return c.retry(ctx, reqData, rc)
+	}
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	resp, err := c.retry(ctx, reqData, rc)
+	switch {
+	case err != nil && ctx.Err() != nil:
+		//// The caller gave up, which says nothing about the endpoint
+		c.breaker.abandon()
+	default:
+		//// A client error (e.g. a bad request) still means the endpoint is up
+		c.breaker.record(err == nil || !isEndpointFault(err))
+	}
+	return resp, err
+}
+
+func (c *BaseAdaptor) retry(ctx context.Context, reqData any, rc *requestConfig) (*http.Response, error) {
+	apikey := c.apiKey
+	if rc.apikey != "" {
+		apikey = rc.apikey
+	} else if c.tokens != nil {
+		token, err := c.tokens.Token(ctx)
+		if err != nil {
+			return nil, err
+		}
+		apikey = token
+	}
+	idempotencykey := rc.idempotencykey
+	if idempotencykey == "" && c.hashidempotencykey {
+		data, err := json.Marshal(reqData)
 		handlers.PanicOnError(err)
+		idempotencykey = fmt.Sprintf("%x", sha256.Sum256(data))
+	}
+	var lasterr error
+	encoder := c.encoder
+	if encoder == nil {
+		encoder = JSONEncoder{}
+	}
+	start := time.Now()
+	//// With WithRetryBudget, don't start another attempt that would only begin after the budget is spent
+	overbudget := func(wait time.Duration) error {
+		if c.retrybudget <= 0 || time.Since(start)+wait <= c.retrybudget {
+			return nil
+		}
+		c.logger().Warn("retry budget exceeded", "budget", c.retrybudget, "elapsed", time.Since(start), "wait", wait)
+		return fmt.Errorf("%w after %v: %w", ErrRetryBudgetExceeded, time.Since(start).Round(time.Millisecond), lasterr)
+	}
+	for i := 0; i < c.maxretries; i++ {
+		body, contenttype, err := encoder.Encode(reqData)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding request: %w", err)
+		}
 
-		//fmt.Println("Calling agent with ", c.apiURL, " and key ", c.apiKey)
-		req, err := http.NewRequest(http.MethodPost, c.apiURL, body)
+		//// Each attempt gets its own deadline (within the overall one) so a hung attempt doesn't use up the retries
+		attemptctx, cancel := ctx, context.CancelFunc(func() {})
+		if c.attempttimeout > 0 {
+			attemptctx, cancel = context.WithTimeout(ctx, c.attempttimeout)
+		}
+		attemptctx = context.WithValue(attemptctx, retryAttemptKey, i+1)
+
+		//fmt.Println("Calling agent with ", c.apiURL, " and key ", apikey)
+		req, err := http.NewRequestWithContext(attemptctx, http.MethodPost, c.apiURL, body)
 		if err != nil {
+			cancel()
 			return nil, fmt.Errorf("error creating request: %w", err)
 		}
 
 		req.Header.Set("Accept", "application/json")
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+		req.Header.Set("Content-Type", contenttype)
+		req.Header.Set("Authorization", "Bearer "+apikey)
+		if rc.requestid != "" {
+			req.Header.Set("X-Request-Id", rc.requestid)
+		}
+		if c.organization != "" {
+			req.Header.Set("OpenAI-Organization", c.organization)
+		}
+		if c.project != "" {
+			req.Header.Set("OpenAI-Project", c.project)
+		}
+		if idempotencykey != "" {
+			//// The standard header, and the X- one some gateways still use
+			req.Header.Set("Idempotency-Key", idempotencykey)
+			req.Header.Set("X-Idempotency-Key", idempotencykey)
+		}
 
 		resp, err := c.client.Do(req)
 
 		if err != nil {
+			cancel()
+			if ctx.Err() == nil && errors.Is(attemptctx.Err(), context.DeadlineExceeded) {
+				c.logger().Warn("attempt timed out", "attempt", i+1, "timeout", c.attempttimeout, "maxretries", c.maxretries)
+				lasterr = err
+				if err := overbudget(0); err != nil {
+					return nil, err
+				}
+				continue
+			}
 			return nil, fmt.Errorf("error sending request: %w", err)
 		}
 		/// retry
-		if resp.StatusCode == 503 {
-			fmt.Println("Status code 503 - service not ready - sleeping for 30 seconds with max ", c.maxretries, " retries")
+		retry, wait := false, time.Duration(0)
+		if c.retrydecider == nil {
+			//// As DefaultRetryDecider, with the adaptor's own wait
+			retry, _ = DefaultRetryDecider(resp)
+			wait = c.unavailabledelay
+		} else if rc.stream && resp.StatusCode == http.StatusOK {
+			//// Buffering the body for the decider would hold back the stream until the model has finished
+		} else {
+			//// The decider may read the body, so buffer it for whoever reads it next
+			data, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				cancel()
+				return nil, fmt.Errorf("error reading response: %w", err)
+			}
+			resp.Body = io.NopCloser(bytes.NewReader(data))
+			retry, wait = c.retrydecider(resp)
+			resp.Body = io.NopCloser(bytes.NewReader(data))
+		}
+		if retry {
+			c.logger().Info("retrying request", "status", resp.StatusCode, "wait", wait, "attempt", i+1, "maxretries", c.maxretries)
 			resp.Body.Close()
-			time.Sleep(30 * time.Second)
+			cancel()
+			lasterr = fmt.Errorf("retry requested for status %d", resp.StatusCode)
+			if err := overbudget(wait); err != nil {
+				return nil, err
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(wait):
+			}
 			continue
 		}
 		if resp.StatusCode != http.StatusOK {
 			errmsg, err := io.ReadAll(resp.Body)
-			log.Println("Error: ", string(errmsg), " err ", err)
+			c.logger().Error("API request failed", "status", resp.StatusCode, "body", string(errmsg), "err", err)
 			if resp.Body != nil {
 				resp.Body.Close()
 			}
-			return nil, fmt.Errorf("API request failed with status %d", resp.StatusCode)
+			cancel()
+			return nil, &StatusError{StatusCode: resp.StatusCode, Body: string(errmsg)}
 		}
 
+		if c.checksumheader != "" && !rc.stream {
+			err := c.verifyChecksum(resp)
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+		}
+		if c.debug {
+			resp.Body = &DebugReadCloser{Reader: resp.Body, Logger: c.logger(), Level: infoLevel()}
+		}
+		//// The attempt's deadline also covers reading the body, so only release it once the body is closed
+		resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
 		return resp, nil
 	}
+	if lasterr != nil {
+		return nil, fmt.Errorf("Num retries exceeded: %w", lasterr)
+	}
 	return nil, fmt.Errorf("Num retries exceeded")
 }
 
+// The endpoint answered with a status other than 200, or one it isn't retried for
+type StatusError struct {
+	StatusCode int
+	Body       string /// usually the endpoint's error message
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("API request failed with status %d", e.StatusCode)
+}
+
+// Returned, wrapping the last attempt's error, when WithRetryBudget stops the retries
+var ErrRetryBudgetExceeded = errors.New("retry budget exceeded")
+
+var ErrChecksumMismatch = errors.New("response checksum mismatch")
+
+// Check the SHA256 of the body against the checksum header (hex or base64), see WithResponseChecksum.
+// The body is buffered, so it can still be read afterwards.
+func (c *BaseAdaptor) verifyChecksum(resp *http.Response) error {
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error reading response: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+
+	expected := strings.TrimSpace(resp.Header.Get(c.checksumheader))
+	if expected == "" {
+		return fmt.Errorf("%w: no %s header", ErrChecksumMismatch, c.checksumheader)
+	}
+	sum := sha256.Sum256(data)
+	if !strings.EqualFold(expected, hex.EncodeToString(sum[:])) && expected != base64.StdEncoding.EncodeToString(sum[:]) {
+		return fmt.Errorf("%w: %s is %s, the body's SHA256 is %x", ErrChecksumMismatch, c.checksumheader, expected, sum)
+	}
+	return nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
 // ////////////////////////////////////////////////////////////////
 //
 //	TGI with HUGS/OpenAI structured request response data
@@ -173,6 +733,12 @@ type Adaptor struct {
 	client       *http.Client
 	extractresp  ExtractResponse
 	maxretries   int
+
+	metalock sync.Mutex
+	lastmeta ResponseMeta
+
+	stats adaptorStats
+	usage tokenUsage
 }
 
 type ExtractResponse func(closer io.ReadCloser) (string, []FunctionCall, error)
@@ -183,10 +749,10 @@ type ExtractResponse func(closer io.ReadCloser) (string, []FunctionCall, error)
 * model should be the model type (which can be found somewhere on HF), e.g. tgi for text generation type models
  */
 func NewAdaptor(apiurl, apikey, model string, baseinstructions string,
-	extractresp ExtractResponse, maxretries int) *Adaptor {
+	extractresp ExtractResponse, maxretries int, opts ...Option) *Adaptor {
 
 	ad := &Adaptor{
-		BaseAdaptor:  NewBaseAdaptor(apiurl, apikey, model, maxretries),
+		BaseAdaptor:  NewBaseAdaptor(apiurl, apikey, model, maxretries, opts...),
 		client:       &http.Client{},
 		extractresp:  extractresp,
 		baseinstruct: baseinstructions,
@@ -198,48 +764,452 @@ func NewAdaptor(apiurl, apikey, model string, baseinstructions string,
 	return ad
 }
 
-func (c *Adaptor) SendRequest(message string) (string, error) {
-	content, _, err := c.SendRequestWithHistory(message, []Message{}, nil)
+// A new adaptor with the same configuration plus opts, e.g. ad.Clone(hf.WithModel("mistral-large")).
+// The clone shares the HTTP connection pool but none of the adaptor's other state.
+func (c *Adaptor) Clone(opts ...Option) *Adaptor {
+	return &Adaptor{
+		BaseAdaptor:  c.BaseAdaptor.clone(opts),
+		client:       c.client,
+		extractresp:  c.extractresp,
+		baseinstruct: c.baseinstruct,
+		maxretries:   c.maxretries,
+	}
+}
+
+func (c *Adaptor) SendRequest(message string, opts ...RequestOption) (string, error) {
+	content, _, err := c.SendRequestWithHistory(message, []Message{}, nil, opts...)
+	return content, err
+}
+
+// As SendRequest, with the message sent as a system message
+func (c *Adaptor) SendSystemRequest(message string, opts ...RequestOption) (string, error) {
+	content, _, err := c.SendSystemRequestWithHistory(message, []Message{}, nil, opts...)
 	return content, err
 }
 
-func (c *Adaptor) sendRequestWithHistory(message string, role Role, history []Message, tools []Tool) (string, []FunctionCall, error) {
+func (c *Adaptor) sendRequestWithHistory(message string, role Role, history []Message, tools []Tool,
+	opts []RequestOption) (string, []FunctionCall, error) {
 
-	messages := make([]Message, 0, len(history)+2)
+	rc := c.newRequestConfig(opts)
 
-	//// The base message is instructions to the AI model
-	messages = append(messages, Message{
-		Role: string(ROLE_SYSTEM), Content: html.UnescapeString(c.baseinstruct),
-	})
-	messages = append(messages, history...)
+	messages := make([]Message, 0, len(history)+3)
+
+	messages = c.withBaseInstruct(messages, history, rc)
 	messages = append(messages, Message{
 		Role: string(role), Content: html.UnescapeString(message),
 	})
+	return c.sendMessages(messages, tools, rc)
+}
+
+// Append the base instructions (the system message) and then the history to messages. The base
+// instructions are left out if the history already starts with a system message, e.g. one that
+// was exported and imported again, or if WithNoSystemMessage is used. WithSystemPrompt replaces
+// the base instructions for a single request.
+func (c *Adaptor) withBaseInstruct(messages []Message, history []Message, rc *requestConfig) []Message {
+	hassystem := len(history) > 0 && history[0].Role == string(ROLE_SYSTEM)
+	if !hassystem && !c.nosystemmessage {
+		baseinstruct := c.baseinstruct
+		if rc.systemprompt != nil {
+			baseinstruct = *rc.systemprompt
+		}
+		//// The base message is instructions to the AI model
+		messages = append(messages, Message{
+			Role: string(ROLE_SYSTEM), Content: html.UnescapeString(baseinstruct),
+		})
+	}
+	return append(messages, history...)
+}
+
+// Send the messages as they are, apart from the assistant prefix, normalization and validation
+func (c *Adaptor) sendMessages(messages []Message, tools []Tool, rc *requestConfig) (string, []FunctionCall, error) {
+	c.autoWarmup()
+	content, functionCall, err := c.sendMessagesOnce(messages, tools, rc)
+	if rc.responseschema == nil {
+		return content, functionCall, err
+	}
+	for attempt := 0; err == nil && len(functionCall) == 0; attempt++ {
+		schemaerr := validateResponse(content, rc.responseschema)
+		if schemaerr == nil {
+			break
+		}
+		if attempt >= rc.schemaretries {
+			return content, functionCall, fmt.Errorf("%w: %w", ErrResponseSchema, schemaerr)
+		}
+		c.logger().Warn("response does not match the schema, asking for a correction", "attempt", attempt+1, "err", schemaerr)
+		schema, marshalerr := json.Marshal(rc.responseschema)
+		handlers.PanicOnError(marshalerr)
+		messages = append(slices.Clip(messages), Message{Role: string(ROLE_AGENT), Content: content}, Message{
+			Role: string(ROLE_USER),
+			Content: fmt.Sprintf("Your response does not match the required JSON schema: %v\n"+
+				"Reply again with only JSON matching this schema: %s", schemaerr, schema),
+		})
+		//// A different request, so it mustn't reuse the idempotency key
+		content, functionCall, err = c.sendMessagesOnce(messages, tools, c.withNewIdempotencyKey(rc))
+	}
+	return content, functionCall, err
+}
+
+var ErrResponseSchema = errors.New("response does not match the schema")
+
+func (c *Adaptor) sendMessagesOnce(messages []Message, tools []Tool, rc *requestConfig) (string, []FunctionCall, error) {
+	reqData, err := c.newAIRequest(messages, tools, rc)
+	if err != nil {
+		return "", nil, err
+	}
+	start := time.Now()
+	content, functionCall, err := c.sendAndExtract(reqData, rc)
+	c.stats.record(start, err)
+	return content, functionCall, err
+}
+
+// The request for the messages and tools, with the request options applied
+func (c *Adaptor) newAIRequest(messages []Message, tools []Tool, rc *requestConfig) (AIRequest, error) {
+	if rc.assistantprefix != "" {
+		//// The model continues this message rather than starting a new one
+		messages = append(messages, Message{
+			Role: string(ROLE_AGENT), Content: rc.assistantprefix,
+		})
+	}
+	if c.lenientroles {
+		messages = NormalizeRoles(messages)
+	}
+	if err := ValidateRoles(messages); err != nil {
+		return AIRequest{}, err
+	}
+	messages, err := normalizeMessages(messages, c.historypolicy)
+	if err != nil {
+		return AIRequest{}, err
+	}
+	if c.validatehistory {
+		if err := ValidateHistory(messages); err != nil {
+			return AIRequest{}, err
+		}
+	}
 	reqData := AIRequest{
-		Model:    c.model,
+		Model:    c.Model(),
 		Messages: messages,
 	}
+	if rc.tools != nil {
+		tools = rc.tools
+	}
 	if tools != nil {
 		reqData.Tools = tools
 	}
+	reqData.User = rc.user
+	reqData.ParallelToolCalls = rc.paralleltoolcalls
+	reqData.ResponseFormat = rc.responseformat
+	if rc.generation != nil {
+		reqData.GenerationParameters = *rc.generation
+	}
+	if len(rc.extrabody) > 0 {
+		err := checkExtraBody(reqData, rc.extrabody)
+		if err != nil {
+			return AIRequest{}, err
+		}
+		reqData.Extra = rc.extrabody
+	}
+	return reqData, nil
+}
 
-	resp, err := c.sendWithRetry(reqData)
-	handlers.PanicOnError(err)
+// Send the request to the adaptor's model, or if that fails to each WithModelFallback model in turn.
+// Returns the model that answered.
+func (c *Adaptor) sendWithFallback(reqData AIRequest, rc *requestConfig) (*http.Response, string, error) {
+	resp, err := c.sendWithRetry(rc.ctx, reqData, rc)
+	for _, model := range c.fallbackmodels {
+		if err == nil || rc.ctx.Err() != nil || !canFallBack(err) {
+			break
+		}
+		c.logger().Warn("falling back to another model", "failed", reqData.Model, "fallback", model, "err", err)
+		reqData.Model = model
+		//// A different request, so a gateway mustn't answer it from the failed one's idempotency key
+		resp, err = c.sendWithRetry(rc.ctx, reqData, c.withNewIdempotencyKey(rc))
+	}
+	if err != nil {
+		return nil, "", err
+	}
 	if resp == nil || resp.Body == nil {
 		log.Panicln("Resp or resp body is nil ... this should never happen")
 	}
+	return resp, reqData.Model, nil
+}
+
+// A copy of rc for a request that differs from the one rc was for, with a new idempotency key from
+// the adaptor's generator, or none (and so the request hash, if that is used) without one
+func (c *BaseAdaptor) withNewIdempotencyKey(rc *requestConfig) *requestConfig {
+	newrc := *rc
+	newrc.idempotencykey = ""
+	if c.idempotencykeygen != nil {
+		newrc.idempotencykey = c.idempotencykeygen()
+	}
+	return &newrc
+}
+
+// Whether another model might succeed where one failed with err. A client error other than model not
+// found, e.g. a malformed request (400) or a bad key (401), would fail the same with any model.
+func canFallBack(err error) bool {
+	if errors.Is(err, ErrAdaptorClosed) {
+		return false
+	}
+	statuserr := &StatusError{}
+	if errors.As(err, &statuserr) && statuserr.StatusCode == http.StatusNotFound {
+		return true
+	}
+	return isEndpointFault(err)
+}
+
+// Whether err is the endpoint's fault - a connection error, an overload (429) or a server error
+// (5xx) - rather than the request's
+func isEndpointFault(err error) bool {
+	statuserr := &StatusError{}
+	if !errors.As(err, &statuserr) {
+		//// e.g. a connection error, or a 503 that outlasted the retries
+		return true
+	}
+	return statuserr.StatusCode == http.StatusTooManyRequests || statuserr.StatusCode >= 500
+}
+
+func (c *Adaptor) sendAndExtract(reqData AIRequest, rc *requestConfig) (string, []FunctionCall, error) {
+	resp, model, err := c.sendWithFallback(reqData, rc)
+	if err != nil {
+		return "", nil, err
+	}
 	defer resp.Body.Close()
 
-	content, functionCall, err := c.extractresp(resp.Body)
+	//// Buffer the body so the response meta can be read whichever extractor is in use
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, fmt.Errorf("error reading response: %w", err)
+	}
+	c.setLastResponseMeta(data, model, rc)
+	c.usage.add(data)
+	if rc.rawresponse != nil {
+		*rc.rawresponse = data
+	}
+
+	content, functionCall, err := rc.extractresp(io.NopCloser(bytes.NewReader(data)))
+	if err == nil && rc.assistantprefix != "" && !strings.HasPrefix(content, rc.assistantprefix) {
+		content = rc.assistantprefix + content
+	}
 	return content, functionCall, err
 }
 
-func (c *Adaptor) SendRequestWithHistory(message string, history []Message, tools []Tool) (string, []FunctionCall, error) {
-	return c.sendRequestWithHistory(message, ROLE_USER, history, tools)
+// Ask for a JSON response (JSON mode) and unmarshal the content into target. The adaptor's extractor
+// (or one passed with WithExtractor) must return the message content, e.g. OpenAIJsonExtractor.
+func (c *Adaptor) SendRequestJSON(message string, history []Message, target any, opts ...RequestOption) error {
+	opts = append([]RequestOption{WithJSONMode()}, opts...)
+	content, _, err := c.SendRequestWithHistory(message, history, nil, opts...)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal([]byte(content), target)
+	if err != nil {
+		return &StructuredOutputError{Content: content, Err: err}
+	}
+	return nil
 }
 
-func (c *Adaptor) SendSystemRequestWithHistory(message string, history []Message, tools []Tool) (string, []FunctionCall, error) {
-	return c.sendRequestWithHistory(message, ROLE_SYSTEM, history, tools)
+// The response content couldn't be unmarshalled, see SendRequestJSON and SendRequestAs
+type StructuredOutputError struct {
+	Content string
+	Err     error
+}
+
+func (e *StructuredOutputError) Error() string {
+	return fmt.Sprintf("error unmarshalling response content %q: %v", e.Content, e.Err)
+}
+
+func (e *StructuredOutputError) Unwrap() error {
+	return e.Err
+}
+
+// Ask for a JSON response and unmarshal the content into a T. JSON mode is used unless the endpoint
+// rejects it (status 400 or 422), in which case the request is sent again without it, with an
+// instruction to answer in JSON added to the system prompt - the history's own system message if it
+// starts with one, or the message if WithNoSystemMessage is used. As it is a different request it
+// doesn't reuse the idempotency key (a new one is generated if the adaptor has a generator). The
+// instruction includes T's schema if T is a struct (see SchemaFromStruct). A function rather than a
+// method, as methods can't have type parameters.
+func SendRequestAs[T any](ctx context.Context, c *Adaptor, message string, history []Message,
+	opts ...RequestOption) (T, error) {
+
+	var result T
+	opts = append(slices.Clone(opts), WithContext(ctx))
+	content, _, err := c.SendRequestWithHistory(message, history, nil, append([]RequestOption{WithJSONMode()}, opts...)...)
+	statuserr := &StatusError{}
+	if errors.As(err, &statuserr) &&
+		(statuserr.StatusCode == http.StatusBadRequest || statuserr.StatusCode == http.StatusUnprocessableEntity) {
+
+		c.logger().Warn("JSON mode rejected, asking for JSON in the system prompt", "status", statuserr.StatusCode)
+		switch {
+		case len(history) > 0 && history[0].Role == string(ROLE_SYSTEM):
+			//// WithSystemPrompt would be ignored, the system message is the history's own
+			history = slices.Clone(history)
+			history[0].Content = jsonInstruction[T](history[0].Content)
+		case c.nosystemmessage:
+			//// No system message is sent, so ask in the message instead
+			message = jsonInstruction[T](message)
+		default:
+			opts = append(opts, WithSystemPrompt(jsonInstruction[T](c.systemPrompt(opts))))
+		}
+		//// A different request, so it mustn't be taken for a retry of the rejected one
+		opts = append(opts, WithIdempotencyKey(""))
+		content, _, err = c.SendRequestWithHistory(message, history, nil, opts...)
+		content = stripCodeFence(content)
+	}
+	if err != nil {
+		return result, err
+	}
+	err = json.Unmarshal([]byte(content), &result)
+	if err != nil {
+		return result, &StructuredOutputError{Content: content, Err: err}
+	}
+	return result, nil
+}
+
+// The system prompt a request with opts is sent with
+func (c *Adaptor) systemPrompt(opts []RequestOption) string {
+	rc := &requestConfig{}
+	for _, opt := range opts {
+		opt.applyRequest(rc)
+	}
+	if rc.systemprompt != nil {
+		return *rc.systemprompt
+	}
+	return c.baseinstruct
+}
+
+func jsonInstruction[T any](prompt string) string {
+	instruction := "Respond only with JSON."
+	if schema, err := SchemaFromStruct[T](); err == nil {
+		data, err := json.Marshal(schema)
+		handlers.PanicOnError(err)
+		instruction = "Respond only with a JSON object matching this JSON schema: " + string(data)
+	}
+	if prompt == "" {
+		return instruction
+	}
+	return prompt + "\n\n" + instruction
+}
+
+// Without JSON mode models often wrap the JSON in a markdown code block
+func stripCodeFence(content string) string {
+	trimmed := strings.TrimSpace(content)
+	if !strings.HasPrefix(trimmed, "```") || !strings.HasSuffix(trimmed, "```") || len(trimmed) < 6 {
+		return content
+	}
+	trimmed = strings.TrimSuffix(trimmed, "```")
+	//// Drop the opening fence and its language, e.g. ```json
+	_, body, found := strings.Cut(trimmed, "\n")
+	if !found {
+		return content
+	}
+	return strings.TrimSpace(body)
+}
+
+// Identifying fields from an OpenAI style response
+type ResponseMeta struct {
+	Id      string `json:"id"`
+	Created int    `json:"created"` /// unix timestamp
+	Model   string `json:"model"`
+	//// Identifies the backend configuration - if this changes the same seed may give different output
+	SystemFingerprint string `json:"system_fingerprint"`
+	//// The X-Request-Id sent with the request, if WithRequestID was used
+	RequestId string `json:"-"`
+	//// The model the request was sent to - one from WithModelFallback if the adaptor's model failed
+	RequestModel string `json:"-"`
+}
+
+func (c *Adaptor) setLastResponseMeta(data []byte, model string, rc *requestConfig) {
+	meta := ResponseMeta{}
+	//// Best effort - non OpenAI style bodies simply leave the meta empty
+	_ = json.Unmarshal(data, &meta)
+	meta.RequestModel = model
+	c.storeResponseMeta(meta, rc)
+}
+
+func (c *Adaptor) storeResponseMeta(meta ResponseMeta, rc *requestConfig) {
+	meta.RequestId = rc.requestid
+	if rc.meta != nil {
+		*rc.meta = meta
+	}
+
+	c.metalock.Lock()
+	defer c.metalock.Unlock()
+	c.lastmeta = meta
+}
+
+// The meta of the most recent response received by this adaptor
+func (c *Adaptor) LastResponseMeta() ResponseMeta {
+	c.metalock.Lock()
+	defer c.metalock.Unlock()
+	return c.lastmeta
+}
+
+// Send the results of the function calls returned for originalMessage, so the model can carry on.
+// The history sent is history, originalMessage, an assistant message with the calls and a tool
+// message per call with its result, taken from results by the call's Id.
+func (c *Adaptor) ContinueWithToolResults(originalMessage string, history []Message, assistantCalls []FunctionCall,
+	results map[string]string, tools []Tool, opts ...RequestOption) (string, []FunctionCall, error) {
+
+	rc := c.newRequestConfig(opts)
+
+	messages := make([]Message, 0, len(history)+len(assistantCalls)+3)
+	messages = c.withBaseInstruct(messages, history, rc)
+	messages = append(messages, Message{
+		Role: string(ROLE_USER), Content: html.UnescapeString(originalMessage),
+	})
+	callresults := make([]string, 0, len(assistantCalls))
+	for _, call := range assistantCalls {
+		result, ok := results[call.Id]
+		if !ok {
+			return "", nil, fmt.Errorf("no result for call %s to %s", call.Id, call.Function.Name)
+		}
+		callresults = append(callresults, result)
+	}
+	messages = InjectToolResults(messages, NewAssistantToolCallMessage(assistantCalls), assistantCalls, callresults)
+	return c.sendMessages(messages, tools, rc)
+}
+
+func (c *Adaptor) SendRequestWithHistory(message string, history []Message, tools []Tool,
+	opts ...RequestOption) (string, []FunctionCall, error) {
+	return c.sendRequestWithHistory(message, ROLE_USER, history, tools, opts)
+}
+
+func (c *Adaptor) SendSystemRequestWithHistory(message string, history []Message, tools []Tool,
+	opts ...RequestOption) (string, []FunctionCall, error) {
+	return c.sendRequestWithHistory(message, ROLE_SYSTEM, history, tools, opts)
+}
+
+// The outcome of one request in a batch
+type ChatResult struct {
+	Content       string
+	FunctionCalls []FunctionCall
+	Err           error
+}
+
+// Send each message as its own request, with at most concurrency requests in flight. The results
+// are in the same order as the messages. A failed request only sets the Err of its own result,
+// the rest of the batch still runs - the error return is for an invalid call.
+func (c *Adaptor) SendBatch(messages []string, tools []Tool, concurrency int) ([]ChatResult, error) {
+	if concurrency < 1 {
+		return nil, fmt.Errorf("batch concurrency must be at least 1, got %d", concurrency)
+	}
+	results := make([]ChatResult, len(messages))
+	group := errgroup.Group{}
+	group.SetLimit(concurrency)
+	for i, message := range messages {
+		group.Go(func() error {
+			content, functioncalls, err := c.sendRequestWithHistory(message, ROLE_USER, nil, tools, nil)
+			results[i] = ChatResult{
+				Content:       content,
+				FunctionCalls: functioncalls,
+				Err:           err,
+			}
+			return nil
+		})
+	}
+	group.Wait()
+	return results, nil
 }
 
 type Response struct {
@@ -258,53 +1228,298 @@ type Response struct {
 		Logprobs     interface{} `json:"logprobs"`
 		FinishReason string      `json:"finish_reason"`
 	} `json:"choices"`
-	Usage struct {
-		PromptTokens     int `json:"prompt_tokens"`
-		CompletionTokens int `json:"completion_tokens"`
-		TotalTokens      int `json:"total_tokens"`
-	} `json:"usage"`
+	Usage Usage `json:"usage"`
+	Error any   `json:"error,omitempty"` /// a string or an object depending on the backend
+}
+
+// The response had no choices, or its first choice had neither content nor tool calls
+type EmptyResponseError struct {
+	ResponseId   string
+	NoChoices    bool
+	FinishReason string /// e.g. stop, length or content_filter
+	APIError     string /// the top level error field of the body, if there was one
 }
 
-type DebugDecoder struct {
-	reader io.ReadCloser
+func (e *EmptyResponseError) Error() string {
+	msg := "empty response"
+	if e.NoChoices {
+		msg = "no choices found in response"
+	}
+	if e.ResponseId != "" {
+		msg += " " + e.ResponseId
+	}
+	if e.FinishReason != "" {
+		msg += " with finish reason " + e.FinishReason
+	}
+	if e.APIError != "" {
+		msg += ": " + e.APIError
+	}
+	return msg
+}
+
+// The response body couldn't be decoded. Offset is the byte offset of the error in the body, as
+// reported by encoding/json, and Snippet is the part of the body around it.
+type DecodeError struct {
+	Extractor string
+	Offset    int64
+	Snippet   string
+	Err       error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s: error decoding response at offset %d near %q: %v", e.Extractor, e.Offset, e.Snippet, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// How much of the body either side of the offset goes in a DecodeError's snippet
+const decodeSnippetLength = 40
+
+func newDecodeError(extractor string, data []byte, err error) *DecodeError {
+	offset := int64(len(data))
+	var syntaxerr *json.SyntaxError
+	var typeerr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxerr) {
+		offset = syntaxerr.Offset
+	} else if errors.As(err, &typeerr) {
+		offset = typeerr.Offset
+	}
+	offset = min(max(offset, 0), int64(len(data)))
+	start := max(offset-decodeSnippetLength, 0)
+	end := min(offset+decodeSnippetLength, int64(len(data)))
+	return &DecodeError{
+		Extractor: extractor,
+		Offset:    offset,
+		Snippet:   string(data[start:end]),
+		Err:       err,
+	}
+}
+
+func apiErrorMessage(apierr any) string {
+	switch e := apierr.(type) {
+	case nil:
+		return ""
+	case string:
+		return e
+	case map[string]any:
+		if msg, ok := e["message"].(string); ok {
+			return msg
+		}
+	}
+	data, _ := json.Marshal(apierr)
+	return string(data)
 }
 
-func (d *DebugDecoder) Read(p []byte) (n int, err error) {
-	n, err = d.reader.Read(p)
-	fmt.Println(string(p))
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+	//// Only some providers send the breakdowns, so these can be nil
+	PromptTokensDetails     *PromptTokensDetails     `json:"prompt_tokens_details,omitempty"`
+	CompletionTokensDetails *CompletionTokensDetails `json:"completion_tokens_details,omitempty"`
+}
+
+type PromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+	AudioTokens  int `json:"audio_tokens"`
+}
+
+type CompletionTokensDetails struct {
+	ReasoningTokens          int `json:"reasoning_tokens"`
+	AudioTokens              int `json:"audio_tokens"`
+	AcceptedPredictionTokens int `json:"accepted_prediction_tokens"`
+	RejectedPredictionTokens int `json:"rejected_prediction_tokens"`
+}
+
+// Wraps a reader, e.g. a response body, and logs each chunk read from it. Logger defaults to
+// slog.Default() and Level to debug.
+type DebugReadCloser struct {
+	Reader io.ReadCloser
+	Logger *slog.Logger
+	Level  *slog.Level
+}
+
+// Deprecated: use DebugReadCloser
+type DebugDecoder = DebugReadCloser
+
+// Wrap r so each chunk read from it is logged to l at debug level. A nil l logs to slog.Default().
+func NewDebugReadCloser(r io.ReadCloser, l *slog.Logger) *DebugReadCloser {
+	return &DebugReadCloser{Reader: r, Logger: l}
+}
+
+func infoLevel() *slog.Level {
+	level := slog.LevelInfo
+	return &level
+}
+
+func (d *DebugReadCloser) Read(p []byte) (n int, err error) {
+	n, err = d.Reader.Read(p)
+	logger := d.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	level := slog.LevelDebug
+	if d.Level != nil {
+		level = *d.Level
+	}
+	logger.Log(context.Background(), level, "read", "data", string(p[:n]), "err", err)
 	return n, err
 }
 
-func (d *DebugDecoder) Close() error {
-	return d.reader.Close()
+func (d *DebugReadCloser) Close() error {
+	return d.Reader.Close()
 }
 
+// Logs the body to slog.Default() at info level as it is read.
+//
+// Deprecated: use OpenAIJsonExtractor with WithDebug, which logs to the adaptor's logger
 func OpenAIJsonExtractorWithDebug(reader io.ReadCloser) (string, []FunctionCall, error) {
-	dbgdec := &DebugDecoder{reader: reader}
+	dbgdec := &DebugReadCloser{Reader: reader, Level: infoLevel()}
 
 	return OpenAIJsonExtractor(dbgdec)
 }
 
 // // Extract the content field from the first message _only_
 func OpenAIJsonExtractor(reader io.ReadCloser) (string, []FunctionCall, error) {
-	dec := json.NewDecoder(reader)
+	extracted, err := OpenAIJsonResponseExtractor(reader)
+	var decodeerr *DecodeError
+	if errors.As(err, &decodeerr) {
+		decodeerr.Extractor = "OpenAIJsonExtractor"
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return extracted.Content, extracted.FunctionCalls, nil
+}
+
+// Everything extracted from a response - the first choice's content and tool calls together
+// with the response's identifying fields
+type ExtractedResponse struct {
+	ResponseMeta
+	Content       string
+	ContentNull   bool   /// the content was JSON null, usually alongside function calls
+	Reasoning     string /// the reasoning of a streamed response, see StreamDelta.ReasoningContent
+	FunctionCalls []FunctionCall
+	FinishReason  string
+	Usage         Usage
+}
+
+// The assistant message to append to the history, with null content kept as null
+func (r ExtractedResponse) Message() Message {
+	return Message{
+		Role:        string(ROLE_AGENT),
+		Content:     r.Content,
+		ContentNull: r.ContentNull,
+		ToolCalls:   r.FunctionCalls,
+	}
+}
+
+// As OpenAIJsonExtractor, but also returns the response Id, SystemFingerprint etc. so they
+// can be logged or compared, e.g. to detect a model change when using a fixed seed
+func OpenAIJsonResponseExtractor(reader io.ReadCloser) (ExtractedResponse, error) {
 	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return ExtractedResponse{}, err
+	}
 
-	resp := Response{} // Ensure your Response struct is defined to expect FunctionCall within Message
-	err := dec.Decode(&resp)
+	resp := Response{}
+	err = json.Unmarshal(data, &resp)
 	if err != nil {
-		return "", nil, err
+		return ExtractedResponse{}, newDecodeError("OpenAIJsonResponseExtractor", data, err)
 	}
-	if len(resp.Choices) > 0 {
-		// Check for function call
-		if resp.Choices[0].Message.ToolCalls != nil {
-			return resp.Choices[0].Message.Content, resp.Choices[0].Message.ToolCalls, nil
+	//// Response can't tell a null content from "", so look at the raw content as well
+	contents := struct {
+		Choices []struct {
+			Message struct {
+				Content json.RawMessage `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}{}
+	_ = json.Unmarshal(data, &contents)
+	// No choices or unexpected response
+	if len(resp.Choices) == 0 {
+		return ExtractedResponse{}, &EmptyResponseError{
+			ResponseId: resp.Id,
+			NoChoices:  true,
+			APIError:   apiErrorMessage(resp.Error),
 		}
-		// No function call, return content
-		return resp.Choices[0].Message.Content, nil, nil
 	}
-	// No choices or unexpected response
-	return "", nil, fmt.Errorf("no choices found in response") // Or handle as appropriate
+	//// Some backends refuse by returning nothing at all
+	if resp.Choices[0].Message.Content == "" && len(resp.Choices[0].Message.ToolCalls) == 0 {
+		return ExtractedResponse{}, &EmptyResponseError{
+			ResponseId:   resp.Id,
+			FinishReason: resp.Choices[0].FinishReason,
+			APIError:     apiErrorMessage(resp.Error),
+		}
+	}
+	return ExtractedResponse{
+		ResponseMeta: ResponseMeta{
+			Id:                resp.Id,
+			Created:           resp.Created,
+			Model:             resp.Model,
+			SystemFingerprint: resp.SystemFingerprint,
+		},
+		Content:     resp.Choices[0].Message.Content,
+		ContentNull: len(contents.Choices) > 0 && string(contents.Choices[0].Message.Content) == "null",
+		//// nil if there is no function call
+		FunctionCalls: resp.Choices[0].Message.ToolCalls,
+		FinishReason:  resp.Choices[0].FinishReason,
+		Usage:         resp.Usage,
+	}, nil
+}
+
+// An extractor that scores the content of every choice (see GenerationParameters.N) with scorer and
+// returns the content and tool calls of the highest scoring choice. Equal scores are decided by the
+// length of the tool call arguments, longest first, then by the order of the choices. A choice for
+// which scorer panics scores -Inf.
+func OpenAIBestChoiceExtractor(scorer func(string) float64) ExtractResponse {
+	return func(reader io.ReadCloser) (string, []FunctionCall, error) {
+		defer reader.Close()
+		resp := Response{}
+		err := json.NewDecoder(reader).Decode(&resp)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(resp.Choices) == 0 {
+			return "", nil, &EmptyResponseError{
+				ResponseId: resp.Id,
+				NoChoices:  true,
+				APIError:   apiErrorMessage(resp.Error),
+			}
+		}
+		best, bestscore, bestargs := 0, math.Inf(-1), -1
+		for i, choice := range resp.Choices {
+			score := safeScore(scorer, choice.Message.Content)
+			args := 0
+			for _, call := range choice.Message.ToolCalls {
+				args += len(call.Function.Arguments)
+			}
+			if score > bestscore || (score == bestscore && args > bestargs) {
+				best, bestscore, bestargs = i, score, args
+			}
+		}
+		choice := resp.Choices[best]
+		if choice.Message.Content == "" && len(choice.Message.ToolCalls) == 0 {
+			return "", nil, &EmptyResponseError{
+				ResponseId:   resp.Id,
+				FinishReason: choice.FinishReason,
+				APIError:     apiErrorMessage(resp.Error),
+			}
+		}
+		return choice.Message.Content, choice.Message.ToolCalls, nil
+	}
+}
+
+func safeScore(scorer func(string) float64, content string) (score float64) {
+	defer func() {
+		if r := recover(); r != nil {
+			score = math.Inf(-1)
+		}
+	}()
+	return scorer(content)
 }
 
 func RawExtracter(reader io.ReadCloser) (string, []FunctionCall, error) {
@@ -317,6 +1532,49 @@ func RawExtracter(reader io.ReadCloser) (string, []FunctionCall, error) {
 	return string(data), nil, nil
 }
 
+// An extractor that tries each of the extractors in turn on the same (buffered) body and returns
+// the first result without an error. If they all fail the last error is returned.
+func ChainExtractors(extractors ...ExtractResponse) ExtractResponse {
+	return func(reader io.ReadCloser) (string, []FunctionCall, error) {
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return "", nil, err
+		}
+		lasterr := errors.New("no extractors to chain")
+		for _, extractor := range extractors {
+			content, functioncalls, err := extractor(io.NopCloser(bytes.NewReader(data)))
+			if err == nil {
+				return content, functioncalls, nil
+			}
+			lasterr = err
+		}
+		return "", nil, lasterr
+	}
+}
+
+// An extractor that uses fallback on the same (buffered) body if primary returns an error. If both
+// fail the error wraps both errors. WithFallbackExtractor(OpenAIJsonExtractor, RawExtracter) always
+// gives some content, even when the body can't be parsed.
+func WithFallbackExtractor(primary, fallback ExtractResponse) ExtractResponse {
+	return func(reader io.ReadCloser) (string, []FunctionCall, error) {
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return "", nil, err
+		}
+		content, functioncalls, primaryerr := primary(io.NopCloser(bytes.NewReader(data)))
+		if primaryerr == nil {
+			return content, functioncalls, nil
+		}
+		content, functioncalls, err = fallback(io.NopCloser(bytes.NewReader(data)))
+		if err != nil {
+			return "", nil, fmt.Errorf("primary extractor failed: %w, fallback extractor failed: %w", primaryerr, err)
+		}
+		return content, functioncalls, nil
+	}
+}
+
 // ///////////////////////////////////////////////////////////////////////
 //
 //	Question and Answer type models
@@ -332,10 +1590,10 @@ type QnAAdaptor struct {
 }
 
 func NewQnAAdaptor(apiurl, apikey, model string,
-	extractresp QnAExtractor, maxretries int) *QnAAdaptor {
+	extractresp QnAExtractor, maxretries int, opts ...Option) *QnAAdaptor {
 
 	ad := &QnAAdaptor{
-		BaseAdaptor: NewBaseAdaptor(apiurl, apikey, model, maxretries),
+		BaseAdaptor: NewBaseAdaptor(apiurl, apikey, model, maxretries, opts...),
 		extractor:   extractresp,
 	}
 	if extractresp == nil {
@@ -353,41 +1611,367 @@ type QnARequest struct {
 	Parameters map[string]any `json:"parameters,omitempty"` //// See the model playground API in HF for these
 }
 
-func (c *QnAAdaptor) SendQuestion(context, question string, params map[string]any) ([]QnAResponse, error) {
+func (c *QnAAdaptor) SendQuestion(qnacontext, question string, params map[string]any) ([]QnAResponse, error) {
+	return c.sendQuestion(context.Background(), qnacontext, question, params)
+}
+
+func (c *QnAAdaptor) sendQuestion(ctx context.Context, qnacontext, question string,
+	params map[string]any) ([]QnAResponse, error) {
+
 	req := QnARequest{
 		Inputs: QnAInputs{
-			Context:  context,
+			Context:  qnacontext,
 			Question: question,
 		},
 		Parameters: params,
 	}
-	resp, err := c.sendWithRetry(req)
-	handlers.PanicOnError(err)
+	resp, err := c.sendWithRetry(ctx, req, c.newRequestConfig(nil))
+	if err != nil {
+		return nil, err
+	}
 	return c.extractor(resp.Body)
 }
 
+// The HF question answering parameters. Nil fields are left out, so the model's defaults apply.
+type QnAParameters struct {
+	TopK                   *int  `json:"top_k,omitempty"`          /// the number of answers to return
+	MaxAnswerLen           *int  `json:"max_answer_len,omitempty"` /// in tokens
+	MaxSeqLen              *int  `json:"max_seq_len,omitempty"`    /// the tokens per chunk of context and question
+	MaxQuestionLen         *int  `json:"max_question_len,omitempty"`
+	DocStride              *int  `json:"doc_stride,omitempty"` /// the overlap between chunks of a long context
+	HandleImpossibleAnswer *bool `json:"handle_impossible_answer,omitempty"`
+	AlignToWords           *bool `json:"align_to_words,omitempty"`
+}
+
+// The parameters as the map taken by SendQuestion, SendQuestions and SearchContexts
+func (p QnAParameters) Map() map[string]any {
+	data, err := json.Marshal(p)
+	handlers.PanicOnError(err)
+	params := make(map[string]any)
+	err = json.Unmarshal(data, &params)
+	handlers.PanicOnError(err)
+	if len(params) == 0 {
+		return nil
+	}
+	return params
+}
+
+// As SendQuestion, with typed parameters
+func (c *QnAAdaptor) SendQuestionTyped(qnacontext, question string, params QnAParameters) ([]QnAResponse, error) {
+	return c.sendQuestion(context.Background(), qnacontext, question, params.Map())
+}
+
+var ErrNoConfidentAnswer = errors.New("no confident answer")
+
+// As SendQuestion, but only answers with a score of at least minScore are returned. If none of
+// the answers are good enough the result is empty, not an error - errors (wrapping ErrNoConfidentAnswer)
+// are only returned when the request itself fails.
+func (c *QnAAdaptor) SendQuestionAboveThreshold(ctx context.Context, qnacontext, question string, minScore float32,
+	params map[string]any) ([]QnAResponse, error) {
+
+	answers, err := c.sendQuestion(ctx, qnacontext, question, params)
+	if errors.Is(err, ErrBelowThreshold) {
+		//// The extractor has its own threshold (see QnAJsonResponseExtractorAbove), and no answer met it
+		return []QnAResponse{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNoConfidentAnswer, err)
+	}
+	confident := make([]QnAResponse, 0, len(answers))
+	for _, answer := range answers {
+		if answer.Score >= minScore {
+			confident = append(confident, answer)
+		}
+	}
+	return confident, nil
+}
+
+type QnABatchRequest struct {
+	Inputs     []QnAInputs    `json:"inputs"`
+	Parameters map[string]any `json:"parameters,omitempty"`
+}
+
+// Ask several questions about the same context in one request. The result has one slice of answers
+// per question, in the same order as the questions.
+func (c *QnAAdaptor) SendQuestions(ctx context.Context, qnacontext string, questions []string,
+	params map[string]any) ([][]QnAResponse, error) {
+
+	req := QnABatchRequest{
+		Inputs:     make([]QnAInputs, len(questions)),
+		Parameters: params,
+	}
+	for i, question := range questions {
+		req.Inputs[i] = QnAInputs{
+			Context:  qnacontext,
+			Question: question,
+		}
+	}
+	resp, err := c.sendWithRetry(ctx, req, c.newRequestConfig(nil))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	//// Models return either one answer per question, [answer1, answer2],
+	//// or the top k answers per question, [[answer1a, answer1b], [answer2a, answer2b]]
+	items := make([]json.RawMessage, 0)
+	err = json.NewDecoder(resp.Body).Decode(&items)
+	if err != nil {
+		return nil, err
+	}
+	answers := make([][]QnAResponse, 0, len(questions))
+	for _, item := range items {
+		item = bytes.TrimSpace(item)
+		if len(item) > 0 && item[0] == '[' {
+			topk := make([]QnAResponse, 0)
+			if err := json.Unmarshal(item, &topk); err != nil {
+				return nil, err
+			}
+			answers = append(answers, topk)
+			continue
+		}
+		answer := QnAResponse{}
+		if err := json.Unmarshal(item, &answer); err != nil {
+			return nil, err
+		}
+		answers = append(answers, []QnAResponse{answer})
+	}
+	//// A single question's top k answers come back as a flat list
+	if len(questions) == 1 && len(answers) > 1 {
+		flat := make([]QnAResponse, 0, len(answers))
+		for _, answer := range answers {
+			flat = append(flat, answer...)
+		}
+		answers = [][]QnAResponse{flat}
+	}
+	if len(answers) != len(questions) {
+		return nil, fmt.Errorf("expected answers for %d questions, got %d", len(questions), len(answers))
+	}
+	return answers, nil
+}
+
+// Ask the same question about each of the documents, e.g. the results of a retrieval step, in
+// parallel. All the answers are returned together, best score first, with Document set to the
+// index of the document each one came from. If any of the requests fails the rest are cancelled
+// and the error returned.
+func (c *QnAAdaptor) SearchContexts(ctx context.Context, documents []string, question string,
+	params map[string]any) ([]QnAResponse, error) {
+
+	perdocument := make([][]QnAResponse, len(documents))
+	group, groupctx := errgroup.WithContext(ctx)
+	for i, document := range documents {
+		group.Go(func() error {
+			answers, err := c.sendQuestion(groupctx, document, question, params)
+			if err != nil {
+				return fmt.Errorf("document %d: %w", i, err)
+			}
+			for j := range answers {
+				answers[j].Document = i
+			}
+			perdocument[i] = answers
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+
+	answers := make([]QnAResponse, 0, len(documents))
+	for _, docanswers := range perdocument {
+		answers = append(answers, docanswers...)
+	}
+	//// Stable, so equal scores stay in document order
+	sort.SliceStable(answers, func(i, j int) bool {
+		return answers[i].Score > answers[j].Score
+	})
+	return answers, nil
+}
+
+// Ask a question about a document too long for the model's context. The document is split into
+// chunks of at most chunkSize bytes, each overlapping the previous one by overlap bytes so an answer
+// across a boundary is still found, and the chunks are asked about in parallel. Chunks don't split
+// a UTF-8 character. Start and End of the answers are positions in the whole document, and answers
+// found in more than one chunk (in the overlaps) are returned once, with the best score. The answers
+// are sorted best score first. If any of the requests fails the rest are cancelled and the error
+// returned.
+func (c *QnAAdaptor) SendQuestionChunked(ctx context.Context, document, question string, chunkSize, overlap int,
+	params map[string]any) ([]QnAResponse, error) {
+
+	if chunkSize <= 0 || overlap < 0 || overlap >= chunkSize {
+		return nil, fmt.Errorf("invalid chunk size %d and overlap %d, need 0 <= overlap < chunk size", chunkSize, overlap)
+	}
+	chunks := chunkDocument(document, chunkSize, overlap)
+	perchunk := make([][]QnAResponse, len(chunks))
+	group, groupctx := errgroup.WithContext(ctx)
+	for i, chunk := range chunks {
+		group.Go(func() error {
+			answers, err := c.sendQuestion(groupctx, document[chunk.start:chunk.end], question, params)
+			if err != nil {
+				return fmt.Errorf("chunk %d: %w", i, err)
+			}
+			//// Answer positions are characters into the chunk
+			offset := utf8.RuneCountInString(document[:chunk.start])
+			for j := range answers {
+				answers[j].Start += offset
+				answers[j].End += offset
+			}
+			perchunk[i] = answers
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+
+	type span struct{ start, end int }
+	best := make(map[span]int)
+	answers := make([]QnAResponse, 0, len(chunks))
+	for _, chunkanswers := range perchunk {
+		for _, answer := range chunkanswers {
+			key := span{answer.Start, answer.End}
+			if i, found := best[key]; found {
+				if answer.Score > answers[i].Score {
+					answers[i] = answer
+				}
+				continue
+			}
+			best[key] = len(answers)
+			answers = append(answers, answer)
+		}
+	}
+	//// Stable, so equal scores stay in document order
+	sort.SliceStable(answers, func(i, j int) bool {
+		return answers[i].Score > answers[j].Score
+	})
+	return answers, nil
+}
+
+type documentChunk struct {
+	start, end int /// byte offsets into the document
+}
+
+func chunkDocument(document string, chunkSize, overlap int) []documentChunk {
+	chunks := make([]documentChunk, 0, len(document)/(chunkSize-overlap)+1)
+	start := 0
+	for {
+		end := min(start+chunkSize, len(document))
+		for end > start && end < len(document) && !utf8.RuneStart(document[end]) {
+			end--
+		}
+		//// A character longer than a chunk gets a chunk of its own
+		if end == start {
+			_, size := utf8.DecodeRuneInString(document[start:])
+			end = start + size
+		}
+		chunks = append(chunks, documentChunk{start: start, end: end})
+		if end >= len(document) {
+			return chunks
+		}
+		next := end - overlap
+		for next > start && !utf8.RuneStart(document[next]) {
+			next--
+		}
+		//// Always move forward, even if the overlap is most of a chunk of long characters
+		if next <= start {
+			next = end
+		}
+		start = next
+	}
+}
+
 type QnAResponse struct {
 	Answer string  `json:"answer"` //	string	The answer to the question.
 	Score  float32 `json:"score"`  // number	The probability associated to the answer.
 	Start  int     `json:"start"`  // The character position in the input where the answer begins.
 	End    int     `json:"end"`    // The character position in the input where the answer ends
+
+	Document int `json:"-"` /// the index of the document the answer came from, set by SearchContexts
+}
+
+var ErrInvalidSpan = errors.New("invalid answer span")
+
+// The answer's text taken from the context it was found in. Start and End are character
+// (not byte) positions, so the context is sliced by rune.
+func (r QnAResponse) ExtractSpan(context string) (string, error) {
+	runes := []rune(context)
+	if r.Start < 0 || r.End < r.Start || r.End > len(runes) {
+		return "", fmt.Errorf("%w: start %d, end %d, context length %d", ErrInvalidSpan, r.Start, r.End, len(runes))
+	}
+	return string(runes[r.Start:r.End]), nil
 }
 
+// Logs the body to slog.Default() at info level as it is read.
+//
+// Deprecated: use QnAJsonResponseExtractor with WithDebug, which logs to the adaptor's logger
 func QnAJsonResponseExtractorWithDebug(reader io.ReadCloser) ([]QnAResponse, error) {
-	dbgreader := &DebugDecoder{reader: reader}
+	dbgreader := &DebugReadCloser{Reader: reader, Level: infoLevel()}
 	return QnAJsonResponseExtractor(dbgreader)
 }
 
+// Extract the answers from an array of answers. Some deployments answer a single question with
+// the answer object on its own, which is returned as a one answer slice.
 func QnAJsonResponseExtractor(reader io.ReadCloser) ([]QnAResponse, error) {
 
-	//// Response should be an array
-	responses := make([]QnAResponse, 0)
-	dec := json.NewDecoder(reader)
 	defer reader.Close()
+	//// Buffered so a decode error can show the body around it
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		answer := QnAResponse{}
+		err = json.NewDecoder(bytes.NewReader(data)).Decode(&answer)
+		if err != nil {
+			return nil, newDecodeError("QnAJsonResponseExtractor", data, err)
+		}
+		return []QnAResponse{answer}, nil
+	}
+	return decodeQnAResponses("QnAJsonResponseExtractor", data)
+}
 
-	err := dec.Decode(&responses)
+// As QnAJsonResponseExtractor, but the response must be an array
+func QnAJsonResponseExtractorStrict(reader io.ReadCloser) ([]QnAResponse, error) {
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
 	if err != nil {
 		return nil, err
 	}
+	return decodeQnAResponses("QnAJsonResponseExtractorStrict", data)
+}
+
+// Returned by QnAJsonResponseExtractorAbove when none of the answers are good enough
+var ErrBelowThreshold = errors.New("no answer above the threshold")
+
+// An extractor that only returns the answers with a score of at least minScore. If none are good
+// enough it returns ErrBelowThreshold, so an uncertain model can be told apart from a failure.
+// SendQuestionAboveThreshold treats that as no good answer, and returns an empty result.
+func QnAJsonResponseExtractorAbove(minScore float32) QnAExtractor {
+	return func(reader io.ReadCloser) ([]QnAResponse, error) {
+		answers, err := QnAJsonResponseExtractor(reader)
+		if err != nil {
+			return nil, err
+		}
+		confident := make([]QnAResponse, 0, len(answers))
+		for _, answer := range answers {
+			if answer.Score >= minScore {
+				confident = append(confident, answer)
+			}
+		}
+		if len(confident) == 0 {
+			return nil, ErrBelowThreshold
+		}
+		return confident, nil
+	}
+}
+
+func decodeQnAResponses(extractor string, data []byte) ([]QnAResponse, error) {
+	//// Response should be an array
+	responses := make([]QnAResponse, 0)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&responses)
+	if err != nil {
+		return nil, newDecodeError(extractor, data, err)
+	}
 	return responses, nil
 }
@@ -1,13 +1,20 @@
 package hf
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 	"fmt"
 )
 
@@ -510,13 +517,38 @@ func TestQnAJsonResponseExtractor(t *testing.T) {
 		}
 	})
 
-	t.Run("IncorrectJSONStructureNotArray", func(t *testing.T) {
-		jsonString := `{"answer": "Test", "score": 0.5, "start": 0, "end": 3}` // Object instead of array
+	t.Run("SingleObject", func(t *testing.T) {
+		jsonString := ` {"answer": "Test", "score": 0.5, "start": 0, "end": 3}` // Object instead of array
 		reader := io.NopCloser(strings.NewReader(jsonString))
 
-		_, err := QnAJsonResponseExtractor(reader)
+		responses, err := QnAJsonResponseExtractor(reader)
+		expected := []QnAResponse{{Answer: "Test", Score: 0.5, Start: 0, End: 3}}
+		if err != nil || !reflect.DeepEqual(responses, expected) {
+			t.Fatalf("Expected the single answer as a slice %+v, got %+v, %v", expected, responses, err)
+		}
+
+		_, err = QnAJsonResponseExtractorStrict(io.NopCloser(strings.NewReader(jsonString)))
 		if err == nil {
-			t.Fatal("Expected an error for incorrect JSON structure (object instead of array), got nil")
+			t.Fatal("Expected an error for incorrect JSON structure (object instead of array) in strict mode, got nil")
+		}
+	})
+
+	t.Run("MalformedSingleObject", func(t *testing.T) {
+		jsonString := `{"answer": "Test", "score": "high"}`
+		reader := io.NopCloser(strings.NewReader(jsonString))
+
+		_, err := QnAJsonResponseExtractor(reader)
+		decodeerr := &DecodeError{}
+		if !errors.As(err, &decodeerr) || !strings.Contains(err.Error(), "QnAResponse.score") {
+			t.Fatalf("Expected the single object's decode error, got %v", err)
+		}
+	})
+
+	t.Run("StrictArray", func(t *testing.T) {
+		jsonString := `[{"answer": "Test", "score": 0.5, "start": 0, "end": 3}]`
+		responses, err := QnAJsonResponseExtractorStrict(io.NopCloser(strings.NewReader(jsonString)))
+		if err != nil || len(responses) != 1 || responses[0].Answer != "Test" {
+			t.Fatalf("Expected one answer in strict mode, got %+v, %v", responses, err)
 		}
 	})
 
@@ -533,3 +565,1419 @@ func TestQnAJsonResponseExtractor(t *testing.T) {
 		// For now, just checking for any error is sufficient.
 	})
 }
+
+func TestNewToolWithEnum(t *testing.T) {
+	tool := NewTool("get_current_weather", "Get the current weather in a given location", []ToolParameter{
+		{Name: "location", Type: "string", Description: "The city", Required: true},
+		{Name: "unit", Type: "string", Description: "Temperature unit", Enum: []string{"celsius", "fahrenheit"}},
+	})
+
+	unit := tool.Function.Parameters.Properties["unit"]
+	if !reflect.DeepEqual(unit.Enum, []string{"celsius", "fahrenheit"}) {
+		t.Errorf("Expected enum [celsius fahrenheit], got %v", unit.Enum)
+	}
+
+	jsonData, err := json.Marshal(tool)
+	if err != nil {
+		t.Fatalf("Failed to marshal Tool: %v", err)
+	}
+	expectedJson := `{"type":"function","function":{"name":"get_current_weather","description":"Get the current weather in a given location","parameters":{"type":"object","properties":{"location":{"type":"string","description":"The city"},"unit":{"type":"string","description":"Temperature unit","enum":["celsius","fahrenheit"]}},"required":["location"],"additionalProperties":false}}}`
+	same, err := compareJsonStrings(expectedJson, string(jsonData))
+	if err != nil {
+		t.Fatalf("Failed to compare JSON: %v", err)
+	}
+	if !same {
+		t.Errorf("Expected JSON:\n%s\nGot JSON:\n%s", expectedJson, string(jsonData))
+	}
+}
+
+func TestLastResponseMeta(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"object":"chat.completion","id":"chatcmpl-42","created":1718000000,"model":"test-model",` +
+			`"choices":[{"index":0,"message":{"role":"assistant","content":"","tool_calls":[{"id":"call_1","type":"function",` +
+			`"function":{"name":"get_user_weather","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	_, funcCalls, err := adaptor.SendRequestWithHistory("What's the weather?", []Message{}, nil)
+	if err != nil {
+		t.Fatalf("SendRequestWithHistory returned error: %v", err)
+	}
+	if len(funcCalls) != 1 {
+		t.Fatalf("Expected 1 function call, got %d", len(funcCalls))
+	}
+
+	meta := adaptor.LastResponseMeta()
+	if meta.Id != "chatcmpl-42" {
+		t.Errorf("Expected Id 'chatcmpl-42', got '%s'", meta.Id)
+	}
+	if meta.Created != 1718000000 {
+		t.Errorf("Expected Created 1718000000, got %d", meta.Created)
+	}
+	if meta.Model != "test-model" {
+		t.Errorf("Expected Model 'test-model', got '%s'", meta.Model)
+	}
+}
+
+func TestNewToolWithArrayParameter(t *testing.T) {
+	tool := NewTool("tag_document", "Tag a document", []ToolParameter{
+		{Name: "tags", Type: "array", ItemType: "string", Description: "The tags to apply", Required: true},
+	})
+
+	jsonData, err := json.Marshal(tool)
+	if err != nil {
+		t.Fatalf("Failed to marshal Tool: %v", err)
+	}
+	expectedJson := `{"type":"function","function":{"name":"tag_document","description":"Tag a document","parameters":{"type":"object","properties":{"tags":{"type":"array","description":"The tags to apply","items":{"type":"string"}}},"required":["tags"],"additionalProperties":false}}}`
+	same, err := compareJsonStrings(expectedJson, string(jsonData))
+	if err != nil {
+		t.Fatalf("Failed to compare JSON: %v", err)
+	}
+	if !same {
+		t.Errorf("Expected JSON:\n%s\nGot JSON:\n%s", expectedJson, string(jsonData))
+	}
+}
+
+func TestNewToolWithNestedObjectParameter(t *testing.T) {
+	tool := NewTool("create_event", "Create a calendar event", []ToolParameter{
+		{Name: "title", Type: "string", Required: true},
+		{Name: "location", Type: "object", Description: "Where the event is held", Required: true, Children: []ToolParameter{
+			{Name: "city", Type: "string", Required: true},
+			{Name: "address", Type: "object", Children: []ToolParameter{
+				{Name: "street", Type: "string", Required: true},
+				{Name: "postcode", Type: "string"},
+			}},
+		}},
+	})
+
+	jsonData, err := json.Marshal(tool)
+	if err != nil {
+		t.Fatalf("Failed to marshal Tool: %v", err)
+	}
+	expectedJson := `{"type":"function","function":{"name":"create_event","description":"Create a calendar event","parameters":{"type":"object","properties":{` +
+		`"title":{"type":"string"},` +
+		`"location":{"type":"object","description":"Where the event is held","properties":{` +
+		`"city":{"type":"string"},` +
+		`"address":{"type":"object","properties":{"street":{"type":"string"},"postcode":{"type":"string"}},"required":["street"]}` +
+		`},"required":["city"]}` +
+		`},"required":["title","location"],"additionalProperties":false}}}`
+	same, err := compareJsonStrings(expectedJson, string(jsonData))
+	if err != nil {
+		t.Fatalf("Failed to compare JSON: %v", err)
+	}
+	if !same {
+		t.Errorf("Expected JSON:\n%s\nGot JSON:\n%s", expectedJson, string(jsonData))
+	}
+}
+
+func TestToolFunctionParameterPropertiesAnyOfOneOf(t *testing.T) {
+	properties := ToolFunctionParameterProperties{
+		Description: "A user id or user name",
+		AnyOf: []*ToolFunctionParameterProperties{
+			{Type: "string"},
+			{Type: "integer"},
+		},
+	}
+	if err := properties.Validate(); err != nil {
+		t.Fatalf("Expected anyOf schema to be valid, got %v", err)
+	}
+	jsonData, err := json.Marshal(properties)
+	if err != nil {
+		t.Fatalf("Failed to marshal properties: %v", err)
+	}
+	expectedJson := `{"description":"A user id or user name","anyOf":[{"type":"string"},{"type":"integer"}]}`
+	same, err := compareJsonStrings(expectedJson, string(jsonData))
+	if err != nil {
+		t.Fatalf("Failed to compare JSON: %v", err)
+	}
+	if !same {
+		t.Errorf("Expected JSON:\n%s\nGot JSON:\n%s", expectedJson, string(jsonData))
+	}
+
+	properties = ToolFunctionParameterProperties{
+		OneOf: []*ToolFunctionParameterProperties{
+			{Type: "string"},
+			{Type: "boolean"},
+		},
+	}
+	jsonData, err = json.Marshal(properties)
+	if err != nil {
+		t.Fatalf("Failed to marshal properties: %v", err)
+	}
+	if string(jsonData) != `{"oneOf":[{"type":"string"},{"type":"boolean"}]}` {
+		t.Errorf("Unexpected oneOf JSON: %s", string(jsonData))
+	}
+
+	invalid := map[string]ToolFunctionParameterProperties{
+		"TypeAndAnyOf":  {Type: "string", AnyOf: []*ToolFunctionParameterProperties{{Type: "integer"}}},
+		"TypeAndOneOf":  {Type: "string", OneOf: []*ToolFunctionParameterProperties{{Type: "integer"}}},
+		"AnyOfAndOneOf": {AnyOf: []*ToolFunctionParameterProperties{{Type: "integer"}}, OneOf: []*ToolFunctionParameterProperties{{Type: "string"}}},
+		"NoneSet":       {Description: "no type"},
+		"InvalidNested": {AnyOf: []*ToolFunctionParameterProperties{{Type: "string", OneOf: []*ToolFunctionParameterProperties{{Type: "integer"}}}}},
+	}
+	for name, properties := range invalid {
+		if err := properties.Validate(); err == nil {
+			t.Errorf("%s: expected a validation error, got nil", name)
+		}
+	}
+}
+
+func TestFunctionCallArguments(t *testing.T) {
+	fc := FunctionCall{Id: "call_1", Type: "function"}
+	fc.Function.Name = "get_user_weather"
+	fc.Function.Arguments = `{"location": "London", "days": 3}`
+
+	var args struct {
+		Location string `json:"location"`
+		Days     int    `json:"days"`
+	}
+	if err := fc.UnmarshalArguments(&args); err != nil {
+		t.Fatalf("UnmarshalArguments returned error: %v", err)
+	}
+	if args.Location != "London" || args.Days != 3 {
+		t.Errorf("Unexpected arguments: %+v", args)
+	}
+
+	argsmap, err := fc.ArgumentsMap()
+	if err != nil {
+		t.Fatalf("ArgumentsMap returned error: %v", err)
+	}
+	expected := map[string]any{"location": "London", "days": float64(3)}
+	if !reflect.DeepEqual(argsmap, expected) {
+		t.Errorf("Expected %v, got %v", expected, argsmap)
+	}
+
+	fc.Function.Arguments = `{"location": `
+	if _, err := fc.ArgumentsMap(); err == nil || !strings.Contains(err.Error(), "get_user_weather") {
+		t.Errorf("Expected an error naming the function, got %v", err)
+	}
+}
+
+func TestMessageName(t *testing.T) {
+	named := NewNamedMessage(ROLE_USER, "researcher", "Find the capital of France")
+	jsonData, err := json.Marshal(named)
+	if err != nil {
+		t.Fatalf("Failed to marshal Message: %v", err)
+	}
+	if string(jsonData) != `{"role":"user","content":"Find the capital of France","name":"researcher"}` {
+		t.Errorf("Unexpected named message JSON: %s", string(jsonData))
+	}
+
+	unnamed := Message{Role: string(ROLE_USER), Content: "Hello"}
+	jsonData, err = json.Marshal(unnamed)
+	if err != nil {
+		t.Fatalf("Failed to marshal Message: %v", err)
+	}
+	if strings.Contains(string(jsonData), `"name"`) {
+		t.Errorf("Expected no name key for an unnamed message, got %s", string(jsonData))
+	}
+}
+
+func TestResponseUsage(t *testing.T) {
+	body := `{"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":120,"completion_tokens":80,"total_tokens":200,` +
+		`"prompt_tokens_details":{"cached_tokens":100},"completion_tokens_details":{"reasoning_tokens":64}}}`
+	resp := Response{}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	usage := resp.Usage
+	if usage.PromptTokens != 120 || usage.CompletionTokens != 80 || usage.TotalTokens != 200 {
+		t.Errorf("Unexpected token counts: %+v", usage)
+	}
+	if usage.PromptTokensDetails == nil || usage.PromptTokensDetails.CachedTokens != 100 {
+		t.Errorf("Expected 100 cached prompt tokens, got %+v", usage.PromptTokensDetails)
+	}
+	if usage.CompletionTokensDetails == nil || usage.CompletionTokensDetails.ReasoningTokens != 64 {
+		t.Errorf("Expected 64 reasoning tokens, got %+v", usage.CompletionTokensDetails)
+	}
+
+	//// Providers without the breakdowns
+	resp = Response{}
+	if err := json.Unmarshal([]byte(`{"usage":{"prompt_tokens":1,"completion_tokens":2,"total_tokens":3}}`), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Usage.PromptTokensDetails != nil || resp.Usage.CompletionTokensDetails != nil {
+		t.Errorf("Expected nil details, got %+v", resp.Usage)
+	}
+}
+
+func TestOpenAIJsonResponseExtractor(t *testing.T) {
+	body := `{"object":"chat.completion","id":"chatcmpl-7","created":1718000000,"model":"test-model","system_fingerprint":"fp_3.2.1",` +
+		`"choices":[{"index":0,"message":{"role":"assistant","content":"Paris"},"finish_reason":"stop"}],` +
+		`"usage":{"prompt_tokens":10,"completion_tokens":1,"total_tokens":11}}`
+
+	extracted, err := OpenAIJsonResponseExtractor(io.NopCloser(strings.NewReader(body)))
+	if err != nil {
+		t.Fatalf("OpenAIJsonResponseExtractor returned error: %v", err)
+	}
+	if extracted.Id != "chatcmpl-7" {
+		t.Errorf("Expected Id 'chatcmpl-7', got '%s'", extracted.Id)
+	}
+	if extracted.SystemFingerprint != "fp_3.2.1" {
+		t.Errorf("Expected SystemFingerprint 'fp_3.2.1', got '%s'", extracted.SystemFingerprint)
+	}
+	if extracted.Content != "Paris" || extracted.FinishReason != "stop" || extracted.Usage.TotalTokens != 11 {
+		t.Errorf("Unexpected extracted response: %+v", extracted)
+	}
+	if extracted.FunctionCalls != nil {
+		t.Errorf("Expected no function calls, got %+v", extracted.FunctionCalls)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	if _, err := adaptor.SendRequest("Capital of France?"); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if adaptor.LastResponseMeta().SystemFingerprint != "fp_3.2.1" {
+		t.Errorf("Expected the SystemFingerprint in the last response meta, got %+v", adaptor.LastResponseMeta())
+	}
+}
+
+func TestOpenAIJsonExtractorEmptyResponses(t *testing.T) {
+	t.Run("NoChoices", func(t *testing.T) {
+		body := `{"id":"chatcmpl-9","choices":[],"error":{"message":"Model is overloaded","type":"server_error"}}`
+		_, _, err := OpenAIJsonExtractor(io.NopCloser(strings.NewReader(body)))
+		var emptyerr *EmptyResponseError
+		if !errors.As(err, &emptyerr) {
+			t.Fatalf("Expected an EmptyResponseError, got %v", err)
+		}
+		if !emptyerr.NoChoices {
+			t.Error("Expected NoChoices to be set")
+		}
+		if emptyerr.APIError != "Model is overloaded" {
+			t.Errorf("Expected the API error message, got '%s'", emptyerr.APIError)
+		}
+	})
+
+	t.Run("EmptyContentWithStop", func(t *testing.T) {
+		body := `{"id":"chatcmpl-10","choices":[{"index":0,"message":{"role":"assistant","content":""},"finish_reason":"stop"}]}`
+		_, _, err := OpenAIJsonExtractor(io.NopCloser(strings.NewReader(body)))
+		var emptyerr *EmptyResponseError
+		if !errors.As(err, &emptyerr) {
+			t.Fatalf("Expected an EmptyResponseError, got %v", err)
+		}
+		if emptyerr.NoChoices {
+			t.Error("Expected NoChoices to be false")
+		}
+		if emptyerr.FinishReason != "stop" {
+			t.Errorf("Expected finish reason 'stop', got '%s'", emptyerr.FinishReason)
+		}
+		if emptyerr.ResponseId != "chatcmpl-10" {
+			t.Errorf("Expected response id 'chatcmpl-10', got '%s'", emptyerr.ResponseId)
+		}
+	})
+}
+
+func TestAIRequestExtra(t *testing.T) {
+	req := AIRequest{
+		Model:    "test-model",
+		Messages: []Message{{Role: string(ROLE_USER), Content: "Hi"}},
+		Extra: map[string]any{
+			"details": true,
+			"best_of": 2,
+			"model":   "ignored-model",
+		},
+	}
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("Failed to marshal AIRequest: %v", err)
+	}
+	expectedJson := `{"model":"test-model","messages":[{"role":"user","content":"Hi"}],"details":true,"best_of":2}`
+	same, err := compareJsonStrings(expectedJson, string(jsonData))
+	if err != nil {
+		t.Fatalf("Failed to compare JSON: %v", err)
+	}
+	if !same {
+		t.Errorf("Expected JSON:\n%s\nGot JSON:\n%s", expectedJson, string(jsonData))
+	}
+
+	//// Without Extra the output is unchanged
+	req.Extra = nil
+	jsonData, err = json.Marshal(req)
+	if err != nil {
+		t.Fatalf("Failed to marshal AIRequest: %v", err)
+	}
+	if string(jsonData) != `{"model":"test-model","messages":[{"role":"user","content":"Hi"}]}` {
+		t.Errorf("Unexpected JSON without extra fields: %s", string(jsonData))
+	}
+}
+
+func TestQnAAdaptor_SendQuestions(t *testing.T) {
+	qnacontext := "My name is Clara and I live in Berkeley."
+	questions := []string{"What is my name?", "Where do I live?"}
+
+	newServer := func(response string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var reqData QnABatchRequest
+			if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+				t.Errorf("Failed to decode request body: %v", err)
+			}
+			if len(reqData.Inputs) != len(questions) {
+				t.Errorf("Expected %d inputs, got %d", len(questions), len(reqData.Inputs))
+			}
+			for i, input := range reqData.Inputs {
+				if input.Context != qnacontext || input.Question != questions[i] {
+					t.Errorf("Unexpected input %d: %+v", i, input)
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(response))
+		}))
+	}
+
+	t.Run("OneAnswerPerQuestion", func(t *testing.T) {
+		server := newServer(`[{"answer":"Clara","score":0.9,"start":11,"end":16},{"answer":"Berkeley","score":0.8,"start":31,"end":39}]`)
+		defer server.Close()
+
+		adaptor := NewQnAAdaptor(server.URL, "test-key", "test-model", nil, 1)
+		answers, err := adaptor.SendQuestions(context.Background(), qnacontext, questions, nil)
+		if err != nil {
+			t.Fatalf("SendQuestions returned error: %v", err)
+		}
+		expected := [][]QnAResponse{
+			{{Answer: "Clara", Score: 0.9, Start: 11, End: 16}},
+			{{Answer: "Berkeley", Score: 0.8, Start: 31, End: 39}},
+		}
+		if !reflect.DeepEqual(answers, expected) {
+			t.Errorf("Expected %+v, got %+v", expected, answers)
+		}
+	})
+
+	t.Run("TopKPerQuestion", func(t *testing.T) {
+		server := newServer(`[[{"answer":"Clara","score":0.9,"start":11,"end":16},{"answer":"name","score":0.1,"start":3,"end":7}],` +
+			`[{"answer":"Berkeley","score":0.8,"start":31,"end":39}]]`)
+		defer server.Close()
+
+		adaptor := NewQnAAdaptor(server.URL, "test-key", "test-model", nil, 1)
+		answers, err := adaptor.SendQuestions(context.Background(), qnacontext, questions, map[string]any{"top_k": 2})
+		if err != nil {
+			t.Fatalf("SendQuestions returned error: %v", err)
+		}
+		if len(answers) != 2 || len(answers[0]) != 2 || len(answers[1]) != 1 {
+			t.Fatalf("Unexpected answers shape: %+v", answers)
+		}
+		if answers[0][1].Answer != "name" || answers[1][0].Answer != "Berkeley" {
+			t.Errorf("Unexpected answers: %+v", answers)
+		}
+	})
+
+	t.Run("WrongNumberOfAnswers", func(t *testing.T) {
+		server := newServer(`[{"answer":"Clara","score":0.9,"start":11,"end":16}]`)
+		defer server.Close()
+
+		adaptor := NewQnAAdaptor(server.URL, "test-key", "test-model", nil, 1)
+		if _, err := adaptor.SendQuestions(context.Background(), qnacontext, questions, nil); err == nil {
+			t.Error("Expected an error when the number of answers does not match the questions, got nil")
+		}
+	})
+}
+
+func TestSendRequestJSON(t *testing.T) {
+	type city struct {
+		Name       string   `json:"name"`
+		Country    string   `json:"country"`
+		Population int      `json:"population"`
+		Landmarks  []string `json:"landmarks"`
+	}
+	expected := city{Name: "Paris", Country: "France", Population: 2100000, Landmarks: []string{"Eiffel Tower", "Louvre"}}
+
+	var responseFormat *ResponseFormat
+	content := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqData AIRequest
+		json.NewDecoder(r.Body).Decode(&reqData)
+		responseFormat = reqData.ResponseFormat
+
+		response := map[string]any{
+			"id": "chatcmpl-1",
+			"choices": []map[string]any{
+				{"index": 0, "message": map[string]any{"role": "assistant", "content": content}, "finish_reason": "stop"},
+			},
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	data, _ := json.Marshal(expected)
+	content = string(data)
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "Reply with JSON.", OpenAIJsonExtractor, 1)
+	var actual city
+	if err := adaptor.SendRequestJSON("Describe Paris", nil, &actual); err != nil {
+		t.Fatalf("SendRequestJSON returned error: %v", err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, actual)
+	}
+	if responseFormat == nil || responseFormat.Type != "json_object" {
+		t.Errorf("Expected response_format json_object in the request, got %+v", responseFormat)
+	}
+
+	content = `{"name": "Paris", "country": `
+	err := adaptor.SendRequestJSON("Describe Paris", nil, &actual)
+	if err == nil {
+		t.Fatal("Expected an error for malformed JSON content, got nil")
+	}
+	if !strings.Contains(err.Error(), `{\"name\": \"Paris\", \"country\": `) {
+		t.Errorf("Expected the error to include the raw content, got %v", err)
+	}
+}
+
+func TestQnAAdaptor_SendQuestionAboveThreshold(t *testing.T) {
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			http.Error(w, "model crashed", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`[{"answer":"Clara","score":0.9,"start":11,"end":16},{"answer":"Berkeley","score":0.2,"start":31,"end":39}]`))
+	}))
+	defer server.Close()
+
+	adaptor := NewQnAAdaptor(server.URL, "test-key", "test-model", nil, 1)
+	answers, err := adaptor.SendQuestionAboveThreshold(context.Background(), "My name is Clara and I live in Berkeley.",
+		"What is my name?", 0.5, nil)
+	if err != nil {
+		t.Fatalf("SendQuestionAboveThreshold returned error: %v", err)
+	}
+	if len(answers) != 1 || answers[0].Answer != "Clara" {
+		t.Errorf("Expected only the confident answer, got %+v", answers)
+	}
+
+	answers, err = adaptor.SendQuestionAboveThreshold(context.Background(), "My name is Clara and I live in Berkeley.",
+		"What is my name?", 0.95, nil)
+	if err != nil {
+		t.Fatalf("Expected no error when no answer is confident enough, got %v", err)
+	}
+	if answers == nil || len(answers) != 0 {
+		t.Errorf("Expected an empty non-nil slice, got %#v", answers)
+	}
+
+	failing = true
+	_, err = adaptor.SendQuestionAboveThreshold(context.Background(), "My name is Clara and I live in Berkeley.",
+		"What is my name?", 0.5, nil)
+	if !errors.Is(err, ErrNoConfidentAnswer) {
+		t.Errorf("Expected ErrNoConfidentAnswer when the request fails, got %v", err)
+	}
+
+	//// With an extractor that has its own threshold, nothing good enough is still not an error
+	failing = false
+	adaptor = NewQnAAdaptor(server.URL, "test-key", "test-model", QnAJsonResponseExtractorAbove(0.95), 1)
+	answers, err = adaptor.SendQuestionAboveThreshold(context.Background(), "My name is Clara and I live in Berkeley.",
+		"What is my name?", 0.5, nil)
+	if err != nil {
+		t.Fatalf("Expected no error when the extractor finds no answer good enough, got %v", err)
+	}
+	if answers == nil || len(answers) != 0 {
+		t.Errorf("Expected an empty non-nil slice, got %#v", answers)
+	}
+}
+
+func TestQnAResponseExtractSpan(t *testing.T) {
+	qnacontext := "Je m'appelle Zoë et j'habite à Paris."
+
+	answer := QnAResponse{Answer: "Zoë", Start: 13, End: 16}
+	span, err := answer.ExtractSpan(qnacontext)
+	if err != nil {
+		t.Fatalf("ExtractSpan returned error: %v", err)
+	}
+	if span != "Zoë" {
+		t.Errorf("Expected 'Zoë', got '%s'", span)
+	}
+
+	//// After the multi-byte characters, byte slicing would be off by 2
+	answer = QnAResponse{Answer: "Paris", Start: 31, End: 36}
+	span, err = answer.ExtractSpan(qnacontext)
+	if err != nil {
+		t.Fatalf("ExtractSpan returned error: %v", err)
+	}
+	if span != "Paris" {
+		t.Errorf("Expected 'Paris', got '%s'", span)
+	}
+
+	for _, invalid := range []QnAResponse{{Start: -1, End: 3}, {Start: 5, End: 2}, {Start: 30, End: 38}} {
+		_, err := invalid.ExtractSpan(qnacontext)
+		if !errors.Is(err, ErrInvalidSpan) {
+			t.Errorf("Expected ErrInvalidSpan for %+v, got %v", invalid, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), "context length 37") {
+			t.Errorf("Expected the error to include the context length, got %v", err)
+		}
+	}
+}
+
+func TestAdaptorClone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqData AIRequest
+		json.NewDecoder(r.Body).Decode(&reqData)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","model":"` + reqData.Model + `","choices":[{"index":0,"message":{"role":"assistant","content":"Hello"}}]}`))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "small-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithMaxIdleConnsPerHost(4))
+	large := adaptor.Clone(WithModel("large-model"))
+
+	if _, err := large.SendRequest("Hi"); err != nil {
+		t.Fatalf("SendRequest on the clone returned error: %v", err)
+	}
+	if large.LastResponseMeta().Model != "large-model" {
+		t.Errorf("Expected the clone to use 'large-model', got '%s'", large.LastResponseMeta().Model)
+	}
+	if adaptor.model != "small-model" {
+		t.Errorf("Expected the original model to be unchanged, got '%s'", adaptor.model)
+	}
+	if adaptor.LastResponseMeta().Model != "" {
+		t.Errorf("Expected the clone's response meta not to be shared, got %+v", adaptor.LastResponseMeta())
+	}
+	if large.apiKey != adaptor.apiKey || large.apiURL != adaptor.apiURL || large.baseinstruct != adaptor.baseinstruct {
+		t.Error("Expected the clone to keep the adaptor's configuration")
+	}
+	if large.BaseAdaptor.client.Transport != adaptor.BaseAdaptor.client.Transport {
+		t.Error("Expected the clone to share the connection pool")
+	}
+
+	//// Tuning the clone's transport leaves the original alone
+	tuned := adaptor.Clone(WithMaxIdleConnsPerHost(16))
+	if tuned.BaseAdaptor.client.Transport == adaptor.BaseAdaptor.client.Transport {
+		t.Fatal("Expected the clone to get its own transport")
+	}
+	if adaptor.transport().MaxIdleConnsPerHost != 4 || tuned.transport().MaxIdleConnsPerHost != 16 {
+		t.Errorf("Expected 4 and 16 idle connections per host, got %d and %d",
+			adaptor.transport().MaxIdleConnsPerHost, tuned.transport().MaxIdleConnsPerHost)
+	}
+}
+
+func TestAdaptorSetModel(t *testing.T) {
+	var lock sync.Mutex
+	models := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqData AIRequest
+		json.NewDecoder(r.Body).Decode(&reqData)
+		lock.Lock()
+		models = append(models, reqData.Model)
+		lock.Unlock()
+		w.Write([]byte(`{"id":"chatcmpl-1","choices":[{"index":0,"message":{"role":"assistant","content":"Hello"}}]}`))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "model-a", "You are an assistant.", OpenAIJsonExtractor, 1)
+	if adaptor.Model() != "model-a" {
+		t.Errorf("Expected model 'model-a', got '%s'", adaptor.Model())
+	}
+
+	//// Switch while other requests are in flight
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			adaptor.SendRequest("Hi")
+		}()
+	}
+	adaptor.SetModel("model-b")
+	wg.Wait()
+
+	if adaptor.Model() != "model-b" {
+		t.Errorf("Expected model 'model-b', got '%s'", adaptor.Model())
+	}
+	if _, err := adaptor.SendRequest("Hi"); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if models[len(models)-1] != "model-b" {
+		t.Errorf("Expected the next request to use 'model-b', got '%s'", models[len(models)-1])
+	}
+}
+
+func TestQnAAdaptor_SearchContexts(t *testing.T) {
+	documents := []string{
+		"Paris is the capital of France.",
+		"Berlin is the capital of Germany.",
+		"The capital of Italy is Rome.",
+	}
+	answers := map[string]string{
+		documents[0]: `[{"answer":"Paris","score":0.5,"start":0,"end":5}]`,
+		documents[1]: `[{"answer":"Berlin","score":0.9,"start":0,"end":6},{"answer":"Germany","score":0.1,"start":25,"end":32}]`,
+		documents[2]: `[{"answer":"Rome","score":0.7,"start":24,"end":28}]`,
+	}
+
+	//// Hold every request until all of them have arrived, which only happens if they are sent in parallel
+	var arrived sync.WaitGroup
+	arrived.Add(len(documents))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqData QnARequest
+		if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		arrived.Done()
+		arrived.Wait()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(answers[reqData.Inputs.Context]))
+	}))
+	defer server.Close()
+
+	adaptor := NewQnAAdaptor(server.URL, "test-key", "test-model", nil, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	results, err := adaptor.SearchContexts(ctx, documents, "What is the capital?", nil)
+	if err != nil {
+		t.Fatalf("SearchContexts returned error: %v", err)
+	}
+	expected := []QnAResponse{
+		{Answer: "Berlin", Score: 0.9, Start: 0, End: 6, Document: 1},
+		{Answer: "Rome", Score: 0.7, Start: 24, End: 28, Document: 2},
+		{Answer: "Paris", Score: 0.5, Start: 0, End: 5, Document: 0},
+		{Answer: "Germany", Score: 0.1, Start: 25, End: 32, Document: 1},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, results)
+	}
+	span, err := results[1].ExtractSpan(documents[results[1].Document])
+	if err != nil || span != "Rome" {
+		t.Errorf("Expected the span 'Rome' from the answer's document, got '%s', %v", span, err)
+	}
+}
+
+func TestQnAAdaptor_SearchContextsError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqData QnARequest
+		json.NewDecoder(r.Body).Decode(&reqData)
+		if reqData.Inputs.Context == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"answer":"ok","score":0.5,"start":0,"end":2}]`))
+	}))
+	defer server.Close()
+
+	adaptor := NewQnAAdaptor(server.URL, "test-key", "test-model", nil, 1)
+	_, err := adaptor.SearchContexts(context.Background(), []string{"ok", "bad", "ok"}, "Question?", nil)
+	if err == nil || !strings.Contains(err.Error(), "document 1") {
+		t.Errorf("Expected an error for document 1, got %v", err)
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	var lock sync.Mutex
+	inflight, maxinflight := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		inflight++
+		maxinflight = max(maxinflight, inflight)
+		lock.Unlock()
+		defer func() {
+			lock.Lock()
+			inflight--
+			lock.Unlock()
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		var reqData AIRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		message := reqData.Messages[len(reqData.Messages)-1].Content
+		if strings.HasPrefix(message, "fail") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"echo %s"},"finish_reason":"stop"}]}`, message)
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	messages := []string{"one", "fail two", "three", "four", "fail five", "six", "seven", "eight"}
+	results, err := adaptor.SendBatch(messages, nil, 3)
+	if err != nil {
+		t.Fatalf("SendBatch returned error: %v", err)
+	}
+	if len(results) != len(messages) {
+		t.Fatalf("Expected %d results, got %d", len(messages), len(results))
+	}
+	for i, message := range messages {
+		if strings.HasPrefix(message, "fail") {
+			if results[i].Err == nil {
+				t.Errorf("Expected an error for message %d", i)
+			}
+			continue
+		}
+		if results[i].Err != nil || results[i].Content != "echo "+message {
+			t.Errorf("Expected 'echo %s' for message %d, got '%s', %v", message, i, results[i].Content, results[i].Err)
+		}
+	}
+	if maxinflight > 3 {
+		t.Errorf("Expected at most 3 requests in flight, got %d", maxinflight)
+	}
+
+	if _, err := adaptor.SendBatch(messages, nil, 0); err == nil {
+		t.Error("Expected an error for a concurrency of 0")
+	}
+}
+
+func TestChainExtractors(t *testing.T) {
+	failing := func(err error) ExtractResponse {
+		return func(reader io.ReadCloser) (string, []FunctionCall, error) {
+			io.ReadAll(reader)
+			return "", nil, err
+		}
+	}
+	errfirst, errsecond := errors.New("first"), errors.New("second")
+
+	chained := ChainExtractors(failing(errfirst), OpenAIJsonExtractor, RawExtracter)
+	content, _, err := chained(io.NopCloser(strings.NewReader(testChatResponse)))
+	if err != nil || content != "Hello" {
+		t.Errorf("Expected the JSON extractor's 'Hello', got '%s', %v", content, err)
+	}
+	//// Not JSON, so the raw extractor gets the whole body
+	content, _, err = chained(io.NopCloser(strings.NewReader("upstream timeout")))
+	if err != nil || content != "upstream timeout" {
+		t.Errorf("Expected the raw body, got '%s', %v", content, err)
+	}
+
+	_, _, err = ChainExtractors(failing(errfirst), failing(errsecond))(io.NopCloser(strings.NewReader("x")))
+	if !errors.Is(err, errsecond) {
+		t.Errorf("Expected the last error, got %v", err)
+	}
+	if _, _, err := ChainExtractors()(io.NopCloser(strings.NewReader("x"))); err == nil {
+		t.Error("Expected an error with no extractors")
+	}
+}
+
+func TestWithFallbackExtractor(t *testing.T) {
+	errprimary, errfallback := errors.New("primary"), errors.New("fallback")
+	failing := func(err error) ExtractResponse {
+		return func(reader io.ReadCloser) (string, []FunctionCall, error) {
+			io.ReadAll(reader)
+			return "", nil, err
+		}
+	}
+	extractor := WithFallbackExtractor(OpenAIJsonExtractor, RawExtracter)
+
+	t.Run("PrimarySucceeds", func(t *testing.T) {
+		content, _, err := extractor(io.NopCloser(strings.NewReader(testChatResponse)))
+		if err != nil || content != "Hello" {
+			t.Errorf("Expected 'Hello', got '%s', %v", content, err)
+		}
+	})
+
+	t.Run("FallbackSucceeds", func(t *testing.T) {
+		content, _, err := extractor(io.NopCloser(strings.NewReader("<html>Bad gateway</html>")))
+		if err != nil || content != "<html>Bad gateway</html>" {
+			t.Errorf("Expected the raw body, got '%s', %v", content, err)
+		}
+	})
+
+	t.Run("BothFail", func(t *testing.T) {
+		_, _, err := WithFallbackExtractor(failing(errprimary), failing(errfallback))(io.NopCloser(strings.NewReader("x")))
+		if !errors.Is(err, errprimary) || !errors.Is(err, errfallback) {
+			t.Errorf("Expected both errors, got %v", err)
+		}
+	})
+}
+
+func TestOpenAIBestChoiceExtractor(t *testing.T) {
+	body := `{"id":"chatcmpl-1","choices":[` +
+		`{"index":0,"message":{"role":"assistant","content":"Short"},"finish_reason":"stop"},` +
+		`{"index":1,"message":{"role":"assistant","content":"The longest answer"},"finish_reason":"stop"},` +
+		`{"index":2,"message":{"role":"assistant","content":"Medium answer"},"finish_reason":"stop"}]}`
+	length := func(content string) float64 {
+		return float64(len(content))
+	}
+
+	t.Run("HighestScore", func(t *testing.T) {
+		content, _, err := OpenAIBestChoiceExtractor(length)(io.NopCloser(strings.NewReader(body)))
+		if err != nil || content != "The longest answer" {
+			t.Errorf("Expected 'The longest answer', got '%s', %v", content, err)
+		}
+	})
+
+	t.Run("ScorerPanics", func(t *testing.T) {
+		scorer := func(content string) float64 {
+			if strings.HasPrefix(content, "The") {
+				panic("cannot score")
+			}
+			return length(content)
+		}
+		content, _, err := OpenAIBestChoiceExtractor(scorer)(io.NopCloser(strings.NewReader(body)))
+		if err != nil || content != "Medium answer" {
+			t.Errorf("Expected 'Medium answer', got '%s', %v", content, err)
+		}
+	})
+
+	t.Run("ToolCallTieBreak", func(t *testing.T) {
+		body := `{"id":"chatcmpl-1","choices":[` +
+			`{"index":0,"message":{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function",` +
+			`"function":{"name":"get_user_weather","arguments":"{}"}}]},"finish_reason":"tool_calls"},` +
+			`{"index":1,"message":{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function",` +
+			`"function":{"name":"get_user_weather","arguments":"{\"location\":\"Paris\"}"}}]},"finish_reason":"tool_calls"}]}`
+		_, calls, err := OpenAIBestChoiceExtractor(length)(io.NopCloser(strings.NewReader(body)))
+		if err != nil || len(calls) != 1 || calls[0].Function.Arguments != `{"location":"Paris"}` {
+			t.Errorf("Expected the call with the longest arguments, got %+v, %v", calls, err)
+		}
+	})
+
+	t.Run("NoChoices", func(t *testing.T) {
+		_, _, err := OpenAIBestChoiceExtractor(length)(io.NopCloser(strings.NewReader(`{"id":"chatcmpl-1","choices":[]}`)))
+		var emptyerr *EmptyResponseError
+		if !errors.As(err, &emptyerr) || !emptyerr.NoChoices {
+			t.Errorf("Expected an EmptyResponseError, got %v", err)
+		}
+	})
+}
+
+func TestQnAAdaptor_SendQuestionTyped(t *testing.T) {
+	var body map[string]json.RawMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = make(map[string]json.RawMessage)
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"answer":"Clara","score":0.9,"start":11,"end":16}]`))
+	}))
+	defer server.Close()
+
+	adaptor := NewQnAAdaptor(server.URL, "test-key", "test-model", nil, 1)
+	topk, maxanswerlen, impossible := 3, 15, true
+	params := QnAParameters{TopK: &topk, MaxAnswerLen: &maxanswerlen, HandleImpossibleAnswer: &impossible}
+	answers, err := adaptor.SendQuestionTyped("My name is Clara.", "What is my name?", params)
+	if err != nil {
+		t.Fatalf("SendQuestionTyped returned error: %v", err)
+	}
+	if len(answers) != 1 || answers[0].Answer != "Clara" {
+		t.Errorf("Unexpected answers %+v", answers)
+	}
+	expected := `{"top_k":3,"max_answer_len":15,"handle_impossible_answer":true}`
+	if equal, err := compareJsonStrings(string(body["parameters"]), expected); err != nil || !equal {
+		t.Errorf("Expected parameters %s, got %s", expected, body["parameters"])
+	}
+
+	//// Without any parameters set, parameters is left out of the request
+	if _, err := adaptor.SendQuestionTyped("My name is Clara.", "What is my name?", QnAParameters{}); err != nil {
+		t.Fatalf("SendQuestionTyped returned error: %v", err)
+	}
+	if _, ok := body["parameters"]; ok {
+		t.Errorf("Expected no parameters, got %s", body["parameters"])
+	}
+}
+
+func TestContinueWithToolResults(t *testing.T) {
+	var reqData map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqData = make(map[string]any)
+		json.NewDecoder(r.Body).Decode(&reqData)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"index":0,"message":{"role":"assistant","content":"Paris is 20 and Rome is 25 degrees."},"finish_reason":"stop"}]}`))
+	}))
+	defer server.Close()
+
+	paris := newTestFunctionCall("get_user_weather", `{"location":"Paris"}`)
+	paris.Id = "call_1"
+	rome := newTestFunctionCall("get_user_weather", `{"location":"Rome"}`)
+	rome.Id = "call_2"
+	calls := []FunctionCall{paris, rome}
+	history := []Message{
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant", Content: "Hello"},
+	}
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithRequestValidation())
+	content, _, err := adaptor.ContinueWithToolResults("Weather in Paris and Rome?", history, calls,
+		map[string]string{"call_2": `{"temp": 25}`, "call_1": `{"temp": 20}`}, nil)
+	if err != nil {
+		t.Fatalf("ContinueWithToolResults returned error: %v", err)
+	}
+	if content != "Paris is 20 and Rome is 25 degrees." {
+		t.Errorf("Unexpected content '%s'", content)
+	}
+
+	messages, _ := json.Marshal(reqData["messages"])
+	expected := `[
+		{"role": "system", "content": "You are an assistant."},
+		{"role": "user", "content": "Hi"},
+		{"role": "assistant", "content": "Hello"},
+		{"role": "user", "content": "Weather in Paris and Rome?"},
+		{"role": "assistant", "content": null, "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"description": null, "name": "get_user_weather", "arguments": "{\"location\":\"Paris\"}"}},
+			{"id": "call_2", "type": "function", "function": {"description": null, "name": "get_user_weather", "arguments": "{\"location\":\"Rome\"}"}}
+		]},
+		{"role": "tool", "content": "{\"temp\": 20}", "tool_call_id": "call_1"},
+		{"role": "tool", "content": "{\"temp\": 25}", "tool_call_id": "call_2"}
+	]`
+	if equal, err := compareJsonStrings(string(messages), expected); err != nil || !equal {
+		t.Errorf("Unexpected messages:\n%s", messages)
+	}
+
+	_, _, err = adaptor.ContinueWithToolResults("Weather in Paris and Rome?", history, calls,
+		map[string]string{"call_1": `{"temp": 20}`}, nil)
+	if err == nil || !strings.Contains(err.Error(), "call_2") {
+		t.Errorf("Expected an error for the missing result, got %v", err)
+	}
+}
+
+func TestMessageNullContent(t *testing.T) {
+	messages := []Message{}
+	err := json.Unmarshal([]byte(`[{"role":"assistant","content":null,"tool_calls":[]},{"role":"assistant","content":""},{"role":"user"}]`), &messages)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal messages: %v", err)
+	}
+	if !messages[0].ContentNull || messages[1].ContentNull || messages[2].ContentNull {
+		t.Errorf("Expected only the first message to have null content, got %+v", messages)
+	}
+
+	//// Round trip - null stays null and "" stays ""
+	data, err := json.Marshal(messages[:2])
+	if err != nil {
+		t.Fatalf("Failed to marshal messages: %v", err)
+	}
+	expected := `[{"role":"assistant","content":null},{"role":"assistant","content":""}]`
+	if equal, err := compareJsonStrings(string(data), expected); err != nil || !equal {
+		t.Errorf("Expected %s, got %s", expected, data)
+	}
+
+	//// Content wins over ContentNull
+	data, _ = json.Marshal(Message{Role: "assistant", Content: "Hi", ContentNull: true})
+	if equal, err := compareJsonStrings(string(data), `{"role":"assistant","content":"Hi"}`); err != nil || !equal {
+		t.Errorf("Expected the content to be kept, got %s", data)
+	}
+}
+
+func TestMessageToolCallOnlyContent(t *testing.T) {
+	call := newTestFunctionCall("get_user_weather", `{}`)
+	tests := []struct {
+		name     string
+		message  Message
+		expected string
+	}{
+		{"tool calls only", Message{Role: "assistant", ToolCalls: []FunctionCall{call}},
+			`{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function",` +
+				`"function":{"description":null,"name":"get_user_weather","arguments":"{}"}}]}`},
+		{"function call only", Message{Role: "assistant", FunctionCall: &call},
+			`{"role":"assistant","content":null,"function_call":{"id":"call_1","type":"function",` +
+				`"function":{"description":null,"name":"get_user_weather","arguments":"{}"}}}`},
+		{"normal text", Message{Role: "assistant", Content: "Hello"}, `{"role":"assistant","content":"Hello"}`},
+		{"empty text", Message{Role: "user"}, `{"role":"user","content":""}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.message)
+			if err != nil {
+				t.Fatalf("Failed to marshal message: %v", err)
+			}
+			if equal, err := compareJsonStrings(string(data), tt.expected); err != nil || !equal {
+				t.Errorf("Expected %s, got %s", tt.expected, data)
+			}
+		})
+	}
+}
+
+func TestOpenAIJsonResponseExtractorNullContent(t *testing.T) {
+	body := `{"id":"chatcmpl-1","choices":[{"index":0,"message":{"role":"assistant","content":null,"tool_calls":[` +
+		`{"id":"call_1","type":"function","function":{"name":"get_user_weather","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`
+	extracted, err := OpenAIJsonResponseExtractor(io.NopCloser(strings.NewReader(body)))
+	if err != nil {
+		t.Fatalf("OpenAIJsonResponseExtractor returned error: %v", err)
+	}
+	if !extracted.ContentNull {
+		t.Error("Expected ContentNull for a null content")
+	}
+	data, _ := json.Marshal(extracted.Message())
+	if !strings.Contains(string(data), `"content":null`) {
+		t.Errorf("Expected the history message to keep the null content, got %s", data)
+	}
+
+	extracted, err = OpenAIJsonResponseExtractor(io.NopCloser(strings.NewReader(testChatResponse)))
+	if err != nil || extracted.ContentNull {
+		t.Errorf("Expected content without ContentNull, got %+v, %v", extracted, err)
+	}
+}
+
+func TestNewAssistantToolCallMessage(t *testing.T) {
+	call := newTestFunctionCall("get_user_weather", `{"location":"Paris"}`)
+	data, err := json.Marshal(NewAssistantToolCallMessage([]FunctionCall{call}))
+	if err != nil {
+		t.Fatalf("Failed to marshal message: %v", err)
+	}
+	expected := `{"role": "assistant", "content": null, "tool_calls": [
+		{"id": "call_1", "type": "function", "function": {"description": null, "name": "get_user_weather", "arguments": "{\"location\":\"Paris\"}"}}
+	]}`
+	if equal, err := compareJsonStrings(string(data), expected); err != nil || !equal {
+		t.Errorf("Expected %s, got %s", expected, data)
+	}
+	if strings.Contains(string(data), "function_call") {
+		t.Errorf("Expected no function_call field, got %s", data)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	padding := strings.Repeat(" ", 100)
+	body := `{"id": "chatcmpl-1",` + padding + `"choices": [{"message": {"content": "Hi"}}}` + padding + `]}`
+	_, _, err := OpenAIJsonExtractor(io.NopCloser(strings.NewReader(body)))
+	decodeerr := &DecodeError{}
+	if !errors.As(err, &decodeerr) {
+		t.Fatalf("Expected a DecodeError, got %v", err)
+	}
+	if decodeerr.Extractor != "OpenAIJsonExtractor" || decodeerr.Offset != int64(strings.Index(body, "}}}")+3) {
+		t.Errorf("Expected the extractor name and offset of the extra brace, got %+v", decodeerr)
+	}
+	if !strings.Contains(decodeerr.Snippet, `"Hi"}}}`) || strings.Contains(decodeerr.Snippet, "chatcmpl-1") ||
+		!strings.Contains(err.Error(), fmt.Sprintf("%q", decodeerr.Snippet)) {
+		t.Errorf("Expected the body around the error in the snippet, got %q", decodeerr.Snippet)
+	}
+	syntaxerr := &json.SyntaxError{}
+	if !errors.As(err, &syntaxerr) {
+		t.Errorf("Expected the json error to be wrapped, got %v", err)
+	}
+
+	_, err = QnAJsonResponseExtractor(io.NopCloser(strings.NewReader(`[{"answer": "Test", "score": "high"}]`)))
+	if !errors.As(err, &decodeerr) || decodeerr.Extractor != "QnAJsonResponseExtractor" ||
+		!strings.Contains(decodeerr.Snippet, `"score": "high"`) {
+		t.Errorf("Expected a DecodeError around the wrongly typed score, got %v", err)
+	}
+
+	//// A truncated body fails at its end
+	_, err = OpenAIJsonResponseExtractor(io.NopCloser(strings.NewReader(`{"choices": [`)))
+	if !errors.As(err, &decodeerr) || decodeerr.Offset != 13 || decodeerr.Snippet != `{"choices": [` {
+		t.Errorf("Expected a DecodeError at the end of the body, got %v", err)
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestDebugReadCloser(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	body := &closeRecorder{Reader: strings.NewReader(testChatResponse)}
+	reader := NewDebugReadCloser(body, logger)
+	content, _, err := OpenAIJsonExtractor(reader)
+	if err != nil || content != "Hello" {
+		t.Fatalf("Expected the wrapped body to be extracted, got '%s', %v", content, err)
+	}
+	if !body.closed {
+		t.Error("Expected Close to close the wrapped reader")
+	}
+	if !strings.Contains(logs.String(), "level=DEBUG msg=read") || !strings.Contains(logs.String(), "chatcmpl") {
+		t.Errorf("Expected the chunks read to be logged at debug level, got %s", logs.String())
+	}
+
+	//// Only what was read is logged, not the rest of the buffer
+	logs.Reset()
+	buf := []byte("xxxxxxxx")
+	n, _ := NewDebugReadCloser(io.NopCloser(strings.NewReader("ab")), logger).Read(buf)
+	if n != 2 || !strings.Contains(logs.String(), "data=ab ") {
+		t.Errorf("Expected only the 2 bytes read to be logged, got %s", logs.String())
+	}
+
+	//// The zero value logs at debug level too, to slog.Default()
+	logs.Reset()
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+	zero := DebugReadCloser{Reader: io.NopCloser(strings.NewReader("ab"))}
+	zero.Read(buf)
+	if !strings.Contains(logs.String(), "level=DEBUG msg=read") {
+		t.Errorf("Expected a DebugReadCloser literal to log at debug level, got %s", logs.String())
+	}
+}
+
+func TestOpenAIJsonExtractorWithDebug(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	content, _, err := OpenAIJsonExtractorWithDebug(io.NopCloser(strings.NewReader(testChatResponse)))
+	if err != nil || content != "Hello" {
+		t.Fatalf("Expected the body to be extracted, got '%s', %v", content, err)
+	}
+	if !strings.Contains(logs.String(), "level=INFO msg=read") {
+		t.Errorf("Expected the body to be logged at the default level, got %s", logs.String())
+	}
+}
+
+func TestQnAAdaptor_SendQuestionChunked(t *testing.T) {
+	document := "Les cafés à Genève ferment tôt. The capital of France is Paris. Les musées rouvrent à l'été."
+	var lock sync.Mutex
+	contexts := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqData QnARequest
+		json.NewDecoder(r.Body).Decode(&reqData)
+		chunk := reqData.Inputs.Context
+		lock.Lock()
+		contexts = append(contexts, chunk)
+		lock.Unlock()
+		//// Every chunk answers with its first character, and chunks containing Paris with Paris
+		first, _ := utf8.DecodeRuneInString(chunk)
+		answers := []QnAResponse{{Answer: string(first), Score: 0.1, Start: 0, End: 1}}
+		if i := strings.Index(chunk, "Paris"); i >= 0 {
+			start := utf8.RuneCountInString(chunk[:i])
+			answers = append(answers, QnAResponse{Answer: "Paris", Score: 0.9, Start: start, End: start + 5})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(answers)
+	}))
+	defer server.Close()
+
+	adaptor := NewQnAAdaptor(server.URL, "test-key", "test-model", nil, 1)
+	results, err := adaptor.SendQuestionChunked(context.Background(), document, "What is the capital of France?", 40, 20, nil)
+	if err != nil {
+		t.Fatalf("SendQuestionChunked returned error: %v", err)
+	}
+	if len(contexts) < 3 {
+		t.Fatalf("Expected the document to be split into several chunks, got %q", contexts)
+	}
+	paris := 0
+	for i, result := range results {
+		span, err := result.ExtractSpan(document)
+		if err != nil || span != result.Answer {
+			t.Errorf("Expected the span of %q in the document, got %q, %v", result.Answer, span, err)
+		}
+		if result.Answer == "Paris" {
+			paris++
+		}
+		if i > 0 && result.Score > results[i-1].Score {
+			t.Errorf("Expected the best score first, got %+v", results)
+		}
+	}
+	if paris != 1 || results[0].Answer != "Paris" || len(results) != len(contexts)+1 {
+		t.Errorf("Expected Paris once, first, and one answer per chunk, got %+v", results)
+	}
+
+	_, err = adaptor.SendQuestionChunked(context.Background(), document, "Question?", 10, 10, nil)
+	if err == nil {
+		t.Error("Expected an error for an overlap as long as the chunks")
+	}
+}
+
+func TestChunkDocument(t *testing.T) {
+	for _, test := range []struct {
+		document           string
+		chunksize, overlap int
+	}{
+		{"The quick brown fox jumps over the lazy dog", 10, 3},
+		{"Größenwahn über Äpfel und Öl", 5, 2},
+		{"日本語のテキスト", 4, 1}, /// characters longer than the overlap
+		{"日本語", 2, 1},      /// characters longer than a chunk
+		{"short", 100, 10},
+		{"", 10, 0},
+	} {
+		chunks := chunkDocument(test.document, test.chunksize, test.overlap)
+		if chunks[0].start != 0 || chunks[len(chunks)-1].end != len(test.document) {
+			t.Errorf("Expected %q to be covered, got %+v", test.document, chunks)
+		}
+		for i, chunk := range chunks {
+			text := test.document[chunk.start:chunk.end]
+			if !utf8.ValidString(text) {
+				t.Errorf("Expected chunk %d of %q not to split a character, got %q", i, test.document, text)
+			}
+			if i > 0 && (chunk.start <= chunks[i-1].start || chunk.start > chunks[i-1].end) {
+				t.Errorf("Expected chunk %d of %q to move forward and not leave a gap, got %+v", i, test.document, chunks)
+			}
+		}
+	}
+	chunks := chunkDocument("0123456789abcdefghij", 8, 3)
+	expected := []documentChunk{{0, 8}, {5, 13}, {10, 18}, {15, 20}}
+	if !reflect.DeepEqual(chunks, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, chunks)
+	}
+}
+
+func TestSendRequestAs(t *testing.T) {
+	type city struct {
+		Name    string `json:"name"`
+		Country string `json:"country"`
+	}
+	var lock sync.Mutex
+	requests := make([]AIRequest, 0)
+	keys := make([]string, 0)
+	rejectjsonmode := false
+	content := `{"name": "Paris", "country": "France"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqData AIRequest
+		json.NewDecoder(r.Body).Decode(&reqData)
+		lock.Lock()
+		requests = append(requests, reqData)
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		lock.Unlock()
+		if rejectjsonmode && reqData.ResponseFormat != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "response_format is not supported"}`))
+			return
+		}
+		response := map[string]any{
+			"id": "chatcmpl-1",
+			"choices": []map[string]any{
+				{"index": 0, "message": map[string]any{"role": "assistant", "content": content}, "finish_reason": "stop"},
+			},
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are a geographer.", OpenAIJsonExtractor, 1)
+	expected := city{Name: "Paris", Country: "France"}
+	actual, err := SendRequestAs[city](context.Background(), adaptor, "Describe Paris", nil)
+	if err != nil || actual != expected {
+		t.Fatalf("Expected %+v, got %+v, %v", expected, actual, err)
+	}
+	if len(requests) != 1 || requests[0].ResponseFormat == nil || requests[0].ResponseFormat.Type != "json_object" {
+		t.Errorf("Expected one request in JSON mode, got %+v", requests)
+	}
+
+	//// Without JSON mode the schema goes in the system prompt, and the model may add a code block
+	requests = requests[:0]
+	rejectjsonmode = true
+	content = "```json\n{\"name\": \"Paris\", \"country\": \"France\"}\n```"
+	actual, err = SendRequestAs[city](context.Background(), adaptor, "Describe Paris", nil)
+	if err != nil || actual != expected {
+		t.Fatalf("Expected %+v without JSON mode, got %+v, %v", expected, actual, err)
+	}
+	if len(requests) != 2 || requests[1].ResponseFormat != nil {
+		t.Fatalf("Expected the request to be resent without JSON mode, got %+v", requests)
+	}
+	system := requests[1].Messages[0].Content
+	if !strings.HasPrefix(system, "You are a geographer.\n\n") || !strings.Contains(system, "JSON schema") ||
+		!strings.Contains(system, `"country"`) {
+		t.Errorf("Expected the schema after the base instructions, got %q", system)
+	}
+
+	//// A history with its own system message gets the schema there, and is left as it was
+	requests = requests[:0]
+	history := []Message{
+		{Role: string(ROLE_SYSTEM), Content: "You are a travel agent."},
+		{Role: string(ROLE_USER), Content: "I'm going to France."},
+	}
+	actual, err = SendRequestAs[city](context.Background(), adaptor, "Describe Paris", history)
+	if err != nil || actual != expected {
+		t.Fatalf("Expected %+v with a system message in the history, got %+v, %v", expected, actual, err)
+	}
+	system = requests[1].Messages[0].Content
+	if len(requests[1].Messages) != 3 || !strings.HasPrefix(system, "You are a travel agent.\n\n") ||
+		!strings.Contains(system, "JSON schema") {
+		t.Errorf("Expected the schema after the history's system message, got %+v", requests[1].Messages)
+	}
+	if history[0].Content != "You are a travel agent." {
+		t.Errorf("Expected the history to be unchanged, got %q", history[0].Content)
+	}
+
+	//// Without a system message, the schema goes in the message
+	requests = requests[:0]
+	actual, err = SendRequestAs[city](context.Background(), adaptor.Clone(WithNoSystemMessage()), "Describe Paris", nil)
+	if err != nil || actual != expected {
+		t.Fatalf("Expected %+v without a system message, got %+v, %v", expected, actual, err)
+	}
+	user := requests[1].Messages[0]
+	if len(requests[1].Messages) != 1 || !strings.HasPrefix(user.Content, "Describe Paris\n\n") ||
+		!strings.Contains(user.Content, "JSON schema") {
+		t.Errorf("Expected the schema after the message, got %+v", requests[1].Messages)
+	}
+
+	//// The resend is a different request, so doesn't reuse the idempotency key
+	requests, keys = requests[:0], keys[:0]
+	_, err = SendRequestAs[city](context.Background(), adaptor, "Describe Paris", nil, WithIdempotencyKey("key-1"))
+	if err != nil || len(keys) != 2 || keys[0] != "key-1" || keys[1] == "key-1" {
+		t.Errorf("Expected the resend without the rejected request's key, got %q, %v", keys, err)
+	}
+
+	//// Content that isn't a T
+	rejectjsonmode = false
+	content = `{"name": "Paris", "country": `
+	_, err = SendRequestAs[city](context.Background(), adaptor, "Describe Paris", nil)
+	outputerr := &StructuredOutputError{}
+	if !errors.As(err, &outputerr) || outputerr.Content != content {
+		t.Fatalf("Expected a StructuredOutputError with the content, got %v", err)
+	}
+	syntaxerr := &json.SyntaxError{}
+	if !errors.As(err, &syntaxerr) {
+		t.Errorf("Expected the unmarshal error to be wrapped, got %v", err)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "model not found"}`))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	_, err := adaptor.SendRequest("Hi")
+	statuserr := &StatusError{}
+	if !errors.As(err, &statuserr) || statuserr.StatusCode != http.StatusNotFound || !strings.Contains(statuserr.Body, "model not found") {
+		t.Fatalf("Expected a StatusError with the status and body, got %v", err)
+	}
+	if err.Error() != "API request failed with status 404" {
+		t.Errorf("Expected the status in the message, got %q", err.Error())
+	}
+}
+
+func TestStripCodeFence(t *testing.T) {
+	for content, expected := range map[string]string{
+		"```json\n{\"a\": 1}\n```":  `{"a": 1}`,
+		" ```\n[1, 2]\n```\n":       `[1, 2]`,
+		`{"a": 1}`:                  `{"a": 1}`,
+		"```{\"a\": 1}```":          "```{\"a\": 1}```",
+		"```json\n{\"a\": \"```\"}": "```json\n{\"a\": \"```\"}",
+	} {
+		if actual := stripCodeFence(content); actual != expected {
+			t.Errorf("Expected %q from %q, got %q", expected, content, actual)
+		}
+	}
+}
+
+func TestQnAJsonResponseExtractorAbove(t *testing.T) {
+	extractor := QnAJsonResponseExtractorAbove(0.5)
+	body := `[{"answer":"Paris","score":0.9,"start":0,"end":5},{"answer":"Lyon","score":0.2,"start":10,"end":14},` +
+		`{"answer":"France","score":0.5,"start":20,"end":26}]`
+	answers, err := extractor(io.NopCloser(strings.NewReader(body)))
+	if err != nil || len(answers) != 2 || answers[0].Answer != "Paris" || answers[1].Answer != "France" {
+		t.Fatalf("Expected the answers scoring at least 0.5, got %+v, %v", answers, err)
+	}
+
+	_, err = extractor(io.NopCloser(strings.NewReader(`[{"answer":"Lyon","score":0.2,"start":10,"end":14}]`)))
+	if !errors.Is(err, ErrBelowThreshold) {
+		t.Errorf("Expected ErrBelowThreshold when no answer is good enough, got %v", err)
+	}
+	_, err = extractor(io.NopCloser(strings.NewReader(`[]`)))
+	if !errors.Is(err, ErrBelowThreshold) {
+		t.Errorf("Expected ErrBelowThreshold for no answers, got %v", err)
+	}
+	_, err = extractor(io.NopCloser(strings.NewReader(`[{"answer":`)))
+	if err == nil || errors.Is(err, ErrBelowThreshold) {
+		t.Errorf("Expected the decode error for a malformed body, got %v", err)
+	}
+}
+
+func TestSendSystemRequest(t *testing.T) {
+	var reqData AIRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&reqData)
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	content, err := adaptor.SendSystemRequest("Summarise the conversation so far.", WithRequestID("trace-1"))
+	if err != nil || content != "Hello" {
+		t.Fatalf("Expected 'Hello', got '%s', %v", content, err)
+	}
+	expected := []Message{
+		{Role: string(ROLE_SYSTEM), Content: "You are an assistant."},
+		{Role: string(ROLE_SYSTEM), Content: "Summarise the conversation so far."},
+	}
+	if !reflect.DeepEqual(reqData.Messages, expected) {
+		t.Errorf("Expected the message sent as a system message, %+v, got %+v", expected, reqData.Messages)
+	}
+}
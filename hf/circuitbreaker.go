@@ -0,0 +1,90 @@
+package hf
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Returned, without contacting the endpoint, while the circuit breaker is open
+type CircuitOpenError struct {
+	OpenUntil time.Time /// when the breaker will next allow a probe request through
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker is open until %s", e.OpenUntil.Format(time.RFC3339))
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// Opens after threshold consecutive failed calls and fails fast for cooldown, after which
+// a single probe call is allowed through. A successful probe closes the breaker again,
+// a failed one re-opens it for another cooldown.
+type circuitBreaker struct {
+	lock      sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     circuitState
+	failures  int
+	openedAt  time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+func (cb *circuitBreaker) allow() error {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	switch cb.state {
+	case circuitOpen:
+		openuntil := cb.openedAt.Add(cb.cooldown)
+		if time.Now().Before(openuntil) {
+			return &CircuitOpenError{OpenUntil: openuntil}
+		}
+		//// Cooldown is over - let this call through as the probe
+		cb.state = circuitHalfOpen
+		return nil
+	case circuitHalfOpen:
+		//// A probe is already in flight
+		return &CircuitOpenError{OpenUntil: cb.openedAt.Add(cb.cooldown)}
+	}
+	return nil
+}
+
+func (cb *circuitBreaker) record(success bool) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if success {
+		cb.state = circuitClosed
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	if cb.state == circuitHalfOpen || cb.failures >= cb.threshold {
+		cb.state = circuitOpen
+		cb.openedAt = time.Now()
+	}
+}
+
+// The call was given up on by the caller, so it neither succeeded nor failed. If it was the
+// probe, the next call is let through as the probe instead.
+func (cb *circuitBreaker) abandon() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if cb.state == circuitHalfOpen {
+		cb.state = circuitOpen
+	}
+}
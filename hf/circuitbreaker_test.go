@@ -0,0 +1,121 @@
+package hf
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var healthy atomic.Bool
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if !healthy.Load() {
+			http.Error(w, "model crashed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	cooldown := 100 * time.Millisecond
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithCircuitBreaker(2, cooldown))
+
+	//// Drive the breaker open
+	for i := 0; i < 2; i++ {
+		_, err := adaptor.SendRequest("Hi")
+		if err == nil {
+			t.Fatalf("Expected an error from the failing endpoint on call %d", i)
+		}
+		var openerr *CircuitOpenError
+		if errors.As(err, &openerr) {
+			t.Fatalf("Breaker opened too early on call %d", i)
+		}
+	}
+
+	//// Open - fail fast without calling the endpoint
+	_, err := adaptor.SendRequest("Hi")
+	var openerr *CircuitOpenError
+	if !errors.As(err, &openerr) {
+		t.Fatalf("Expected a CircuitOpenError, got %v", err)
+	}
+	if hits.Load() != 2 {
+		t.Errorf("Expected the endpoint to be called 2 times, got %d", hits.Load())
+	}
+
+	//// A failed probe after the cooldown re-opens the breaker
+	time.Sleep(cooldown + 20*time.Millisecond)
+	_, err = adaptor.SendRequest("Hi")
+	if err == nil || errors.As(err, &openerr) {
+		t.Fatalf("Expected the probe to reach the failing endpoint, got %v", err)
+	}
+	_, err = adaptor.SendRequest("Hi")
+	if !errors.As(err, &openerr) {
+		t.Fatalf("Expected a CircuitOpenError after a failed probe, got %v", err)
+	}
+
+	//// A successful probe closes it again
+	healthy.Store(true)
+	time.Sleep(cooldown + 20*time.Millisecond)
+	content, err := adaptor.SendRequest("Hi")
+	if err != nil {
+		t.Fatalf("Expected the probe to succeed, got %v", err)
+	}
+	if content != "Hello" {
+		t.Errorf("Expected content 'Hello', got '%s'", content)
+	}
+	if _, err = adaptor.SendRequest("Hi"); err != nil {
+		t.Errorf("Expected the breaker to be closed after recovery, got %v", err)
+	}
+	if hits.Load() != 5 {
+		t.Errorf("Expected the endpoint to be called 5 times, got %d", hits.Load())
+	}
+}
+
+func TestCircuitBreakerClientErrors(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.Header.Get("Authorization") != "Bearer test-key" {
+			http.Error(w, "bad key", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithCircuitBreaker(2, time.Minute))
+	for i := 0; i < 3; i++ {
+		_, err := adaptor.SendRequest("Hi")
+		var openerr *CircuitOpenError
+		if err == nil || errors.As(err, &openerr) {
+			t.Fatalf("Expected the 400 from the endpoint on call %d, got %v", i, err)
+		}
+	}
+	_, err := adaptor.SendRequest("Hi", WithAPIKey("wrong-key"))
+	var openerr *CircuitOpenError
+	if err == nil || errors.As(err, &openerr) {
+		t.Fatalf("Expected the 401 from the endpoint, got %v", err)
+	}
+
+	//// Cancelled calls are not failures either
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 3; i++ {
+		adaptor.SendRequest("Hi", WithContext(ctx))
+	}
+	if _, err = adaptor.SendRequest("Hi"); err == nil || errors.As(err, &openerr) {
+		t.Errorf("Expected the breaker to stay closed, got %v", err)
+	}
+	if hits.Load() != 5 {
+		t.Errorf("Expected the endpoint to be called 5 times, got %d", hits.Load())
+	}
+}
@@ -0,0 +1,90 @@
+package hf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+)
+
+// Encodes the body of each request (and each retry of it), see WithRequestEncoder
+type RequestEncoder interface {
+	// The body and its Content-Type
+	Encode(reqData any) (io.Reader, string, error)
+}
+
+// Encodes the request as JSON, the default
+type JSONEncoder struct{}
+
+func (JSONEncoder) Encode(reqData any) (io.Reader, string, error) {
+	body := &bytes.Buffer{}
+	err := json.NewEncoder(body).Encode(reqData)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, "application/json", nil
+}
+
+// A request for MultipartEncoder, e.g. the audio or image for a pipeline endpoint and its parameters
+type MultipartRequest struct {
+	Fields map[string]string
+	Files  []MultipartFile
+}
+
+type MultipartFile struct {
+	Field    string
+	Filename string
+	Data     []byte /// not a reader, as the body is encoded again for each retry
+}
+
+// Encodes a MultipartRequest as multipart/form-data, for endpoints that take files
+type MultipartEncoder struct{}
+
+func (MultipartEncoder) Encode(reqData any) (io.Reader, string, error) {
+	req, ok := reqData.(MultipartRequest)
+	if !ok {
+		return nil, "", fmt.Errorf("multipart encoder needs a MultipartRequest, got %T", reqData)
+	}
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for field, value := range req.Fields {
+		if err := writer.WriteField(field, value); err != nil {
+			return nil, "", err
+		}
+	}
+	for _, file := range req.Files {
+		part, err := writer.CreateFormFile(file.Field, file.Filename)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := part.Write(file.Data); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return body, writer.FormDataContentType(), nil
+}
+
+// A request for BinaryEncoder, e.g. audio sent to a speech recognition endpoint as it is
+type BinaryRequest struct {
+	Data        []byte
+	ContentType string /// e.g. audio/flac, application/octet-stream if empty
+}
+
+// Sends a BinaryRequest as the raw bytes, and anything else as JSON
+type BinaryEncoder struct{}
+
+func (BinaryEncoder) Encode(reqData any) (io.Reader, string, error) {
+	req, ok := reqData.(BinaryRequest)
+	if !ok {
+		return JSONEncoder{}.Encode(reqData)
+	}
+	contenttype := req.ContentType
+	if contenttype == "" {
+		contenttype = "application/octet-stream"
+	}
+	return bytes.NewReader(req.Data), contenttype, nil
+}
@@ -0,0 +1,109 @@
+package hf
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMultipartEncoder(t *testing.T) {
+	type received struct {
+		mediatype, boundary, task, filename, data string
+	}
+	var lock sync.Mutex
+	requests := make([]received, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediatype, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			t.Errorf("Failed to parse the content type: %v", err)
+		}
+		got := received{mediatype: mediatype, boundary: params["boundary"]}
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("Failed to parse the multipart body: %v", err)
+		} else {
+			got.task = r.FormValue("task")
+			file, header, err := r.FormFile("audio")
+			if err != nil {
+				t.Errorf("Expected the audio file in the body: %v", err)
+			} else {
+				data, _ := io.ReadAll(file)
+				got.filename, got.data = header.Filename, string(data)
+			}
+		}
+		lock.Lock()
+		requests = append(requests, got)
+		attempt := len(requests)
+		lock.Unlock()
+		//// The first attempt is retried, so the body has to be encoded again
+		if attempt == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"text": "hello"}`))
+	}))
+	defer server.Close()
+
+	adaptor := NewBaseAdaptor(server.URL, "test-key", "test-model", 2,
+		WithRequestEncoder(MultipartEncoder{}), WithServiceUnavailableDelay(time.Millisecond))
+	req := MultipartRequest{
+		Fields: map[string]string{"task": "transcribe"},
+		Files:  []MultipartFile{{Field: "audio", Filename: "clip.wav", Data: []byte("RIFF....WAVE")}},
+	}
+	resp, err := adaptor.sendWithRetry(context.Background(), req, adaptor.newRequestConfig(nil))
+	if err != nil {
+		t.Fatalf("sendWithRetry returned error: %v", err)
+	}
+	resp.Body.Close()
+	if len(requests) != 2 {
+		t.Fatalf("Expected a retry, got %d requests", len(requests))
+	}
+	for i, got := range requests {
+		if got.mediatype != "multipart/form-data" || got.boundary == "" {
+			t.Errorf("Expected multipart/form-data with a boundary on request %d, got %+v", i, got)
+		}
+		if got.task != "transcribe" || got.filename != "clip.wav" || got.data != "RIFF....WAVE" {
+			t.Errorf("Expected the field and file on request %d, got %+v", i, got)
+		}
+	}
+
+	_, err = adaptor.sendWithRetry(context.Background(), AIRequest{}, adaptor.newRequestConfig(nil))
+	if err == nil || !strings.Contains(err.Error(), "MultipartRequest") {
+		t.Errorf("Expected an error encoding a request that isn't a MultipartRequest, got %v", err)
+	}
+}
+
+func TestJSONEncoderDefault(t *testing.T) {
+	contenttype := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contenttype = r.Header.Get("Content-Type")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	if _, err := adaptor.SendRequest("Hi"); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if contenttype != "application/json" {
+		t.Errorf("Expected JSON by default, got %s", contenttype)
+	}
+}
+
+func TestBinaryEncoder(t *testing.T) {
+	body, contenttype, err := BinaryEncoder{}.Encode(BinaryRequest{Data: []byte("\x89PNG")})
+	data, _ := io.ReadAll(body)
+	if err != nil || contenttype != "application/octet-stream" || string(data) != "\x89PNG" {
+		t.Errorf("Expected the raw bytes as application/octet-stream, got %s %q, %v", contenttype, data, err)
+	}
+	body, contenttype, err = BinaryEncoder{}.Encode(map[string]any{"inputs": "text"})
+	data, _ = io.ReadAll(body)
+	if err != nil || contenttype != "application/json" || strings.TrimSpace(string(data)) != `{"inputs":"text"}` {
+		t.Errorf("Expected other requests as JSON, got %s %q, %v", contenttype, data, err)
+	}
+}
@@ -0,0 +1,183 @@
+package hf
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ////////////////////////////////////////////////////////////////
+//
+//	Human readable exports of a conversation history, e.g. for
+//	review or evaluation pipelines
+//
+// ////////////////////////////////////////////////////////////////
+
+// Render the history as a Markdown transcript, with any function call shown inline
+func ExportMarkdown(history []Message) string {
+	sb := strings.Builder{}
+	for i, msg := range history {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString("**" + roleLabel(msg.Role) + ":**")
+		if msg.Name != "" {
+			sb.WriteString(" _(" + msg.Name + ")_")
+		}
+		if msg.Content != "" {
+			sb.WriteString(" " + msg.Content)
+		}
+		sb.WriteString("\n")
+		for _, call := range messageCalls(msg) {
+			sb.WriteString(fmt.Sprintf("\n`%s(%s)`\n", call.Function.Name, call.Function.Arguments))
+		}
+	}
+	return sb.String()
+}
+
+// The calls made by a message, whether as a legacy function call or as tool calls
+func messageCalls(msg Message) []FunctionCall {
+	if msg.FunctionCall != nil {
+		return append([]FunctionCall{*msg.FunctionCall}, msg.ToolCalls...)
+	}
+	return msg.ToolCalls
+}
+
+func roleLabel(role string) string {
+	switch role {
+	case string(ROLE_SYSTEM):
+		return "System"
+	case string(ROLE_USER):
+		return "User"
+	case string(ROLE_AGENT):
+		return "Assistant"
+	case "tool":
+		return "Tool result"
+	}
+	return role
+}
+
+// Write the history as CSV with a header and one row per message. The tool columns are filled
+// for function calls (tool_name, tool_args - one line per call) and tool messages (tool_result).
+func ExportCSV(w io.Writer, history []Message) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"turn", "role", "content", "tool_name", "tool_args", "tool_result"})
+	if err != nil {
+		return err
+	}
+	for i, msg := range history {
+		row := []string{strconv.Itoa(i), msg.Role, msg.Content, "", "", ""}
+		names, args := make([]string, 0), make([]string, 0)
+		for _, call := range messageCalls(msg) {
+			names = append(names, call.Function.Name)
+			args = append(args, call.Function.Arguments)
+		}
+		row[3] = strings.Join(names, "\n")
+		row[4] = strings.Join(args, "\n")
+		if msg.Role == "tool" {
+			row[2] = ""
+			row[5] = msg.Content
+		}
+		err = writer.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// A one line summary of the tool for logging, e.g. tool:get_weather(location:string[required], unit:string)
+func (t Tool) String() string {
+	params := make([]string, 0)
+	for _, name := range toolParameterNames(t.Function.Parameters) {
+		param := name + ":" + parameterType(t.Function.Parameters.Properties[name])
+		if slices.Contains(t.Function.Parameters.Required, name) {
+			param += "[required]"
+		}
+		params = append(params, param)
+	}
+	return "tool:" + t.Function.Name + "(" + strings.Join(params, ", ") + ")"
+}
+
+// Document the tool in Markdown - its name, description and a table of its parameters
+func (t Tool) Markdown() string {
+	sb := strings.Builder{}
+	sb.WriteString("### " + t.Function.Name + "\n")
+	if t.Function.Description != "" {
+		sb.WriteString("\n" + t.Function.Description + "\n")
+	}
+	names := toolParameterNames(t.Function.Parameters)
+	if len(names) == 0 {
+		sb.WriteString("\nNo parameters.\n")
+		return sb.String()
+	}
+	sb.WriteString("\n| Name | Type | Required | Description |\n| --- | --- | --- | --- |\n")
+	for _, name := range names {
+		properties := t.Function.Parameters.Properties[name]
+		required := "no"
+		if slices.Contains(t.Function.Parameters.Required, name) {
+			required = "yes"
+		}
+		description := properties.Description
+		if len(properties.Enum) > 0 {
+			if description != "" && !strings.HasSuffix(description, ".") {
+				description += "."
+			}
+			description = strings.TrimSpace(description + " One of: `" + strings.Join(properties.Enum, "`, `") + "`")
+		}
+		sb.WriteString(fmt.Sprintf("| %s | %s | %s | %s |\n", markdownCell(name),
+			markdownCell(parameterType(properties)), required, markdownCell(description)))
+	}
+	return sb.String()
+}
+
+// The required parameters in order, then the others by name
+func toolParameterNames(params *ToolFunctionParameters) []string {
+	if params == nil {
+		return nil
+	}
+	names := make([]string, 0, len(params.Properties))
+	for _, name := range params.Required {
+		if _, found := params.Properties[name]; found {
+			names = append(names, name)
+		}
+	}
+	optional := make([]string, 0, len(params.Properties))
+	for name := range params.Properties {
+		if !slices.Contains(params.Required, name) {
+			optional = append(optional, name)
+		}
+	}
+	sort.Strings(optional)
+	return append(names, optional...)
+}
+
+// e.g. string, array<number> or string|number for alternatives
+func parameterType(properties ToolFunctionParameterProperties) string {
+	alternatives := properties.AnyOf
+	if len(alternatives) == 0 {
+		alternatives = properties.OneOf
+	}
+	if len(alternatives) > 0 {
+		types := make([]string, 0, len(alternatives))
+		for _, alternative := range alternatives {
+			types = append(types, parameterType(*alternative))
+		}
+		return strings.Join(types, "|")
+	}
+	if properties.Type == "array" && properties.Items != nil {
+		return "array<" + parameterType(*properties.Items) + ">"
+	}
+	return properties.Type
+}
+
+// A pipe would end the cell, and a newline the row
+func markdownCell(text string) string {
+	text = strings.ReplaceAll(text, "|", "\\|")
+	return strings.Join(strings.Fields(text), " ")
+}
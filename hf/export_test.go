@@ -0,0 +1,116 @@
+package hf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testExportHistory() []Message {
+	call := newTestFunctionCall("get_user_weather", `{"location":"London"}`)
+	return []Message{
+		{Role: string(ROLE_SYSTEM), Content: "You are an assistant."},
+		{Role: string(ROLE_USER), Content: "What's the weather in London?"},
+		{Role: string(ROLE_AGENT), FunctionCall: &call},
+		{Role: "tool", Content: `{"weather": "sunny"}`},
+		{Role: string(ROLE_AGENT), Content: "It's sunny, with a \"light\" breeze."},
+	}
+}
+
+func TestExportMarkdown(t *testing.T) {
+	expected := "**System:** You are an assistant.\n" +
+		"\n**User:** What's the weather in London?\n" +
+		"\n**Assistant:**\n\n`get_user_weather({\"location\":\"London\"})`\n" +
+		"\n**Tool result:** {\"weather\": \"sunny\"}\n" +
+		"\n**Assistant:** It's sunny, with a \"light\" breeze.\n"
+
+	markdown := ExportMarkdown(testExportHistory())
+	if markdown != expected {
+		t.Errorf("Expected Markdown:\n%s\nGot:\n%s", expected, markdown)
+	}
+	if ExportMarkdown(testExportHistory()) != markdown {
+		t.Error("Expected the Markdown export to be deterministic")
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	expected := "turn,role,content,tool_name,tool_args,tool_result\n" +
+		"0,system,You are an assistant.,,,\n" +
+		"1,user,What's the weather in London?,,,\n" +
+		"2,assistant,,get_user_weather,\"{\"\"location\"\":\"\"London\"\"}\",\n" +
+		"3,tool,,,,\"{\"\"weather\"\": \"\"sunny\"\"}\"\n" +
+		"4,assistant,\"It's sunny, with a \"\"light\"\" breeze.\",,,\n"
+
+	buf := &bytes.Buffer{}
+	if err := ExportCSV(buf, testExportHistory()); err != nil {
+		t.Fatalf("ExportCSV returned error: %v", err)
+	}
+	if buf.String() != expected {
+		t.Errorf("Expected CSV:\n%s\nGot:\n%s", expected, buf.String())
+	}
+}
+
+func TestExportToolCalls(t *testing.T) {
+	history := []Message{
+		{Role: string(ROLE_AGENT), ToolCalls: []FunctionCall{
+			newTestFunctionCall("get_user_weather", `{"location":"Paris"}`),
+			newTestFunctionCall("get_user_weather", `{"location":"Rome"}`),
+		}},
+	}
+	expected := "**Assistant:**\n\n`get_user_weather({\"location\":\"Paris\"})`\n\n`get_user_weather({\"location\":\"Rome\"})`\n"
+	if markdown := ExportMarkdown(history); markdown != expected {
+		t.Errorf("Expected markdown:\n%s\ngot:\n%s", expected, markdown)
+	}
+
+	buf := bytes.Buffer{}
+	if err := ExportCSV(&buf, history); err != nil {
+		t.Fatalf("ExportCSV returned error: %v", err)
+	}
+	expected = "turn,role,content,tool_name,tool_args,tool_result\n" +
+		"0,assistant,,\"get_user_weather\nget_user_weather\",\"{\"\"location\"\":\"\"Paris\"\"}\n{\"\"location\"\":\"\"Rome\"\"}\",\n"
+	if buf.String() != expected {
+		t.Errorf("Expected CSV:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func testWeatherTool() Tool {
+	return NewTool("get_weather", "Get the current weather | forecast", []ToolParameter{
+		{Name: "unit", Type: "string", Description: "The temperature unit", Enum: []string{"celsius", "fahrenheit"}},
+		{Name: "location", Type: "string", Description: "The city,\ne.g. London", Required: true},
+		{Name: "days", Type: "array", ItemType: "number", Description: "Days ahead"},
+	})
+}
+
+func TestToolString(t *testing.T) {
+	expected := "tool:get_weather(location:string[required], days:array<number>, unit:string)"
+	if actual := testWeatherTool().String(); actual != expected {
+		t.Errorf("Expected %q, got %q", expected, actual)
+	}
+	if actual := NewTool("get_time", "", nil).String(); actual != "tool:get_time()" {
+		t.Errorf("Expected a tool without parameters to have empty brackets, got %q", actual)
+	}
+}
+
+func TestToolMarkdown(t *testing.T) {
+	expected := "### get_weather\n" +
+		"\n" +
+		"Get the current weather | forecast\n" +
+		"\n" +
+		"| Name | Type | Required | Description |\n" +
+		"| --- | --- | --- | --- |\n" +
+		"| location | string | yes | The city, e.g. London |\n" +
+		"| days | array<number> | no | Days ahead |\n" +
+		"| unit | string | no | The temperature unit. One of: `celsius`, `fahrenheit` |\n"
+	if actual := testWeatherTool().Markdown(); actual != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, actual)
+	}
+	expected = "### get_time\n\nNo parameters.\n"
+	if actual := NewTool("get_time", "", nil).Markdown(); actual != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, actual)
+	}
+
+	//// A pipe in a description would split the cell
+	tool := NewTool("search", "", []ToolParameter{{Name: "query", Type: "string", Description: "a|b"}})
+	if actual := tool.Markdown(); !bytes.Contains([]byte(actual), []byte(`| a\|b |`)) {
+		t.Errorf("Expected the pipe to be escaped, got\n%s", actual)
+	}
+}
@@ -0,0 +1,269 @@
+package hf
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// What to do with a message list that some chat templates reject - consecutive messages with the
+// same role, or a system message after the start of the conversation
+type HistoryPolicy int
+
+const (
+	HistoryAsIs   HistoryPolicy = iota /// send the messages unchanged (the default)
+	HistoryMerge                       /// merge consecutive messages with the same role
+	HistoryReject                      /// return an ErrInvalidHistory
+)
+
+var ErrInvalidHistory = errors.New("invalid message history")
+
+// Check the messages sent with each request, see HistoryPolicy
+func WithHistoryPolicy(policy HistoryPolicy) Option {
+	return func(c *BaseAdaptor) {
+		c.historypolicy = policy
+	}
+}
+
+// Make the messages valid for templates that need system messages first and then alternating
+// user and assistant messages. The same messages are merged as by MergeConsecutiveMessages, but
+// joined with "\n\n" so the parts stay separate paragraphs. Those it keeps
+// apart are left as they are if they are system or tool (or function) messages, as a call to several
+// tools is answered by one result message per tool. Otherwise, e.g. when one is a tool call or they
+// are from differently named participants, they are an error with either policy.
+func normalizeMessages(messages []Message, policy HistoryPolicy) ([]Message, error) {
+	if policy == HistoryAsIs {
+		return messages, nil
+	}
+	normalized := make([]Message, 0, len(messages))
+	for i, message := range messages {
+		if len(normalized) == 0 {
+			normalized = append(normalized, message)
+			continue
+		}
+		last := &normalized[len(normalized)-1]
+		if message.Role == string(ROLE_SYSTEM) && last.Role != string(ROLE_SYSTEM) {
+			return nil, fmt.Errorf("%w: system message %d follows a %s message", ErrInvalidHistory, i, last.Role)
+		}
+		mergeable := canMergeMessages(*last, message)
+		if message.Role != last.Role || (!mergeable && (message.Role == string(ROLE_SYSTEM) ||
+			message.Role == string(ROLE_TOOL) || message.Role == "function")) {
+			normalized = append(normalized, message)
+			continue
+		}
+		if policy == HistoryReject {
+			return nil, fmt.Errorf("%w: messages %d and %d both have the role %s", ErrInvalidHistory, i-1, i, message.Role)
+		}
+		if !mergeable {
+			return nil, fmt.Errorf("%w: can't merge %s message %d into the one before it", ErrInvalidHistory, message.Role, i)
+		}
+		*last = mergeMessages(*last, message, "\n\n")
+	}
+	return normalized, nil
+}
+
+// Merge runs of messages with the same role into one message, joining the content with "\n". System
+// messages are never merged, and tool messages only when they are results for the same call.
+// Messages with function or tool calls, or from differently named participants, are kept apart too.
+func MergeConsecutiveMessages(history []Message) []Message {
+	merged := make([]Message, 0, len(history))
+	for _, message := range history {
+		if len(merged) > 0 && canMergeMessages(merged[len(merged)-1], message) {
+			merged[len(merged)-1] = mergeMessages(merged[len(merged)-1], message, "\n")
+			continue
+		}
+		merged = append(merged, message)
+	}
+	return merged
+}
+
+// Add the assistant message that made the calls (e.g. from NewAssistantToolCallMessage) to the end
+// of the history, followed by a tool message per call with its result - results[i] is the result of
+// calls[i]. A new slice is returned, so the history passed in is not changed. Panics if there
+// isn't exactly one result per call.
+func InjectToolResults(history []Message, assistantMsg Message, calls []FunctionCall, results []string) []Message {
+	if len(calls) != len(results) {
+		log.Panicf("%d results for %d tool calls", len(results), len(calls))
+	}
+	injected := make([]Message, 0, len(history)+len(calls)+1)
+	injected = append(injected, history...)
+	injected = append(injected, assistantMsg)
+	for i, call := range calls {
+		injected = append(injected, Message{
+			Role: string(ROLE_TOOL), ToolCallId: call.Id, Content: results[i],
+		})
+	}
+	return injected
+}
+
+func canMergeMessages(first, second Message) bool {
+	switch {
+	case first.Role != second.Role || first.Role == string(ROLE_SYSTEM) || first.Role == "function":
+		return false
+	case first.Role == string(ROLE_TOOL) && first.ToolCallId == "":
+		//// No telling whether they are results for the same call
+		return false
+	case first.ToolCallId != second.ToolCallId || first.Name != second.Name:
+		return false
+	case first.FunctionCall != nil || second.FunctionCall != nil:
+		return false
+	case len(first.ToolCalls) > 0 || len(second.ToolCalls) > 0:
+		return false
+	}
+	return true
+}
+
+// second's content joined onto first's with sep, for messages canMergeMessages allows
+func mergeMessages(first, second Message, sep string) Message {
+	first.Content += sep + second.Content
+	first.ContentNull = false
+	return first
+}
+
+// Split the message into messages with the same role whose content is at most maxBytes (UTF-8)
+// bytes (unless maxBytes is smaller than a single rune), e.g. to fit a long document into a
+// model's context a piece at a time. Splits are made at whitespace where possible, and otherwise
+// between runes - a word longer than maxBytes is split. Whitespace at the splits is dropped. Any
+// calls the message makes stay with the first chunk.
+func ChunkMessage(msg Message, maxBytes int) []Message {
+	if len(msg.Content) <= maxBytes || maxBytes <= 0 {
+		return []Message{msg}
+	}
+	chunks := make([]string, 0, len(msg.Content)/maxBytes+1)
+	rest := msg.Content
+	for len(rest) > maxBytes {
+		//// The longest prefix that fits and ends on a rune boundary
+		cut := maxBytes
+		for cut > 0 && !utf8.RuneStart(rest[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			//// A single rune bigger than maxBytes, which can't be split
+			_, cut = utf8.DecodeRuneInString(rest)
+		}
+		next, _ := utf8.DecodeRuneInString(rest[cut:])
+		if !unicode.IsSpace(next) {
+			if space := strings.LastIndexFunc(rest[:cut], unicode.IsSpace); space > 0 {
+				cut = space
+			}
+		}
+		if chunk := strings.TrimRightFunc(rest[:cut], unicode.IsSpace); chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+		rest = strings.TrimLeftFunc(rest[cut:], unicode.IsSpace)
+	}
+	if rest != "" {
+		chunks = append(chunks, rest)
+	}
+
+	messages := make([]Message, 0, len(chunks))
+	for i, chunk := range chunks {
+		message := msg
+		message.Content = chunk
+		message.ContentNull = false
+		if i > 0 {
+			message.FunctionCall = nil
+			message.ToolCalls = nil
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// Check the messages follow the OpenAI API's rules - a system message only at the start, user and
+// assistant messages alternating, and tool results only after an assistant message with a tool call.
+// Errors wrap ErrInvalidHistory and give the index of the first message that breaks a rule.
+func ValidateHistory(history []Message) error {
+	for i, message := range history {
+		switch message.Role {
+		case string(ROLE_SYSTEM):
+			if i > 0 {
+				return fmt.Errorf("%w: system message at %d, it must be the first message", ErrInvalidHistory, i)
+			}
+		case "tool", "function":
+			//// Several tool results can answer one assistant message
+			j := i - 1
+			for j >= 0 && history[j].Role == message.Role {
+				j--
+			}
+			if j < 0 || history[j].Role != string(ROLE_AGENT) || (history[j].FunctionCall == nil && len(history[j].ToolCalls) == 0) {
+				return fmt.Errorf("%w: %s message at %d does not follow an assistant tool call", ErrInvalidHistory, message.Role, i)
+			}
+		default:
+			if i > 0 && history[i-1].Role == message.Role {
+				return fmt.Errorf("%w: messages at %d and %d both have the role %s", ErrInvalidHistory, i-1, i, message.Role)
+			}
+		}
+	}
+	return nil
+}
+
+// Roles that are sent as they are. function is the legacy role for the result of a function call.
+var knownRoles = map[string]bool{
+	string(ROLE_SYSTEM): true,
+	string(ROLE_USER):   true,
+	string(ROLE_AGENT):  true,
+	string(ROLE_TOOL):   true,
+	"function":          true,
+}
+
+// Common aliases for the known roles, e.g. from other providers' formats or hand written histories
+var roleAliases = map[string]Role{
+	"human":     ROLE_USER,
+	"ai":        ROLE_AGENT,
+	"bot":       ROLE_AGENT,
+	"model":     ROLE_AGENT,
+	"agent":     ROLE_AGENT,
+	"assistent": ROLE_AGENT,
+	"developer": ROLE_SYSTEM,
+}
+
+// Check every message has one of the known roles (system, user, assistant, tool, or the legacy
+// function). The error wraps ErrInvalidHistory and gives the index and role of the first message
+// with an unknown role. The roles of every request are checked before it is sent.
+func ValidateRoles(history []Message) error {
+	for i, message := range history {
+		if !knownRoles[message.Role] {
+			return fmt.Errorf("%w: message %d has the unknown role %q, expected system, user, assistant or tool",
+				ErrInvalidHistory, i, message.Role)
+		}
+	}
+	return nil
+}
+
+// A copy of the history with role aliases mapped to the known roles - case and surrounding space are
+// ignored, and e.g. human becomes user and bot or model become assistant. Roles that aren't aliases
+// are left as they are, for ValidateRoles to report.
+func NormalizeRoles(history []Message) []Message {
+	normalized := make([]Message, len(history))
+	copy(normalized, history)
+	for i, message := range normalized {
+		role := strings.ToLower(strings.TrimSpace(message.Role))
+		if alias, ok := roleAliases[role]; ok {
+			role = string(alias)
+		}
+		if knownRoles[role] {
+			normalized[i].Role = role
+		}
+	}
+	return normalized
+}
+
+// Map role aliases (see NormalizeRoles) in the messages of each request, rather than rejecting them
+func WithLenientRoles() Option {
+	return func(c *BaseAdaptor) {
+		c.lenientroles = true
+	}
+}
+
+// Check the messages of each request with ValidateHistory before it is sent, including the
+// adaptor's system message and the new message. Requests with a system message at the end (from
+// SendSystemRequestWithHistory) always fail the check.
+func WithRequestValidation() Option {
+	return func(c *BaseAdaptor) {
+		c.validatehistory = true
+	}
+}
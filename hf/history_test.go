@@ -0,0 +1,480 @@
+package hf
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNormalizeMessagesMerge(t *testing.T) {
+	messages := []Message{
+		{Role: "system", Content: "You are an assistant."},
+		{Role: "system", Content: "Answer briefly."},
+		{Role: "user", Content: "Hi"},
+		{Role: "user", Content: "What is the capital of France?"},
+		{Role: "assistant", Content: "Paris."},
+		{Role: "tool", Content: `{"temp": 20}`},
+		{Role: "tool", Content: `{"temp": 25}`},
+		{Role: "user", Content: "Thanks"},
+	}
+	normalized, err := normalizeMessages(messages, HistoryMerge)
+	if err != nil {
+		t.Fatalf("normalizeMessages returned error: %v", err)
+	}
+	expected := []Message{
+		{Role: "system", Content: "You are an assistant."},
+		{Role: "system", Content: "Answer briefly."},
+		{Role: "user", Content: "Hi\n\nWhat is the capital of France?"},
+		{Role: "assistant", Content: "Paris."},
+		{Role: "tool", Content: `{"temp": 20}`},
+		{Role: "tool", Content: `{"temp": 25}`},
+		{Role: "user", Content: "Thanks"},
+	}
+	if !reflect.DeepEqual(normalized, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, normalized)
+	}
+	if messages[2].Content != "Hi" {
+		t.Errorf("Expected the original messages to be unchanged, got '%s'", messages[2].Content)
+	}
+
+	//// Named participants and tool calls can't be merged
+	unmergeable := [][]Message{
+		{NewNamedMessage(ROLE_USER, "alice", "Hi"), NewNamedMessage(ROLE_USER, "bob", "Hello")},
+		{{Role: "assistant", FunctionCall: &FunctionCall{}}, {Role: "assistant", Content: "Done"}},
+	}
+	for _, messages := range unmergeable {
+		if _, err := normalizeMessages(messages, HistoryMerge); !errors.Is(err, ErrInvalidHistory) {
+			t.Errorf("Expected ErrInvalidHistory for %+v, got %v", messages, err)
+		}
+	}
+}
+
+func TestNormalizeMessagesReject(t *testing.T) {
+	valid := []Message{
+		{Role: "system", Content: "You are an assistant."},
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant", Content: "Hello"},
+		{Role: "user", Content: "Bye"},
+	}
+	normalized, err := normalizeMessages(valid, HistoryReject)
+	if err != nil || !reflect.DeepEqual(normalized, valid) {
+		t.Errorf("Expected valid messages to be unchanged, got %+v, %v", normalized, err)
+	}
+
+	invalid := [][]Message{
+		{{Role: "user", Content: "Hi"}, {Role: "user", Content: "Are you there?"}},
+		{{Role: "user", Content: "Hi"}, {Role: "system", Content: "Be brief."}},
+	}
+	for _, messages := range invalid {
+		if _, err := normalizeMessages(messages, HistoryReject); !errors.Is(err, ErrInvalidHistory) {
+			t.Errorf("Expected ErrInvalidHistory for %+v, got %v", messages, err)
+		}
+	}
+	//// A system message after the start is an error when merging too
+	if _, err := normalizeMessages(invalid[1], HistoryMerge); !errors.Is(err, ErrInvalidHistory) {
+		t.Errorf("Expected ErrInvalidHistory for a late system message, got %v", err)
+	}
+	//// The default sends anything
+	if normalized, err := normalizeMessages(invalid[0], HistoryAsIs); err != nil || len(normalized) != 2 {
+		t.Errorf("Expected the messages to be unchanged, got %+v, %v", normalized, err)
+	}
+}
+
+func TestWithHistoryPolicy(t *testing.T) {
+	var reqData AIRequest
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		reqData = AIRequest{}
+		json.NewDecoder(r.Body).Decode(&reqData)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	history := []Message{
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant", Content: "Hello"},
+		{Role: "user", Content: "I have a question."},
+	}
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithHistoryPolicy(HistoryMerge))
+	if _, _, err := adaptor.SendRequestWithHistory("What is the capital of France?", history, nil); err != nil {
+		t.Fatalf("SendRequestWithHistory returned error: %v", err)
+	}
+	last := reqData.Messages[len(reqData.Messages)-1]
+	if len(reqData.Messages) != 4 || last.Content != "I have a question.\n\nWhat is the capital of France?" {
+		t.Errorf("Expected the new message to be merged into the last one, got %+v", reqData.Messages)
+	}
+
+	rejecting := adaptor.Clone(WithHistoryPolicy(HistoryReject))
+	if _, _, err := rejecting.SendRequestWithHistory("What is the capital of France?", history, nil); !errors.Is(err, ErrInvalidHistory) {
+		t.Errorf("Expected ErrInvalidHistory, got %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("Expected the rejected request not to be sent, got %d requests", requests)
+	}
+}
+
+func TestValidateHistory(t *testing.T) {
+	call := &FunctionCall{Id: "call_1", Type: "function"}
+	valid := []Message{
+		{Role: "system", Content: "You are an assistant."},
+		{Role: "user", Content: "Weather in Paris and Rome?"},
+		{Role: "assistant", FunctionCall: call},
+		{Role: "tool", Content: `{"temp": 20}`},
+		{Role: "tool", Content: `{"temp": 25}`},
+		{Role: "assistant", Content: "20 and 25 degrees."},
+		{Role: "user", Content: "Thanks"},
+	}
+	if err := ValidateHistory(valid); err != nil {
+		t.Errorf("Expected the history to be valid, got %v", err)
+	}
+	if err := ValidateHistory(nil); err != nil {
+		t.Errorf("Expected an empty history to be valid, got %v", err)
+	}
+
+	invalid := map[string][]Message{
+		"consecutive user": {
+			{Role: "user", Content: "Hi"}, {Role: "user", Content: "Hello?"},
+		},
+		"late system": {
+			{Role: "user", Content: "Hi"}, {Role: "system", Content: "Be brief."},
+		},
+		"two systems": {
+			{Role: "system", Content: "You are an assistant."}, {Role: "system", Content: "Be brief."},
+		},
+		"tool after user": {
+			{Role: "user", Content: "Hi"}, {Role: "tool", Content: "{}"},
+		},
+		"tool after plain assistant": {
+			{Role: "assistant", Content: "Hi"}, {Role: "tool", Content: "{}"},
+		},
+		"tool first": {
+			{Role: "tool", Content: "{}"},
+		},
+	}
+	for name, history := range invalid {
+		if err := ValidateHistory(history); !errors.Is(err, ErrInvalidHistory) {
+			t.Errorf("%s: expected ErrInvalidHistory, got %v", name, err)
+		}
+	}
+}
+
+func TestValidateRoles(t *testing.T) {
+	valid := []Message{
+		{Role: "system", Content: "You are an assistant."},
+		{Role: "user", Content: "Weather in Paris?"},
+		{Role: "assistant", ToolCalls: []FunctionCall{newTestFunctionCall("get_user_weather", "{}")}},
+		{Role: "tool", ToolCallId: "call_1", Content: `{"temp": 20}`},
+		{Role: "assistant", Content: "20 degrees."},
+	}
+	if err := ValidateRoles(valid); err != nil {
+		t.Errorf("Expected the roles to be valid, got %v", err)
+	}
+
+	invalid := append(valid, Message{Role: "assistent", Content: "Anything else?"})
+	err := ValidateRoles(invalid)
+	if !errors.Is(err, ErrInvalidHistory) {
+		t.Fatalf("Expected ErrInvalidHistory, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "message 5") || !strings.Contains(err.Error(), `"assistent"`) {
+		t.Errorf("Expected the error to give the index and role, got %v", err)
+	}
+}
+
+func TestNormalizeRoles(t *testing.T) {
+	history := []Message{
+		{Role: "Developer", Content: "You are an assistant."},
+		{Role: "human", Content: "Hi"},
+		{Role: " bot ", Content: "Hello"},
+		{Role: "assistent", Content: "Hello again"},
+		{Role: "narrator", Content: "Meanwhile"},
+	}
+	normalized := NormalizeRoles(history)
+	roles := make([]string, 0, len(normalized))
+	for _, message := range normalized {
+		roles = append(roles, message.Role)
+	}
+	expected := []string{"system", "user", "assistant", "assistant", "narrator"}
+	if !reflect.DeepEqual(roles, expected) {
+		t.Errorf("Expected %v, got %v", expected, roles)
+	}
+	if history[1].Role != "human" {
+		t.Errorf("Expected the history to be unchanged, got %+v", history)
+	}
+	if err := ValidateRoles(normalized); err == nil || !strings.Contains(err.Error(), "message 4") {
+		t.Errorf("Expected the unknown role to be reported, got %v", err)
+	}
+}
+
+func TestRolesCheckedBeforeSending(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	history := []Message{{Role: "human", Content: "Hi"}, {Role: "bot", Content: "Hello"}}
+	if _, _, err := adaptor.SendRequestWithHistory("How are you?", history, nil); !errors.Is(err, ErrInvalidHistory) {
+		t.Errorf("Expected ErrInvalidHistory, got %v", err)
+	}
+	if requests != 0 {
+		t.Errorf("Expected the invalid request not to be sent, got %d requests", requests)
+	}
+
+	lenient := adaptor.Clone(WithLenientRoles())
+	if _, _, err := lenient.SendRequestWithHistory("How are you?", history, nil); err != nil {
+		t.Errorf("Expected the aliases to be mapped, got %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("Expected 1 request, got %d", requests)
+	}
+}
+
+func TestWithRequestValidation(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithRequestValidation())
+	history := []Message{{Role: "user", Content: "Hi"}, {Role: "assistant", Content: "Hello"}}
+	if _, _, err := adaptor.SendRequestWithHistory("How are you?", history, nil); err != nil {
+		t.Fatalf("SendRequestWithHistory returned error: %v", err)
+	}
+
+	//// History ending with a user message, so the new one makes two in a row
+	history = append(history, Message{Role: "user", Content: "Are you there?"})
+	if _, _, err := adaptor.SendRequestWithHistory("How are you?", history, nil); !errors.Is(err, ErrInvalidHistory) {
+		t.Errorf("Expected ErrInvalidHistory, got %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("Expected the invalid request not to be sent, got %d requests", requests)
+	}
+
+	//// Off by default
+	unchecked := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	if _, _, err := unchecked.SendRequestWithHistory("How are you?", history, nil); err != nil {
+		t.Errorf("Expected no validation by default, got %v", err)
+	}
+}
+
+func TestBaseInstructNotDuplicated(t *testing.T) {
+	var reqData AIRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqData = AIRequest{}
+		json.NewDecoder(r.Body).Decode(&reqData)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	roles := func() []string {
+		roles := make([]string, 0)
+		for _, message := range reqData.Messages {
+			roles = append(roles, message.Role+":"+message.Content)
+		}
+		return roles
+	}
+
+	//// A history that was exported with its system message
+	imported := []Message{
+		{Role: "system", Content: "You are a pirate."},
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant", Content: "Ahoy"},
+	}
+	if _, _, err := adaptor.SendRequestWithHistory("Bye", imported, nil); err != nil {
+		t.Fatalf("SendRequestWithHistory returned error: %v", err)
+	}
+	expected := []string{"system:You are a pirate.", "user:Hi", "assistant:Ahoy", "user:Bye"}
+	if !reflect.DeepEqual(roles(), expected) {
+		t.Errorf("Expected %v, got %v", expected, roles())
+	}
+
+	//// Without a system message in the history the base instructions are added as before
+	if _, _, err := adaptor.SendRequestWithHistory("Bye", imported[1:], nil); err != nil {
+		t.Fatalf("SendRequestWithHistory returned error: %v", err)
+	}
+	expected = []string{"system:You are an assistant.", "user:Hi", "assistant:Ahoy", "user:Bye"}
+	if !reflect.DeepEqual(roles(), expected) {
+		t.Errorf("Expected %v, got %v", expected, roles())
+	}
+
+	nosystem := adaptor.Clone(WithNoSystemMessage())
+	if _, _, err := nosystem.SendRequestWithHistory("Bye", imported[1:], nil); err != nil {
+		t.Fatalf("SendRequestWithHistory returned error: %v", err)
+	}
+	expected = []string{"user:Hi", "assistant:Ahoy", "user:Bye"}
+	if !reflect.DeepEqual(roles(), expected) {
+		t.Errorf("Expected no system message, got %v", roles())
+	}
+}
+
+func TestMergeConsecutiveMessages(t *testing.T) {
+	call := newTestFunctionCall("get_user_weather", `{"location":"Paris"}`)
+	history := []Message{
+		{Role: "system", Content: "You are an assistant."},
+		{Role: "system", Content: "Answer briefly."},
+		{Role: "user", Content: "Hi"},
+		{Role: "user", Content: "Weather in Paris?"},
+		{Role: "assistant", ToolCalls: []FunctionCall{call}, ContentNull: true},
+		{Role: "assistant", Content: "Checking."},
+		{Role: "tool", ToolCallId: "call_1", Content: "20"},
+		{Role: "tool", ToolCallId: "call_1", Content: "degrees"},
+		{Role: "tool", ToolCallId: "call_2", Content: "25"},
+		{Role: "user", Content: "Thanks"},
+	}
+	expected := []Message{
+		{Role: "system", Content: "You are an assistant."},
+		{Role: "system", Content: "Answer briefly."},
+		{Role: "user", Content: "Hi\nWeather in Paris?"},
+		{Role: "assistant", ToolCalls: []FunctionCall{call}, ContentNull: true},
+		{Role: "assistant", Content: "Checking."},
+		{Role: "tool", ToolCallId: "call_1", Content: "20\ndegrees"},
+		{Role: "tool", ToolCallId: "call_2", Content: "25"},
+		{Role: "user", Content: "Thanks"},
+	}
+	merged := MergeConsecutiveMessages(history)
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, merged)
+	}
+	if history[2].Content != "Hi" {
+		t.Errorf("Expected the history to be unchanged, got '%s'", history[2].Content)
+	}
+	if merged := MergeConsecutiveMessages(nil); len(merged) != 0 {
+		t.Errorf("Expected no messages, got %+v", merged)
+	}
+}
+
+func TestHistoryMergeMatchesMergeConsecutiveMessages(t *testing.T) {
+	history := []Message{
+		{Role: "system", Content: "You are an assistant."},
+		{Role: "system", Content: "Answer briefly."},
+		{Role: "user", Content: "Hi"},
+		{Role: "user", Content: "Weather in Paris?"},
+		NewAssistantToolCallMessage([]FunctionCall{newTestFunctionCall("get_user_weather", `{"location":"Paris"}`)}),
+		{Role: "tool", ToolCallId: "call_1", Content: "20"},
+		{Role: "tool", ToolCallId: "call_1", Content: "degrees"},
+		{Role: "tool", Content: "25"},
+		{Role: "tool", Content: "30"},
+	}
+	normalized, err := normalizeMessages(history, HistoryMerge)
+	if err != nil {
+		t.Fatalf("normalizeMessages returned error: %v", err)
+	}
+	//// The same messages are merged, only the separator differs
+	for i := range normalized {
+		normalized[i].Content = strings.ReplaceAll(normalized[i].Content, "\n\n", "\n")
+	}
+	if merged := MergeConsecutiveMessages(history); !reflect.DeepEqual(normalized, merged) {
+		t.Errorf("Expected the same merge from both, got %+v and %+v", normalized, merged)
+	}
+}
+
+func chunkContents(messages []Message) []string {
+	contents := make([]string, 0, len(messages))
+	for _, message := range messages {
+		contents = append(contents, message.Content)
+	}
+	return contents
+}
+
+func TestChunkMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		maxbytes int
+		expected []string
+	}{
+		{"under the limit", "Hello world", 20, []string{"Hello world"}},
+		{"exactly the limit", "Hello world", 11, []string{"Hello world"}},
+		{"words", "The quick brown fox jumps", 10, []string{"The quick", "brown fox", "jumps"}},
+		{"split at a space", "Hello world", 5, []string{"Hello", "world"}},
+		{"runs of whitespace", "one  \n two\t\tthree", 5, []string{"one", "two", "three"}},
+		{"long word", "abcdefghij xy", 4, []string{"abcd", "efgh", "ij", "xy"}},
+		//// é is 2 bytes, so "café" is 5 bytes
+		{"two byte runes", "café café café", 11, []string{"café café", "café"}},
+		{"three byte runes", "日本語のテキスト", 7, []string{"日本", "語の", "テキ", "スト"}},
+		{"four byte runes", "😀😀😀", 6, []string{"😀", "😀", "😀"}},
+		{"rune bigger than the limit", "😀a", 2, []string{"😀", "a"}},
+		//// U+3000 is a 3 byte space
+		{"multi byte space", "日本　語の", 8, []string{"日本", "語の"}},
+	}
+	for _, test := range tests {
+		msg := Message{Role: "user", Name: "alice", Content: test.content}
+		chunks := ChunkMessage(msg, test.maxbytes)
+		contents := chunkContents(chunks)
+		if !reflect.DeepEqual(contents, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, contents)
+		}
+		for _, chunk := range chunks {
+			if !utf8.ValidString(chunk.Content) {
+				t.Errorf("%s: chunk %q is not valid UTF-8", test.name, chunk.Content)
+			}
+			if len(chunk.Content) > test.maxbytes && utf8.RuneCountInString(chunk.Content) > 1 {
+				t.Errorf("%s: chunk %q is over %d bytes", test.name, chunk.Content, test.maxbytes)
+			}
+			if chunk.Role != "user" || chunk.Name != "alice" {
+				t.Errorf("%s: expected the role and name to be kept, got %+v", test.name, chunk)
+			}
+		}
+	}
+}
+
+func TestChunkMessageToolCalls(t *testing.T) {
+	call := newTestFunctionCall("get_user_weather", `{}`)
+	chunks := ChunkMessage(Message{Role: "assistant", Content: "one two", ToolCalls: []FunctionCall{call}}, 3)
+	if len(chunks) != 2 || len(chunks[0].ToolCalls) != 1 || chunks[1].ToolCalls != nil {
+		t.Errorf("Expected the tool calls to stay with the first chunk, got %+v", chunks)
+	}
+}
+
+func TestInjectToolResults(t *testing.T) {
+	weather := newTestFunctionCall("get_user_weather", `{"location":"London"}`)
+	clock := newTestFunctionCall("get_time", `{}`)
+	clock.Id = "call_2"
+	history := make([]Message, 2, 10)
+	history[0] = Message{Role: string(ROLE_SYSTEM), Content: "You are an assistant."}
+	history[1] = Message{Role: string(ROLE_USER), Content: "What's the weather and time in London?"}
+	calls := []FunctionCall{weather, clock}
+
+	injected := InjectToolResults(history, NewAssistantToolCallMessage(calls), calls, []string{`{"weather": "sunny"}`, "12:00"})
+	expected := []Message{
+		history[0],
+		history[1],
+		{Role: string(ROLE_AGENT), ContentNull: true, ToolCalls: calls},
+		{Role: string(ROLE_TOOL), ToolCallId: "call_1", Content: `{"weather": "sunny"}`},
+		{Role: string(ROLE_TOOL), ToolCallId: "call_2", Content: "12:00"},
+	}
+	if !reflect.DeepEqual(injected, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, injected)
+	}
+	if err := ValidateHistory(injected); err != nil {
+		t.Errorf("Expected a valid history, got %v", err)
+	}
+	//// The history had room to grow, but its backing array mustn't be written to
+	if extended := history[:3]; extended[2].Role != "" {
+		t.Errorf("Expected the history passed in to be unchanged, got %+v", extended[2])
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic for a missing result")
+		}
+	}()
+	InjectToolResults(history, NewAssistantToolCallMessage(calls), calls, []string{"sunny"})
+}
@@ -0,0 +1,75 @@
+package hf
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"golang.org/x/net/http2"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Returned for a request sent with WithHTTP2Only when the endpoint doesn't support HTTP/2
+var ErrHTTP2Unavailable = errors.New("HTTP/2 is not available")
+
+// Sends every request with HTTP/2 and never falls back to HTTP/1.1, see WithHTTP2Only. The HTTP/2
+// transport is built from config on the first request, so the options that tune config (TLS and
+// idle connections) apply whatever order they are in.
+type http2OnlyTransport struct {
+	config *http.Transport
+
+	once sync.Once
+	h2   *http2.Transport
+}
+
+func newHTTP2OnlyTransport(config *http.Transport) *http2OnlyTransport {
+	return &http2OnlyTransport{config: config}
+}
+
+func (t *http2OnlyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("%w: HTTP/2 needs https, got %s", ErrHTTP2Unavailable, req.URL.Scheme)
+	}
+	t.once.Do(t.build)
+	return t.h2.RoundTrip(req)
+}
+
+func (t *http2OnlyTransport) build() {
+	t.h2 = &http2.Transport{
+		TLSClientConfig: t.config.TLSClientConfig.Clone(),
+		IdleConnTimeout: t.config.IdleConnTimeout,
+		DialTLSContext:  t.dialTLS,
+	}
+}
+
+// Called by http.Client.CloseIdleConnections. Before the first request this only builds the
+// HTTP/2 transport, which has no connections yet.
+func (t *http2OnlyTransport) CloseIdleConnections() {
+	t.once.Do(t.build)
+	t.h2.CloseIdleConnections()
+}
+
+func (t *http2OnlyTransport) dialTLS(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+	dial := t.config.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsconn := tls.Client(conn, cfg)
+	err = tlsconn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	//// The server picks HTTP/1.1 (or nothing) if it doesn't speak HTTP/2
+	if protocol := tlsconn.ConnectionState().NegotiatedProtocol; protocol != http2.NextProtoTLS {
+		tlsconn.Close()
+		return nil, fmt.Errorf("%w: %s negotiated %q", ErrHTTP2Unavailable, addr, protocol)
+	}
+	return tlsconn, nil
+}
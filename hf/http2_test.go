@@ -0,0 +1,80 @@
+package hf
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// An https server that reports the HTTP version of each request in the response content
+func newProtoServer(t *testing.T, enablehttp2 bool) (*httptest.Server, *x509.CertPool) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","choices":[{"index":0,"message":{"role":"assistant","content":"` +
+			r.Proto + `"},"finish_reason":"stop"}]}`))
+	}))
+	server.EnableHTTP2 = enablehttp2
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	return server, pool
+}
+
+func TestWithHTTP2Only(t *testing.T) {
+	server, pool := newProtoServer(t, true)
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithHTTP2Only(), WithRootCAs(pool))
+	proto, err := adaptor.SendRequest("Hi")
+	if err != nil || proto != "HTTP/2.0" {
+		t.Errorf("Expected HTTP/2.0, got '%s', %v", proto, err)
+	}
+
+	//// A clone keeps HTTP/2 only, with its own transport
+	proto, err = adaptor.Clone(WithIdleConnectionTimeout(0)).SendRequest("Hi")
+	if err != nil || proto != "HTTP/2.0" {
+		t.Errorf("Expected HTTP/2.0 from the clone, got '%s', %v", proto, err)
+	}
+
+	http1server, http1pool := newProtoServer(t, false)
+	http1 := NewAdaptor(http1server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithRootCAs(http1pool), WithHTTP2Only())
+	if _, err := http1.SendRequest("Hi"); !errors.Is(err, ErrHTTP2Unavailable) {
+		t.Errorf("Expected ErrHTTP2Unavailable, got %v", err)
+	}
+
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+	unencrypted := NewAdaptor(plain.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithHTTP2Only())
+	if _, err := unencrypted.SendRequest("Hi"); !errors.Is(err, ErrHTTP2Unavailable) {
+		t.Errorf("Expected ErrHTTP2Unavailable for http, got %v", err)
+	}
+}
+
+func TestWithHTTP1Only(t *testing.T) {
+	server, pool := newProtoServer(t, true)
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected string
+	}{
+		{"default", []Option{WithRootCAs(pool)}, "HTTP/2.0"},
+		{"HTTP/1.1 only", []Option{WithRootCAs(pool), WithHTTP1Only()}, "HTTP/1.1"},
+		{"HTTP/1.1 only before TLS", []Option{WithHTTP1Only(), WithRootCAs(pool)}, "HTTP/1.1"},
+		{"HTTP/2 then HTTP/1.1", []Option{WithHTTP2Only(), WithRootCAs(pool), WithHTTP1Only()}, "HTTP/1.1"},
+		{"HTTP/1.1 then HTTP/2", []Option{WithHTTP1Only(), WithHTTP2Only(), WithRootCAs(pool)}, "HTTP/2.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+				tt.opts...)
+			proto, err := adaptor.SendRequest("Hi")
+			if err != nil || proto != tt.expected {
+				t.Errorf("Expected %s, got '%s', %v", tt.expected, proto, err)
+			}
+		})
+	}
+}
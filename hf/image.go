@@ -0,0 +1,93 @@
+package hf
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// An adaptor for text-to-image models, which return an image rather than text
+type ImageAdaptor struct {
+	*BaseAdaptor
+}
+
+func NewImageAdaptor(apiurl, apikey, model string, maxretries int, opts ...Option) *ImageAdaptor {
+	return &ImageAdaptor{
+		BaseAdaptor: NewBaseAdaptor(apiurl, apikey, model, maxretries, opts...),
+	}
+}
+
+type ImageRequest struct {
+	Inputs     string         `json:"inputs"`               /// the prompt
+	Parameters map[string]any `json:"parameters,omitempty"` /// e.g. width, height, num_inference_steps
+}
+
+var ErrNoImage = errors.New("no image in response")
+
+// Generate an image from prompt. Returns the image and its content type, e.g. image/png. The image
+// may come back as it is, or base64 encoded in JSON, either OpenAI style ({"data": [{"b64_json":
+// "..."}]}) or as {"image": "..."} - the content type of a base64 image is taken from its data URL
+// if it has one, otherwise it is detected from the image.
+func (c *ImageAdaptor) Generate(prompt string, params map[string]any) ([]byte, string, error) {
+	req := ImageRequest{
+		Inputs:     prompt,
+		Parameters: params,
+	}
+	resp, err := c.sendWithRetry(context.Background(), req, c.newRequestConfig(nil))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading response: %w", err)
+	}
+	contenttype, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if contenttype != "application/json" {
+		if contenttype == "" {
+			contenttype = http.DetectContentType(data)
+		}
+		return data, contenttype, nil
+	}
+	return decodeImageJSON(data)
+}
+
+func decodeImageJSON(data []byte) ([]byte, string, error) {
+	body := struct {
+		Data []struct {
+			B64JSON string `json:"b64_json"`
+		} `json:"data"`
+		Image string `json:"image"`
+	}{}
+	err := json.Unmarshal(data, &body)
+	if err != nil {
+		return nil, "", newDecodeError("Generate", data, err)
+	}
+	encoded := body.Image
+	if len(body.Data) > 0 {
+		encoded = body.Data[0].B64JSON
+	}
+	if encoded == "" {
+		return nil, "", ErrNoImage
+	}
+	contenttype := ""
+	//// A data URL, e.g. data:image/png;base64,iVBOR...
+	if header, payload, found := strings.Cut(encoded, ","); found && strings.HasPrefix(header, "data:") {
+		contenttype = strings.TrimSuffix(strings.TrimPrefix(header, "data:"), ";base64")
+		encoded = payload
+	}
+	image, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, "", fmt.Errorf("error decoding image: %w", err)
+	}
+	if contenttype == "" {
+		contenttype = http.DetectContentType(image)
+	}
+	return image, contenttype, nil
+}
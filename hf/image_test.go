@@ -0,0 +1,71 @@
+package hf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The start of a PNG, enough for its content type to be detected
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestImageAdaptor(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString(testPNG)
+	responses := map[string]func(w http.ResponseWriter){
+		"raw": func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write(testPNG)
+		},
+		"untyped": func(w http.ResponseWriter) {
+			w.Header()["Content-Type"] = nil
+			w.Write(testPNG)
+		},
+		"openai": func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"created": 1718000000, "data": [{"b64_json": "` + encoded + `"}]}`))
+		},
+		"dataurl": func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Write([]byte(`{"image": "data:image/webp;base64,` + encoded + `"}`))
+		},
+	}
+	expected := map[string]string{"raw": "image/jpeg", "untyped": "image/png", "openai": "image/png", "dataurl": "image/webp"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := ImageRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Parameters["width"] != 512.0 {
+			t.Errorf("Expected the parameters in the request, got %+v", req)
+		}
+		responses[req.Inputs](w)
+	}))
+	defer server.Close()
+
+	adaptor := NewImageAdaptor(server.URL, "test-key", "stabilityai/stable-diffusion-xl-base-1.0", 1)
+	for form, contenttype := range expected {
+		image, actual, err := adaptor.Generate(form, map[string]any{"width": 512})
+		if err != nil {
+			t.Errorf("Generate returned error for the %s response: %v", form, err)
+			continue
+		}
+		if !bytes.Equal(image, testPNG) || actual != contenttype {
+			t.Errorf("Expected the image as %s from the %s response, got %s %q", contenttype, form, actual, image)
+		}
+	}
+}
+
+func TestImageAdaptorNoImage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": []}`))
+	}))
+	defer server.Close()
+
+	adaptor := NewImageAdaptor(server.URL, "test-key", "test-model", 1)
+	if _, _, err := adaptor.Generate("A cat", nil); !errors.Is(err, ErrNoImage) {
+		t.Errorf("Expected ErrNoImage, got %v", err)
+	}
+}
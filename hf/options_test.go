@@ -0,0 +1,1491 @@
+package hf
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testChatResponse = `{"id":"chatcmpl-1","choices":[{"index":0,"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}]}`
+
+func TestWithExtractor(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+
+	content, _, err := adaptor.SendRequestWithHistory("Hi", nil, nil, WithExtractor(RawExtracter))
+	if err != nil {
+		t.Fatalf("SendRequestWithHistory with RawExtracter returned error: %v", err)
+	}
+	if content != testChatResponse {
+		t.Errorf("Expected raw content '%s', got '%s'", testChatResponse, content)
+	}
+
+	content, _, err = adaptor.SendRequestWithHistory("Hi", nil, nil)
+	if err != nil {
+		t.Fatalf("SendRequestWithHistory returned error: %v", err)
+	}
+	if content != "Hello" {
+		t.Errorf("Expected the adaptor's extractor to be used after the override, got '%s'", content)
+	}
+}
+
+func TestWithExtraBody(t *testing.T) {
+	var body map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	_, _, err := adaptor.SendRequestWithHistory("Hi", nil, nil, WithExtraBody(map[string]any{
+		"min_p":                0.1,
+		"chat_template_kwargs": map[string]any{"enable_thinking": false},
+	}))
+	if err != nil {
+		t.Fatalf("SendRequestWithHistory returned error: %v", err)
+	}
+	if body["min_p"] != 0.1 {
+		t.Errorf("Expected min_p 0.1 in the request body, got %v", body["min_p"])
+	}
+	kwargs, ok := body["chat_template_kwargs"].(map[string]any)
+	if !ok || kwargs["enable_thinking"] != false {
+		t.Errorf("Expected chat_template_kwargs in the request body, got %v", body["chat_template_kwargs"])
+	}
+	if body["model"] != "test-model" {
+		t.Errorf("Expected the request fields to be kept, got model %v", body["model"])
+	}
+
+	//// tools is a request field, even though it is omitted when empty
+	_, _, err = adaptor.SendRequestWithHistory("Hi", nil, nil, WithExtraBody(map[string]any{"tools": "none"}))
+	if err == nil {
+		t.Error("Expected an error for an extra body key colliding with a request field, got nil")
+	}
+}
+
+// Send waves of concurrent requests and count the connections the server sees opened
+func countNewConnections(t *testing.T, wavesize int, opts ...Option) int32 {
+	var newconns atomic.Int32
+	arrived := make(chan struct{}, wavesize)
+	release := make(chan struct{}, wavesize)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//// Hold every request until the whole wave is in flight
+		arrived <- struct{}{}
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			newconns.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1, opts...)
+	for wave := 0; wave < 2; wave++ {
+		wg := sync.WaitGroup{}
+		for i := 0; i < wavesize; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := adaptor.SendRequest("Hi"); err != nil {
+					t.Errorf("SendRequest returned error: %v", err)
+				}
+			}()
+		}
+		for i := 0; i < wavesize; i++ {
+			<-arrived
+		}
+		for i := 0; i < wavesize; i++ {
+			release <- struct{}{}
+		}
+		wg.Wait()
+	}
+	return newconns.Load()
+}
+
+func TestWithMaxIdleConnsPerHost(t *testing.T) {
+	wavesize := 8
+
+	//// With Go's default of 2 idle connections per host most of the second wave reconnects
+	defaultconns := countNewConnections(t, wavesize, WithMaxIdleConns(100))
+	if defaultconns <= int32(wavesize) {
+		t.Errorf("Expected the default transport to open more than %d connections, got %d", wavesize, defaultconns)
+	}
+
+	tunedconns := countNewConnections(t, wavesize, WithMaxIdleConns(100), WithMaxIdleConnsPerHost(wavesize),
+		WithIdleConnectionTimeout(time.Minute))
+	if tunedconns != int32(wavesize) {
+		t.Errorf("Expected the second wave to reuse the first wave's %d connections, got %d new connections",
+			wavesize, tunedconns)
+	}
+}
+
+func TestWithIdleConnectionTimeout(t *testing.T) {
+	var newconns atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			newconns.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	for _, tt := range []struct {
+		timeout  time.Duration
+		expected int32
+	}{{time.Minute, 1}, {20 * time.Millisecond, 2}} {
+		newconns.Store(0)
+		adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+			WithIdleConnectionTimeout(tt.timeout))
+		for i := 0; i < 2; i++ {
+			if _, err := adaptor.SendRequest("Hi"); err != nil {
+				t.Fatalf("SendRequest returned error: %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if newconns.Load() != tt.expected {
+			t.Errorf("Expected %d connections with an idle timeout of %v, got %d", tt.expected, tt.timeout, newconns.Load())
+		}
+	}
+}
+
+func TestWithAPIKey(t *testing.T) {
+	var lock sync.Mutex
+	keys := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		keys = append(keys, r.Header.Get("Authorization"))
+		lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "default-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	if _, err := adaptor.SendRequest("Hi", WithAPIKey("tenant-key")); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if _, err := adaptor.SendRequest("Hi"); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+
+	expected := []string{"Bearer tenant-key", "Bearer default-key"}
+	if len(keys) != len(expected) || keys[0] != expected[0] || keys[1] != expected[1] {
+		t.Errorf("Expected authorization headers %v, got %v", expected, keys)
+	}
+	if adaptor.apiKey != "default-key" {
+		t.Errorf("Expected the adaptor's key to be unchanged, got '%s'", adaptor.apiKey)
+	}
+}
+
+func TestWithTimeoutPerAttempt(t *testing.T) {
+	var attempts atomic.Int32
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			//// Hang until the client gives up on the attempt
+			select {
+			case <-r.Context().Done():
+			case <-done:
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+	defer close(done)
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 3,
+		WithTimeoutPerAttempt(100*time.Millisecond))
+	start := time.Now()
+	content, err := adaptor.SendRequest("Hi")
+	if err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if content != "Hello" {
+		t.Errorf("Expected content 'Hello', got '%s'", content)
+	}
+	if attempts.Load() != 2 {
+		t.Errorf("Expected 2 attempts, got %d", attempts.Load())
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the hung attempt to be abandoned, took %s", elapsed)
+	}
+
+	//// The overall deadline still applies - no more attempts once it has passed
+	attempts.Store(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	adaptor = NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 3,
+		WithTimeoutPerAttempt(time.Second))
+	if _, err := adaptor.SendRequest("Hi", WithContext(ctx)); err == nil {
+		t.Error("Expected an error once the overall deadline passed, got nil")
+	}
+	if attempts.Load() != 1 {
+		t.Errorf("Expected 1 attempt within the overall deadline, got %d", attempts.Load())
+	}
+}
+
+func TestWithRequestID(t *testing.T) {
+	var lock sync.Mutex
+	requestids := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requestids = append(requestids, r.Header.Get("X-Request-Id"))
+		lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+
+	meta := ResponseMeta{}
+	if _, err := adaptor.SendRequest("Hi", WithRequestID("trace-123"), WithResponseMeta(&meta)); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if requestids[0] != "trace-123" {
+		t.Errorf("Expected X-Request-Id 'trace-123', got '%s'", requestids[0])
+	}
+	if meta.RequestId != "trace-123" || meta.Id != "chatcmpl-1" {
+		t.Errorf("Unexpected response meta: %+v", meta)
+	}
+
+	//// An empty id generates a UUID
+	if _, err := adaptor.SendRequest("Hi", WithRequestID(""), WithResponseMeta(&meta)); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if len(meta.RequestId) != 36 || requestids[1] != meta.RequestId {
+		t.Errorf("Expected a generated UUID to be sent and returned, sent '%s', returned '%s'", requestids[1], meta.RequestId)
+	}
+	if adaptor.LastResponseMeta().RequestId != meta.RequestId {
+		t.Errorf("Expected the request id in the last response meta, got %+v", adaptor.LastResponseMeta())
+	}
+
+	if _, err := adaptor.SendRequest("Hi"); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if requestids[2] != "" {
+		t.Errorf("Expected no X-Request-Id without the option, got '%s'", requestids[2])
+	}
+}
+
+func TestWithAssistantPrefix(t *testing.T) {
+	var body map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","choices":[{"index":0,"message":{"role":"assistant","content":"\"capital\": \"Paris\"}"}}]}`))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	content, _, err := adaptor.SendRequestWithHistory("Capital of France as JSON?", nil, nil, WithAssistantPrefix("{"))
+	if err != nil {
+		t.Fatalf("SendRequestWithHistory returned error: %v", err)
+	}
+	if content != `{"capital": "Paris"}` {
+		t.Errorf("Expected the prefix to be included in the content, got '%s'", content)
+	}
+
+	messages, _ := body["messages"].([]any)
+	if len(messages) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(messages))
+	}
+	last, _ := messages[2].(map[string]any)
+	if last["role"] != "assistant" || last["content"] != "{" {
+		t.Errorf("Expected a trailing assistant message with the prefix, got %v", last)
+	}
+	if body["continue_final_message"] != true || body["add_generation_prompt"] != false {
+		t.Errorf("Expected the continue_final_message flags, got %v and %v",
+			body["continue_final_message"], body["add_generation_prompt"])
+	}
+}
+
+func TestWithGuidedDecoding(t *testing.T) {
+	var body map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+
+	schema := map[string]any{"type": "object", "properties": map[string]any{"capital": map[string]any{"type": "string"}}}
+	if _, err := adaptor.SendRequest("Capital of France?", WithGuidedJSON(schema), WithExtraBody(map[string]any{"min_p": 0.1})); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	guided, _ := body["guided_json"].(map[string]any)
+	if guided["type"] != "object" {
+		t.Errorf("Expected the schema in guided_json, got %v", body["guided_json"])
+	}
+	if body["min_p"] != 0.1 {
+		t.Errorf("Expected guided decoding to merge with the extra body, got %v", body)
+	}
+
+	if _, err := adaptor.SendRequest("Postcode?", WithGuidedRegex(`[A-Z]{2}[0-9] [0-9][A-Z]{2}`)); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if body["guided_regex"] != `[A-Z]{2}[0-9] [0-9][A-Z]{2}` {
+		t.Errorf("Expected the pattern in guided_regex, got %v", body["guided_regex"])
+	}
+
+	if _, err := adaptor.SendRequest("Positive or negative?", WithGuidedChoice([]string{"positive", "negative"})); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	choices, _ := body["guided_choice"].([]any)
+	if len(choices) != 2 || choices[0] != "positive" || choices[1] != "negative" {
+		t.Errorf("Expected the choices in guided_choice, got %v", body["guided_choice"])
+	}
+}
+
+func TestWithProxy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	var proxied atomic.Int32
+	var proxyauth atomic.Value
+	//// A forwarding proxy, which gets the absolute URL of the endpoint in the request line
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+		proxyauth.Store(r.Header.Get("Proxy-Authorization"))
+		outreq, err := http.NewRequest(r.Method, r.URL.String(), r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		outreq.Header = r.Header.Clone()
+		outreq.Header.Del("Proxy-Authorization")
+		resp, err := http.DefaultTransport.RoundTrip(outreq)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer proxy.Close()
+
+	proxyurl := strings.Replace(proxy.URL, "http://", "http://user:secret@", 1)
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithProxy(proxyurl))
+	answer, err := adaptor.SendRequest("Hi")
+	if err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if answer != "Hello" {
+		t.Errorf("Expected 'Hello', got '%s'", answer)
+	}
+	if proxied.Load() != 1 {
+		t.Errorf("Expected the request to go through the proxy, proxy saw %d requests", proxied.Load())
+	}
+	expectedauth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	if auth, _ := proxyauth.Load().(string); auth != expectedauth {
+		t.Errorf("Expected proxy authorization '%s', got '%s'", expectedauth, auth)
+	}
+
+	//// The default transport is left alone
+	if http.DefaultTransport.(*http.Transport).Proxy == nil {
+		t.Error("Expected the default transport to keep its proxy from the environment")
+	}
+}
+
+func TestWithProxyInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic for a proxy URL without a host")
+		}
+	}()
+	NewBaseAdaptor("http://localhost", "test-key", "test-model", 1, WithProxy("proxy-without-scheme"))
+}
+
+func TestWithInsecureSkipVerify(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	if _, err := adaptor.SendRequest("Hi"); err == nil {
+		t.Error("Expected the self-signed certificate to be rejected")
+	}
+
+	adaptor = NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithInsecureSkipVerify())
+	if answer, err := adaptor.SendRequest("Hi"); err != nil || answer != "Hello" {
+		t.Errorf("Expected 'Hello', got '%s', %v", answer, err)
+	}
+	if tlsconfig := http.DefaultTransport.(*http.Transport).TLSClientConfig; tlsconfig != nil && tlsconfig.InsecureSkipVerify {
+		t.Error("Expected the default transport to still verify certificates")
+	}
+}
+
+func TestWithRootCAs(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithRootCAs(pool))
+	if answer, err := adaptor.SendRequest("Hi"); err != nil || answer != "Hello" {
+		t.Errorf("Expected 'Hello', got '%s', %v", answer, err)
+	}
+
+	adaptor = NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithRootCAs(x509.NewCertPool()))
+	if _, err := adaptor.SendRequest("Hi"); err == nil {
+		t.Error("Expected the certificate to be rejected by an unrelated pool")
+	}
+}
+
+func TestWithGenerationParameters(t *testing.T) {
+	var body map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = make(map[string]any)
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	params := DefaultGenerationParameters()
+	*params.Temperature = 0.2
+	seed := int64(42)
+	params.Seed = &seed
+	params.Stop = []string{"\n\n"}
+	if _, err := adaptor.SendRequest("Hi", WithGenerationParameters(params)); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	expected := map[string]any{"max_tokens": 1024.0, "temperature": 0.2, "top_p": 0.95, "seed": 42.0}
+	for key, value := range expected {
+		if body[key] != value {
+			t.Errorf("Expected %s %v in the request body, got %v", key, value, body[key])
+		}
+	}
+	if stop, ok := body["stop"].([]any); !ok || len(stop) != 1 || stop[0] != "\n\n" {
+		t.Errorf("Expected the stop sequences in the request body, got %v", body["stop"])
+	}
+	for _, key := range []string{"top_k", "n", "presence_penalty", "frequency_penalty", "repetition_penalty"} {
+		if _, ok := body[key]; ok {
+			t.Errorf("Expected %s to be left out of the request body", key)
+		}
+	}
+	if *DefaultGenerationParameters().Temperature != 0.7 {
+		t.Error("Expected changes to one set of defaults not to affect the next")
+	}
+
+	//// Without the option none of the parameters are sent
+	if _, err := adaptor.SendRequest("Hi"); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if _, ok := body["temperature"]; ok {
+		t.Errorf("Expected no temperature in the request body, got %v", body["temperature"])
+	}
+
+	//// The parameters are request fields, so can't also be set in the extra body
+	if _, err := adaptor.SendRequest("Hi", WithExtraBody(map[string]any{"temperature": 0.5})); err == nil {
+		t.Error("Expected an error for an extra body key colliding with a generation parameter, got nil")
+	}
+}
+
+func TestTopKAndRepetitionPenaltyMarshalling(t *testing.T) {
+	unset, err := json.Marshal(AIRequest{Model: "test-model"})
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+	if strings.Contains(string(unset), "top_k") || strings.Contains(string(unset), "repetition_penalty") {
+		t.Errorf("Expected top_k and repetition_penalty to be left out, got %s", unset)
+	}
+
+	topk, penalty := 40, 1.1
+	set, err := json.Marshal(AIRequest{Model: "test-model",
+		GenerationParameters: GenerationParameters{TopK: &topk, RepetitionPenalty: &penalty}})
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+	expected := `{"model":"test-model","messages":null,"top_k":40,"repetition_penalty":1.1}`
+	if equal, err := compareJsonStrings(string(set), expected); err != nil || !equal {
+		t.Errorf("Expected %s, got %s", expected, set)
+	}
+}
+
+func TestWithIdempotencyKey(t *testing.T) {
+	var lock sync.Mutex
+	keys := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		keys = append(keys, r.Header.Get("X-Idempotency-Key"))
+		attempt := len(keys)
+		lock.Unlock()
+		//// Every odd attempt fails, so each request is retried once
+		if attempt%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	var generated atomic.Int32
+	generator := func() string {
+		return fmt.Sprintf("generated-%d", generated.Add(1))
+	}
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 3,
+		WithServiceUnavailableDelay(time.Millisecond), WithDefaultIdempotencyKeyGenerator(generator))
+
+	if _, err := adaptor.SendRequest("Hi", WithIdempotencyKey("order-42")); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if _, err := adaptor.SendRequest("Hi"); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if _, err := adaptor.SendRequest("Hi"); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	expected := []string{"order-42", "order-42", "generated-1", "generated-1", "generated-2", "generated-2"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected the same key for every attempt of a request, %v, got %v", expected, keys)
+	}
+
+	//// No key without either option
+	keys = keys[:0]
+	plain := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 3,
+		WithServiceUnavailableDelay(time.Millisecond))
+	if _, err := plain.SendRequest("Hi"); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if keys[0] != "" || keys[1] != "" {
+		t.Errorf("Expected no X-Idempotency-Key, got %v", keys)
+	}
+}
+
+func TestSendOptions(t *testing.T) {
+	var reqData AIRequest
+	var body map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		reqData, body = AIRequest{}, make(map[string]any)
+		json.Unmarshal(data, &reqData)
+		json.Unmarshal(data, &body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	instruction, seed := "Answer in French.", int64(7)
+	weather := NewTool("get_user_weather", "Get the weather", []ToolParameter{{Name: "location", Type: "string", Required: true}})
+	search := NewTool("search", "Search the web", []ToolParameter{{Name: "query", Type: "string", Required: true}})
+	options := SendOptions{
+		BaseInstruction: &instruction,
+		Tools:           []Tool{search},
+		Extra:           map[string]any{"min_p": 0.1},
+		User:            "user-42",
+		Seed:            &seed,
+	}
+	if _, _, err := adaptor.SendRequestWithHistory("Hi", nil, []Tool{weather}, &options); err != nil {
+		t.Fatalf("SendRequestWithHistory returned error: %v", err)
+	}
+	if reqData.Messages[0].Content != instruction {
+		t.Errorf("Expected the base instruction to be overridden, got %q", reqData.Messages[0].Content)
+	}
+	if len(reqData.Tools) != 1 || reqData.Tools[0].Function.Name != "search" {
+		t.Errorf("Expected the tools to be overridden, got %+v", reqData.Tools)
+	}
+	if body["min_p"] != 0.1 || body["user"] != "user-42" || body["seed"] != 7.0 {
+		t.Errorf("Expected min_p, user and seed in the request body, got %v", body)
+	}
+
+	//// Zero options change nothing, and combine with the other options
+	if _, _, err := adaptor.SendRequestWithHistory("Hi", nil, []Tool{weather}, &SendOptions{}, WithTopK(5)); err != nil {
+		t.Fatalf("SendRequestWithHistory returned error: %v", err)
+	}
+	if reqData.Messages[0].Content != "You are an assistant." || len(reqData.Tools) != 1 || reqData.Tools[0].Function.Name != "get_user_weather" {
+		t.Errorf("Expected the adaptor's instruction and the call's tools, got %+v", reqData)
+	}
+	if _, ok := body["user"]; ok || body["top_k"] != 5.0 {
+		t.Errorf("Expected top_k and no user in the request body, got %v", body)
+	}
+
+	//// As do nil options, e.g. when the caller has none to give
+	if _, _, err := adaptor.SendRequestWithHistory("Hi", nil, []Tool{weather}, (*SendOptions)(nil)); err != nil {
+		t.Fatalf("SendRequestWithHistory returned error with nil options: %v", err)
+	}
+	if reqData.Messages[0].Content != "You are an assistant." || len(reqData.Tools) != 1 || reqData.Tools[0].Function.Name != "get_user_weather" {
+		t.Errorf("Expected nil options to change nothing, got %+v", reqData)
+	}
+}
+
+func TestWithModelFallback(t *testing.T) {
+	var lock sync.Mutex
+	models := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqData := AIRequest{}
+		json.NewDecoder(r.Body).Decode(&reqData)
+		lock.Lock()
+		models = append(models, reqData.Model)
+		lock.Unlock()
+		switch reqData.Model {
+		case "primary-model":
+			w.WriteHeader(http.StatusNotFound)
+		case "overloaded-model":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "bad-request-model":
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(testChatResponse))
+		}
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "primary-model", "You are an assistant.", OpenAIJsonExtractor, 2,
+		WithServiceUnavailableDelay(time.Millisecond), WithModelFallback("overloaded-model", "fallback-model", "unused-model"))
+	meta := ResponseMeta{}
+	content, err := adaptor.SendRequest("Hi", WithResponseMeta(&meta))
+	if err != nil || content != "Hello" {
+		t.Fatalf("Expected 'Hello' from the fallback, got '%s', %v", content, err)
+	}
+	expected := []string{"primary-model", "overloaded-model", "overloaded-model", "fallback-model"}
+	if !reflect.DeepEqual(models, expected) {
+		t.Errorf("Expected the models to be tried in turn, %v, got %v", expected, models)
+	}
+	if meta.RequestModel != "fallback-model" || adaptor.LastResponseMeta().RequestModel != "fallback-model" {
+		t.Errorf("Expected the fallback model in the response meta, got %+v", meta)
+	}
+	if adaptor.Model() != "primary-model" {
+		t.Errorf("Expected the adaptor's model to be unchanged, got %s", adaptor.Model())
+	}
+
+	//// A client error would fail the same with any model, so it's returned as it is
+	models = models[:0]
+	badrequest := adaptor.Clone(WithModel("bad-request-model"))
+	_, err = badrequest.SendRequest("Hi")
+	statuserr := &StatusError{}
+	if !errors.As(err, &statuserr) || statuserr.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected the 400 to be returned, got %v", err)
+	}
+	if len(models) != 1 {
+		t.Errorf("Expected no fallback after a 400, got %v", models)
+	}
+
+	//// Without fallbacks the primary's error is returned
+	models = models[:0]
+	plain := NewAdaptor(server.URL, "test-key", "primary-model", "You are an assistant.", OpenAIJsonExtractor, 2)
+	if _, err := plain.SendRequest("Hi"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected the primary model's error, got %v", err)
+	}
+	if len(models) != 1 {
+		t.Errorf("Expected only the primary model to be tried, got %v", models)
+	}
+}
+
+func TestWithModelFallbackIdempotencyKey(t *testing.T) {
+	var lock sync.Mutex
+	keys := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqData := AIRequest{}
+		json.NewDecoder(r.Body).Decode(&reqData)
+		lock.Lock()
+		keys[reqData.Model] = r.Header.Get("Idempotency-Key")
+		lock.Unlock()
+		if reqData.Model == "primary-model" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "primary-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithModelFallback("backup-model"), WithDefaultIdempotencyKeyGenerator(newUUID))
+	for _, opts := range [][]RequestOption{nil, {WithIdempotencyKey("caller-key")}} {
+		if _, err := adaptor.SendRequest("Hi", opts...); err != nil {
+			t.Fatalf("Expected the fallback to answer, got %v", err)
+		}
+		if keys["primary-model"] == "" || keys["backup-model"] == "" || keys["primary-model"] == keys["backup-model"] {
+			t.Errorf("Expected the fallback to send a new idempotency key, got %v", keys)
+		}
+	}
+}
+
+func TestWithRequestHashIdempotencyKey(t *testing.T) {
+	var lock sync.Mutex
+	keys := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		key := r.Header.Get("Idempotency-Key")
+		if key != r.Header.Get("X-Idempotency-Key") {
+			key = "mismatched headers"
+		}
+		keys = append(keys, key)
+		attempt := len(keys)
+		lock.Unlock()
+		//// Every odd attempt fails, so each request is retried once
+		if attempt%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 3,
+		WithServiceUnavailableDelay(time.Millisecond), WithRequestHashIdempotencyKey())
+	for _, message := range []string{"Hi", "Bye", "Hi"} {
+		if _, err := adaptor.SendRequest(message); err != nil {
+			t.Fatalf("SendRequest returned error: %v", err)
+		}
+	}
+	if len(keys) != 6 || len(keys[0]) != 64 {
+		t.Fatalf("Expected a SHA256 key for each of 6 attempts, got %v", keys)
+	}
+	if keys[0] != keys[1] || keys[2] != keys[3] {
+		t.Errorf("Expected the same key for every attempt of a request, got %v", keys)
+	}
+	if keys[0] == keys[2] || keys[0] != keys[4] {
+		t.Errorf("Expected the key to depend only on the request, got %v", keys)
+	}
+
+	//// An explicit key wins
+	keys = keys[:0]
+	if _, err := adaptor.SendRequest("Hi", WithIdempotencyKey("order-42")); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"order-42", "order-42"}) {
+		t.Errorf("Expected the explicit key on both attempts, got %v", keys)
+	}
+}
+
+func TestWithResponseChecksum(t *testing.T) {
+	sum := sha256.Sum256([]byte(testChatResponse))
+	var checksum string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if checksum != "" {
+			w.Header().Set("X-Response-SHA256", checksum)
+		}
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithResponseChecksum("X-Response-SHA256"))
+	for _, valid := range []string{hex.EncodeToString(sum[:]), strings.ToUpper(hex.EncodeToString(sum[:])),
+		base64.StdEncoding.EncodeToString(sum[:])} {
+		checksum = valid
+		content, err := adaptor.SendRequest("Hi")
+		if err != nil || content != "Hello" {
+			t.Errorf("Expected 'Hello' for checksum %s, got '%s', %v", valid, content, err)
+		}
+	}
+
+	for _, invalid := range []string{"", hex.EncodeToString(make([]byte, sha256.Size))} {
+		checksum = invalid
+		if _, err := adaptor.SendRequest("Hi"); !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("Expected ErrChecksumMismatch for checksum %q, got %v", invalid, err)
+		}
+	}
+
+	//// Not checked without the option
+	unchecked := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	if _, err := unchecked.SendRequest("Hi"); err != nil {
+		t.Errorf("Expected no checksum check by default, got %v", err)
+	}
+}
+
+func TestParallelToolCallsMarshalling(t *testing.T) {
+	for _, tt := range []struct {
+		opts     []RequestOption
+		expected string /// the parallel_tool_calls field, or empty if it should be left out
+	}{
+		{nil, ""},
+		{[]RequestOption{WithParallelToolCalls(false)}, `"parallel_tool_calls":false`},
+		{[]RequestOption{WithParallelToolCalls(true)}, `"parallel_tool_calls":true`},
+	} {
+		adaptor := NewAdaptor("http://localhost", "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+		reqData, err := adaptor.newAIRequest([]Message{{Role: "user", Content: "Hi"}}, nil, adaptor.newRequestConfig(tt.opts))
+		if err != nil {
+			t.Fatalf("newAIRequest returned error: %v", err)
+		}
+		data, err := json.Marshal(reqData)
+		if err != nil {
+			t.Fatalf("Failed to marshal request: %v", err)
+		}
+		if tt.expected == "" && strings.Contains(string(data), "parallel_tool_calls") {
+			t.Errorf("Expected parallel_tool_calls to be left out, got %s", data)
+		}
+		if tt.expected != "" && !strings.Contains(string(data), tt.expected) {
+			t.Errorf("Expected %s, got %s", tt.expected, data)
+		}
+	}
+}
+
+func TestWithTopKAndRepetitionPenalty(t *testing.T) {
+	var body map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = make(map[string]any)
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	defaults := WithGenerationParameters(DefaultGenerationParameters())
+	if _, err := adaptor.SendRequest("Hi", defaults, WithTopK(40), WithRepetitionPenalty(1.1)); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	expected := map[string]any{"top_k": 40.0, "repetition_penalty": 1.1, "temperature": 0.7}
+	for key, value := range expected {
+		if body[key] != value {
+			t.Errorf("Expected %s %v in the request body, got %v", key, value, body[key])
+		}
+	}
+
+	//// The options don't change the parameters shared with other requests
+	if _, err := adaptor.SendRequest("Hi", defaults); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if _, ok := body["top_k"]; ok {
+		t.Errorf("Expected no top_k in the request body, got %v", body["top_k"])
+	}
+}
+
+func TestWithRawResponse(t *testing.T) {
+	//// Extra whitespace and an unknown field, which a re-encoding would lose
+	response := "{\"id\":\"chatcmpl-1\",  \"vendor_field\":{\"a\":1},\n\"choices\":[{\"index\":0,\"message\":{\"role\":\"assistant\",\"content\":\"Hello\"},\"finish_reason\":\"stop\"}]}\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	var raw []byte
+	content, _, err := adaptor.SendRequestWithHistory("Hi", nil, nil, WithRawResponse(&raw))
+	if err != nil {
+		t.Fatalf("SendRequestWithHistory returned error: %v", err)
+	}
+	if content != "Hello" {
+		t.Errorf("Expected 'Hello', got '%s'", content)
+	}
+	if string(raw) != response {
+		t.Errorf("Expected the raw body %q, got %q", response, raw)
+	}
+
+	//// The raw body is there even when extraction fails
+	failing := func(reader io.ReadCloser) (string, []FunctionCall, error) {
+		return "", nil, errors.New("cannot parse")
+	}
+	raw = nil
+	if _, _, err := adaptor.SendRequestWithHistory("Hi", nil, nil, WithRawResponse(&raw), WithExtractor(failing)); err == nil {
+		t.Error("Expected the extractor's error")
+	}
+	if string(raw) != response {
+		t.Errorf("Expected the raw body after a failed extraction, got %q", raw)
+	}
+}
+
+func TestWithSystemPrompt(t *testing.T) {
+	var reqData AIRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqData = AIRequest{}
+		json.NewDecoder(r.Body).Decode(&reqData)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	systemPrompt := func() string {
+		if len(reqData.Messages) == 0 || reqData.Messages[0].Role != "system" {
+			return ""
+		}
+		return reqData.Messages[0].Content
+	}
+
+	history := []Message{{Role: "user", Content: "Hi"}, {Role: "assistant", Content: "Hello"}}
+	if _, _, err := adaptor.SendRequestWithHistory("Great product!", history, nil,
+		WithSystemPrompt("Classify the sentiment as positive or negative.")); err != nil {
+		t.Fatalf("SendRequestWithHistory returned error: %v", err)
+	}
+	if systemPrompt() != "Classify the sentiment as positive or negative." {
+		t.Errorf("Expected the overridden system prompt, got %q", systemPrompt())
+	}
+	if len(reqData.Messages) != 4 {
+		t.Errorf("Expected one system message and the rest of the history, got %+v", reqData.Messages)
+	}
+
+	//// The adaptor's base instructions are unchanged
+	if _, err := adaptor.SendRequest("Hi"); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if systemPrompt() != "You are an assistant." {
+		t.Errorf("Expected the base instructions, got %q", systemPrompt())
+	}
+	if adaptor.baseinstruct != "You are an assistant." {
+		t.Errorf("Expected the adaptor to be unchanged, got %q", adaptor.baseinstruct)
+	}
+}
+
+// Answers every request itself, without a server
+type mockTransport struct {
+	requests atomic.Int32
+	name     string
+}
+
+func (m *mockTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	m.requests.Add(1)
+	if r.Body != nil {
+		r.Body.Close()
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(strings.Replace(testChatResponse, "Hello", m.name, 1))),
+		Request:    r,
+	}, nil
+}
+
+func TestWithTransport(t *testing.T) {
+	mock := &mockTransport{name: "mock"}
+	adaptor := NewAdaptor("http://unreachable.invalid", "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithTransport(mock))
+	answer, err := adaptor.SendRequest("Hi")
+	if err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if answer != "mock" || mock.requests.Load() != 1 {
+		t.Errorf("Expected the mock transport to answer, got '%s' after %d requests", answer, mock.requests.Load())
+	}
+
+	//// A transport option can't tune the mock, so it is left in place
+	tuned := adaptor.Clone(WithMaxIdleConnsPerHost(10))
+	if _, err := tuned.SendRequest("Hi"); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if mock.requests.Load() != 2 {
+		t.Errorf("Expected the clone to keep the mock transport, got %d requests", mock.requests.Load())
+	}
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	clientmock := &mockTransport{name: "client"}
+	transportmock := &mockTransport{name: "transport"}
+	client := &http.Client{Transport: clientmock}
+
+	//// WithHTTPClient wins whichever order the options are given in
+	orders := [][]Option{
+		{WithHTTPClient(client), WithTransport(transportmock)},
+		{WithTransport(transportmock), WithHTTPClient(client)},
+	}
+	for i, opts := range orders {
+		adaptor := NewAdaptor("http://unreachable.invalid", "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1, opts...)
+		answer, err := adaptor.SendRequest("Hi")
+		if err != nil {
+			t.Fatalf("SendRequest returned error: %v", err)
+		}
+		if answer != "client" {
+			t.Errorf("Order %d: expected the client's transport to answer, got '%s'", i, answer)
+		}
+	}
+	if transportmock.requests.Load() != 0 {
+		t.Errorf("Expected no requests through WithTransport, got %d", transportmock.requests.Load())
+	}
+
+	//// The client is shared with clones and never changed by transport options
+	adaptor := NewAdaptor("http://unreachable.invalid", "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithHTTPClient(client), WithMaxIdleConns(5))
+	clone := adaptor.Clone(WithProxy("http://proxy.invalid:3128"))
+	if clone.BaseAdaptor.client != client || client.Transport != clientmock {
+		t.Error("Expected the injected client to be used as it is")
+	}
+}
+
+func TestWithRetryDecider(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if attempts.Add(1) == 1 {
+			w.Write([]byte(`{"error":{"code":"model_overloaded"}}`))
+			return
+		}
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	decider := func(resp *http.Response) (bool, time.Duration) {
+		body, _ := io.ReadAll(resp.Body)
+		if strings.Contains(string(body), "model_overloaded") {
+			return true, time.Millisecond
+		}
+		return DefaultRetryDecider(resp)
+	}
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 3,
+		WithRetryDecider(decider))
+	answer, err := adaptor.SendRequest("Hi")
+	if err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	//// The decider read the body, but the extractor still gets all of it
+	if answer != "Hello" {
+		t.Errorf("Expected 'Hello', got '%s'", answer)
+	}
+	if attempts.Load() != 2 {
+		t.Errorf("Expected 2 attempts, got %d", attempts.Load())
+	}
+
+	//// Every attempt asks for a retry, so the retries run out
+	attempts.Store(0)
+	always := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 3,
+		WithRetryDecider(func(resp *http.Response) (bool, time.Duration) { return true, time.Millisecond }))
+	if _, err := always.SendRequest("Hi"); err == nil || !strings.Contains(err.Error(), "retries exceeded") {
+		t.Errorf("Expected the retries to run out, got %v", err)
+	}
+	if attempts.Load() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts.Load())
+	}
+}
+
+func TestDefaultRetryDecider(t *testing.T) {
+	if retry, wait := DefaultRetryDecider(&http.Response{StatusCode: http.StatusServiceUnavailable}); !retry || wait != 30*time.Second {
+		t.Errorf("Expected a 503 to be retried after 30s, got %v, %v", retry, wait)
+	}
+	if retry, _ := DefaultRetryDecider(&http.Response{StatusCode: http.StatusBadRequest}); retry {
+		t.Error("Expected a 400 not to be retried")
+	}
+}
+
+// Adds the attempt number to each request before passing it on
+type attemptHeaderTransport struct{}
+
+func (attemptHeaderTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("X-Retry-Attempt", fmt.Sprint(RetryAttemptFromContext(r.Context())))
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestRetryAttemptFromContext(t *testing.T) {
+	var lock sync.Mutex
+	headers := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		headers = append(headers, r.Header.Get("X-Retry-Attempt"))
+		attempt := len(headers)
+		lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if attempt < 3 {
+			w.Write([]byte(`{"error":"busy"}`))
+			return
+		}
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 3,
+		WithTransport(attemptHeaderTransport{}),
+		WithRetryDecider(func(resp *http.Response) (bool, time.Duration) {
+			body, _ := io.ReadAll(resp.Body)
+			return strings.Contains(string(body), "busy"), time.Millisecond
+		}))
+	if _, err := adaptor.SendRequest("Hi"); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	expected := []string{"1", "2", "3"}
+	if !reflect.DeepEqual(headers, expected) {
+		t.Errorf("Expected attempt headers %v, got %v", expected, headers)
+	}
+	if RetryAttemptFromContext(context.Background()) != 0 {
+		t.Error("Expected 0 for a context without an attempt")
+	}
+}
+
+func TestWithServiceUnavailableDelay(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	logs := bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 2,
+		WithServiceUnavailableDelay(10*time.Millisecond), WithLogger(logger))
+	start := time.Now()
+	answer, err := adaptor.SendRequest("Hi")
+	if err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if answer != "Hello" || attempts.Load() != 2 {
+		t.Errorf("Expected 'Hello' after 2 attempts, got '%s' after %d", answer, attempts.Load())
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("Expected the configured delay to be used, took %v", elapsed)
+	}
+	if !strings.Contains(logs.String(), "retrying request") || !strings.Contains(logs.String(), "status=503") {
+		t.Errorf("Expected the retry to be logged to the configured logger, got %q", logs.String())
+	}
+}
+
+func TestWithMaxConcurrent(t *testing.T) {
+	var inflight, maxinflight, total atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		total.Add(1)
+		for {
+			m := maxinflight.Load()
+			if n <= m || maxinflight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithMaxConcurrent(3))
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := adaptor.SendRequest("Hi"); err != nil {
+				t.Errorf("SendRequest returned error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if maxinflight.Load() > 3 {
+		t.Errorf("Expected at most 3 requests in flight, got %d", maxinflight.Load())
+	}
+	if total.Load() != 20 {
+		t.Errorf("Expected 20 requests, got %d", total.Load())
+	}
+	if len(adaptor.slots) != 0 {
+		t.Errorf("Expected every slot to be released, %d still held", len(adaptor.slots))
+	}
+}
+
+func TestWithMaxConcurrentContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithMaxConcurrent(1))
+	go adaptor.SendRequest("Hi")
+	for len(adaptor.slots) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	//// The only slot is taken, so this waits until its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := adaptor.SendRequest("Hi", WithContext(ctx)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the wait to end with the context, got %v", err)
+	}
+}
+
+func TestWithOrganizationAndProject(t *testing.T) {
+	var lock sync.Mutex
+	headers := make([]http.Header, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		headers = append(headers, r.Header.Clone())
+		lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithOrganization("org-123"), WithProject("proj_abc"))
+	if _, err := adaptor.SendRequest("Hi"); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if _, err := adaptor.Clone().SendRequest("Hi"); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	plain := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	if _, err := plain.SendRequest("Hi"); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if headers[i].Get("OpenAI-Organization") != "org-123" || headers[i].Get("OpenAI-Project") != "proj_abc" {
+			t.Errorf("Expected the organization and project headers on request %d, got %v", i, headers[i])
+		}
+	}
+	if _, ok := headers[2]["Openai-Organization"]; ok {
+		t.Errorf("Expected no organization header without the option, got %v", headers[2])
+	}
+	if _, ok := headers[2]["Openai-Project"]; ok {
+		t.Errorf("Expected no project header without the option, got %v", headers[2])
+	}
+}
+
+func TestWithResponseSchema(t *testing.T) {
+	type city struct {
+		Name       string `json:"name"`
+		Population int    `json:"population"`
+	}
+	schema, err := SchemaFromStruct[city]()
+	if err != nil {
+		t.Fatalf("SchemaFromStruct returned error: %v", err)
+	}
+	var lock sync.Mutex
+	requests := make([]AIRequest, 0)
+	keys := make([]string, 0)
+	contents := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqData := AIRequest{}
+		json.NewDecoder(r.Body).Decode(&reqData)
+		lock.Lock()
+		requests = append(requests, reqData)
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		content := contents[min(len(requests), len(contents))-1]
+		lock.Unlock()
+		response := map[string]any{
+			"choices": []map[string]any{
+				{"index": 0, "message": map[string]any{"role": "assistant", "content": content}, "finish_reason": "stop"},
+			},
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are a geographer.", OpenAIJsonExtractor, 1)
+
+	//// The first response is corrected
+	contents = []string{`{"name": "Paris", "population": "2.1 million"}`, `{"name": "Paris", "population": 2100000}`}
+	content, err := adaptor.SendRequest("Describe Paris", WithJSONMode(), WithResponseSchema(schema, 2),
+		WithIdempotencyKey("key-1"))
+	if err != nil || content != contents[1] {
+		t.Fatalf("Expected the corrected response, got '%s', %v", content, err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("Expected one correction, got %d requests", len(requests))
+	}
+	correction := requests[1].Messages
+	if len(correction) != 4 || correction[2].Role != string(ROLE_AGENT) || correction[2].Content != contents[0] ||
+		!strings.Contains(correction[3].Content, "field response.population should be of type number") ||
+		!strings.Contains(correction[3].Content, `"population"`) {
+		t.Errorf("Expected the invalid response and a correction with the error and schema, got %+v", correction)
+	}
+	if keys[0] != "key-1" || keys[1] == "key-1" {
+		t.Errorf("Expected the correction not to reuse the idempotency key, got %v", keys)
+	}
+
+	//// Still invalid once the retries are used up
+	requests, keys = requests[:0], keys[:0]
+	contents = []string{`{"name": "Paris"}`}
+	content, err = adaptor.SendRequest("Describe Paris",
+		WithResponseSchema(`{"type": "object", "required": ["name", "population"]}`, 1))
+	if !errors.Is(err, ErrResponseSchema) || !strings.Contains(err.Error(), "missing required field response.population") {
+		t.Errorf("Expected ErrResponseSchema, got %v", err)
+	}
+	if content != contents[0] || len(requests) != 2 {
+		t.Errorf("Expected the last response after one retry, got '%s' after %d requests", content, len(requests))
+	}
+
+	//// Content that isn't JSON at all
+	requests = requests[:0]
+	contents = []string{"Paris has about 2.1 million people."}
+	_, err = adaptor.SendRequest("Describe Paris", WithResponseSchema(schema, 0))
+	if !errors.Is(err, ErrResponseSchema) || len(requests) != 1 {
+		t.Errorf("Expected ErrResponseSchema without a retry, got %v after %d requests", err, len(requests))
+	}
+}
+
+func TestBaseAdaptor_Close(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	_, err := adaptor.SendRequest("Hi")
+	if err != nil {
+		t.Fatalf("SendRequest failed: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := adaptor.Close(); err != nil {
+			t.Fatalf("Close %d failed: %v", i+1, err)
+		}
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the idle connection to be closed")
+	}
+
+	_, err = adaptor.SendRequest("Hi")
+	if !errors.Is(err, ErrAdaptorClosed) {
+		t.Errorf("Expected ErrAdaptorClosed after Close, got %v", err)
+	}
+	//// A clone has its own lifecycle
+	_, err = adaptor.Clone().SendRequest("Hi")
+	if err != nil {
+		t.Errorf("Expected a clone of a closed adaptor to still send, got %v", err)
+	}
+}
+
+func TestHTTP2OnlyTransport_CloseIdleConnections(t *testing.T) {
+	server, pool := newProtoServer(t, true)
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithHTTP2Only(), WithRootCAs(pool))
+	//// Nothing to close yet, but it must not stop the first request from building the transport
+	adaptor.Close()
+	clone := adaptor.Clone()
+	_, err := clone.SendRequest("Hi")
+	if err != nil {
+		t.Fatalf("SendRequest failed: %v", err)
+	}
+	if err := clone.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
+
+func TestWithDebug(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	logs := bytes.Buffer{}
+	//// At the default level, so turning debug on is enough
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithLogger(logger), WithDebug(true))
+	answer, err := adaptor.SendRequest("Hi")
+	if err != nil || answer != "Hello" {
+		t.Fatalf("Expected 'Hello', got '%s', %v", answer, err)
+	}
+	if !strings.Contains(logs.String(), "level=INFO msg=read") || !strings.Contains(logs.String(), "chatcmpl") {
+		t.Errorf("Expected the response body to be logged to the configured logger, got %q", logs.String())
+	}
+
+	logs.Reset()
+	_, err = adaptor.Clone(WithDebug(false)).SendRequest("Hi")
+	if err != nil {
+		t.Fatalf("SendRequest failed: %v", err)
+	}
+	if strings.Contains(logs.String(), "msg=read") {
+		t.Errorf("Expected nothing to be logged without debug, got %q", logs.String())
+	}
+}
+
+func TestWithRetryBudget(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	//// maxretries would allow 100 attempts, 5 seconds of waiting
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 100,
+		WithServiceUnavailableDelay(50*time.Millisecond), WithRetryBudget(200*time.Millisecond))
+	start := time.Now()
+	_, err := adaptor.SendRequest("Hi")
+	elapsed := time.Since(start)
+	if !errors.Is(err, ErrRetryBudgetExceeded) || !strings.Contains(err.Error(), "status 503") {
+		t.Fatalf("Expected ErrRetryBudgetExceeded wrapping the last error, got %v", err)
+	}
+	//// Only the last attempt, which started within the budget, can finish after it
+	if elapsed > 500*time.Millisecond || attempts.Load() < 2 || attempts.Load() > 5 {
+		t.Errorf("Expected the retries to stop within the budget, took %v and %d attempts", elapsed, attempts.Load())
+	}
+
+	//// A shorter deadline still ends the request first
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = adaptor.Clone(WithRetryBudget(10*time.Second)).SendRequest("Hi", WithContext(ctx))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the context's deadline to end the retries, got %v", err)
+	}
+}
+
+func TestTransportOptionIgnoredLogged(t *testing.T) {
+	logs := bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	NewAdaptor("http://localhost", "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithLogger(logger), WithHTTPClient(&http.Client{}), WithMaxIdleConns(5))
+	if !strings.Contains(logs.String(), "level=WARN") || !strings.Contains(logs.String(), "WithHTTPClient") {
+		t.Errorf("Expected the ignored option to be logged to the configured logger, got %q", logs.String())
+	}
+}
@@ -0,0 +1,239 @@
+package hf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+)
+
+// An adaptor for OpenAI's Responses API, which takes a list of input items (messages, function calls
+// and their outputs) rather than chat messages, and answers with a list of output items rather than
+// choices. apiurl is the full endpoint, e.g. https://api.openai.com/v1/responses. The history is
+// the same []Message as for Adaptor, so tool calls and their results can be added with
+// InjectToolResults.
+type ResponsesAdaptor struct {
+	*BaseAdaptor
+	instructions string /// sent as the request's instructions rather than as a system message
+}
+
+func NewResponsesAdaptor(apiurl, apikey, model, instructions string, maxretries int, opts ...Option) *ResponsesAdaptor {
+	return &ResponsesAdaptor{
+		BaseAdaptor:  NewBaseAdaptor(apiurl, apikey, model, maxretries, opts...),
+		instructions: instructions,
+	}
+}
+
+type ResponsesRequest struct {
+	Model             string               `json:"model"`
+	Instructions      string               `json:"instructions,omitempty"`
+	Input             []ResponsesInputItem `json:"input"`
+	Tools             []ResponsesTool      `json:"tools,omitempty"`
+	ParallelToolCalls *bool                `json:"parallel_tool_calls,omitempty"`
+	User              string               `json:"user,omitempty"`
+	MaxOutputTokens   *int                 `json:"max_output_tokens,omitempty"`
+	Temperature       *float64             `json:"temperature,omitempty"`
+	TopP              *float64             `json:"top_p,omitempty"`
+}
+
+// A message (Role and Content), a function call the model made (Type function_call) or the output of
+// one (Type function_call_output)
+type ResponsesInputItem struct {
+	Type      string  `json:"type,omitempty"` /// empty for a message
+	Role      string  `json:"role,omitempty"`
+	Content   string  `json:"content,omitempty"`
+	CallId    string  `json:"call_id,omitempty"`
+	Name      string  `json:"name,omitempty"`
+	Arguments string  `json:"arguments,omitempty"`
+	Output    *string `json:"output,omitempty"` /// a pointer as an empty output is still sent
+}
+
+// The Responses API has the function's fields at the top level rather than under function
+type ResponsesTool struct {
+	Type        string                  `json:"type"`
+	Name        string                  `json:"name"`
+	Description string                  `json:"description,omitempty"`
+	Parameters  *ToolFunctionParameters `json:"parameters,omitempty"`
+}
+
+func newResponsesTools(tools []Tool) []ResponsesTool {
+	if tools == nil {
+		return nil
+	}
+	responsestools := make([]ResponsesTool, 0, len(tools))
+	for _, tool := range tools {
+		responsestools = append(responsestools, ResponsesTool{
+			Type:        tool.Type,
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			Parameters:  tool.Function.Parameters,
+		})
+	}
+	return responsestools
+}
+
+// Convert chat messages to input items. Tool messages become function call outputs, and the calls
+// made by an assistant message become function calls after its content (if any).
+func newResponsesInput(messages []Message) []ResponsesInputItem {
+	input := make([]ResponsesInputItem, 0, len(messages))
+	for _, message := range messages {
+		if message.Role == string(ROLE_TOOL) {
+			output := message.Content
+			input = append(input, ResponsesInputItem{
+				Type: "function_call_output", CallId: message.ToolCallId, Output: &output,
+			})
+			continue
+		}
+		if message.Content != "" || len(message.ToolCalls) == 0 {
+			input = append(input, ResponsesInputItem{
+				Role: message.Role, Content: message.Content,
+			})
+		}
+		for _, call := range message.ToolCalls {
+			input = append(input, ResponsesInputItem{
+				Type: "function_call", CallId: call.Id, Name: call.Function.Name, Arguments: call.Function.Arguments,
+			})
+		}
+	}
+	return input
+}
+
+type ResponsesResponse struct {
+	Id     string                `json:"id"`
+	Status string                `json:"status"` /// e.g. completed, incomplete or failed
+	Output []ResponsesOutputItem `json:"output"`
+	Error  *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	IncompleteDetails *struct {
+		Reason string `json:"reason"` /// e.g. max_output_tokens or content_filter
+	} `json:"incomplete_details"`
+	Usage struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+// A message, a function call or another item (e.g. reasoning) which is ignored
+type ResponsesOutputItem struct {
+	Type    string `json:"type"`
+	Id      string `json:"id"`
+	Role    string `json:"role"`
+	Content []struct {
+		Type    string `json:"type"` /// output_text or refusal
+		Text    string `json:"text"`
+		Refusal string `json:"refusal"`
+	} `json:"content"`
+	CallId    string `json:"call_id"` /// the id the function call's output is sent back with
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+var (
+	ErrResponseIncomplete = errors.New("response incomplete")
+	ErrRefusal            = errors.New("the model refused")
+)
+
+// Extract the text and function calls from a Responses API response. The text of all the output
+// messages is joined. Each function call is returned with its call_id as the Id, so the results can
+// be sent back with InjectToolResults. A response that stopped early (status incomplete, e.g. at
+// max_output_tokens) is returned as far as it got, with an error wrapping ErrResponseIncomplete.
+// A refusal is an error wrapping ErrRefusal, with the model's explanation.
+func ResponsesJsonExtractor(reader io.ReadCloser) (string, []FunctionCall, error) {
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return "", nil, fmt.Errorf("error reading response: %w", err)
+	}
+	resp := ResponsesResponse{}
+	err = json.NewDecoder(bytes.NewReader(data)).Decode(&resp)
+	if err != nil {
+		return "", nil, newDecodeError("ResponsesJsonExtractor", data, err)
+	}
+	if resp.Error != nil {
+		return "", nil, fmt.Errorf("response %s failed: %s: %s", resp.Id, resp.Error.Code, resp.Error.Message)
+	}
+	if resp.Status == "failed" {
+		return "", nil, fmt.Errorf("response %s failed", resp.Id)
+	}
+	content := strings.Builder{}
+	functioncalls := make([]FunctionCall, 0)
+	for _, item := range resp.Output {
+		switch item.Type {
+		case "message":
+			for _, part := range item.Content {
+				switch part.Type {
+				case "output_text":
+					content.WriteString(part.Text)
+				case "refusal":
+					return "", nil, fmt.Errorf("%w: %s", ErrRefusal, part.Refusal)
+				}
+			}
+		case "function_call":
+			call := FunctionCall{Id: item.CallId, Type: "function"}
+			call.Function.Name = item.Name
+			call.Function.Arguments = item.Arguments
+			functioncalls = append(functioncalls, call)
+		}
+	}
+	if resp.Status == "incomplete" {
+		reason := "unknown reason"
+		if resp.IncompleteDetails != nil {
+			reason = resp.IncompleteDetails.Reason
+		}
+		return content.String(), functioncalls, fmt.Errorf("%w: %s", ErrResponseIncomplete, reason)
+	}
+	return content.String(), functioncalls, nil
+}
+
+func (c *ResponsesAdaptor) SendRequest(message string, opts ...RequestOption) (string, error) {
+	content, _, err := c.SendRequestWithHistory(message, []Message{}, nil, opts...)
+	return content, err
+}
+
+// Send the history followed by message as a user message. An empty message is left out, e.g. to
+// continue once the results of the model's function calls are in the history. Of the per request
+// options, the context, API key, request and idempotency ids, system prompt (sent as the
+// instructions), tools, user, parallel tool calls, max tokens, temperature and top p are used. The
+// rest are ignored.
+func (c *ResponsesAdaptor) SendRequestWithHistory(message string, history []Message, tools []Tool,
+	opts ...RequestOption) (string, []FunctionCall, error) {
+
+	rc := c.newRequestConfig(opts)
+	messages := history
+	if message != "" {
+		messages = append(messages[:len(messages):len(messages)], Message{
+			Role: string(ROLE_USER), Content: html.UnescapeString(message),
+		})
+	}
+	if rc.tools != nil {
+		tools = rc.tools
+	}
+	req := ResponsesRequest{
+		Model:             c.Model(),
+		Instructions:      c.instructions,
+		Input:             newResponsesInput(messages),
+		Tools:             newResponsesTools(tools),
+		ParallelToolCalls: rc.paralleltoolcalls,
+		User:              rc.user,
+	}
+	if rc.systemprompt != nil {
+		req.Instructions = *rc.systemprompt
+	}
+	if rc.generation != nil {
+		req.MaxOutputTokens = rc.generation.MaxTokens
+		req.Temperature = rc.generation.Temperature
+		req.TopP = rc.generation.TopP
+	}
+	resp, err := c.sendWithRetry(rc.ctx, req, rc)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	return ResponsesJsonExtractor(resp.Body)
+}
@@ -0,0 +1,156 @@
+package hf
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Captured from the Responses API, a function call after a reasoning item
+const testResponsesFunctionCall = `{
+  "id": "resp_67ccd2bed1ec8190b14f964abc0542670bb6a6b452d3795b",
+  "object": "response",
+  "created_at": 1741476542,
+  "status": "completed",
+  "error": null,
+  "incomplete_details": null,
+  "instructions": "You are an assistant.",
+  "model": "gpt-4.1-2025-04-14",
+  "output": [
+    {"type": "reasoning", "id": "rs_67ccd2bf17f0819081ff3bb2cf6508e6", "summary": []},
+    {
+      "type": "function_call",
+      "id": "fc_67ccd2bf17f0819081ff3bb2cf6508e60bb6a6b452d3795b",
+      "call_id": "call_unLAR8MvFNptuiZK6K6HCy5k",
+      "name": "get_weather",
+      "arguments": "{\"location\":\"Paris, France\"}",
+      "status": "completed"
+    }
+  ],
+  "parallel_tool_calls": true,
+  "usage": {"input_tokens": 291, "output_tokens": 23, "total_tokens": 314}
+}`
+
+const testResponsesMessage = `{
+  "id": "resp_67ccd3a9da748190baa7f1570fe91ac604becb25c45c1d41",
+  "object": "response",
+  "status": "completed",
+  "error": null,
+  "output": [
+    {
+      "type": "message",
+      "id": "msg_67ccd3acc8d48190a77525dc6de64b4104becb25c45c1d41",
+      "status": "completed",
+      "role": "assistant",
+      "content": [{"type": "output_text", "text": "It's sunny in Paris.", "annotations": []}]
+    }
+  ],
+  "usage": {"input_tokens": 336, "output_tokens": 9, "total_tokens": 345}
+}`
+
+func TestResponsesAdaptor(t *testing.T) {
+	requests := make([]map[string]any, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := make(map[string]any)
+		json.NewDecoder(r.Body).Decode(&req)
+		requests = append(requests, req)
+		w.Header().Set("Content-Type", "application/json")
+		if len(requests) == 1 {
+			w.Write([]byte(testResponsesFunctionCall))
+			return
+		}
+		w.Write([]byte(testResponsesMessage))
+	}))
+	defer server.Close()
+
+	adaptor := NewResponsesAdaptor(server.URL, "test-key", "gpt-4.1", "You are an assistant.", 1)
+	tools := []Tool{NewTool("get_weather", "Get the weather", []ToolParameter{
+		{Name: "location", Type: "string", Required: true},
+	})}
+	content, calls, err := adaptor.SendRequestWithHistory("What's the weather in Paris?", nil, tools)
+	if err != nil {
+		t.Fatalf("SendRequestWithHistory returned error: %v", err)
+	}
+	if content != "" || len(calls) != 1 || calls[0].Id != "call_unLAR8MvFNptuiZK6K6HCy5k" ||
+		calls[0].Function.Name != "get_weather" || calls[0].Function.Arguments != `{"location":"Paris, France"}` {
+		t.Fatalf("Expected the function call, got '%s', %+v", content, calls)
+	}
+	expected := map[string]any{
+		"model":        "gpt-4.1",
+		"instructions": "You are an assistant.",
+		"input":        []any{map[string]any{"role": "user", "content": "What's the weather in Paris?"}},
+		"tools": []any{map[string]any{
+			"type": "function", "name": "get_weather", "description": "Get the weather",
+			"parameters": map[string]any{
+				"type": "object", "properties": map[string]any{"location": map[string]any{"type": "string"}},
+				"required": []any{"location"}, "additionalProperties": false,
+			},
+		}},
+	}
+	if !reflect.DeepEqual(requests[0], expected) {
+		t.Errorf("Expected the request %+v, got %+v", expected, requests[0])
+	}
+
+	//// Send the result back, without a new message
+	history := []Message{{Role: string(ROLE_USER), Content: "What's the weather in Paris?"}}
+	history = InjectToolResults(history, NewAssistantToolCallMessage(calls), calls, []string{`{"weather": "sunny"}`})
+	content, calls, err = adaptor.SendRequestWithHistory("", history, tools, WithSystemPrompt("Be brief."))
+	if err != nil {
+		t.Fatalf("SendRequestWithHistory returned error: %v", err)
+	}
+	if content != "It's sunny in Paris." || len(calls) != 0 {
+		t.Errorf("Expected the answer, got '%s', %+v", content, calls)
+	}
+	expectedinput := []any{
+		map[string]any{"role": "user", "content": "What's the weather in Paris?"},
+		map[string]any{"type": "function_call", "call_id": "call_unLAR8MvFNptuiZK6K6HCy5k", "name": "get_weather",
+			"arguments": `{"location":"Paris, France"}`},
+		map[string]any{"type": "function_call_output", "call_id": "call_unLAR8MvFNptuiZK6K6HCy5k",
+			"output": `{"weather": "sunny"}`},
+	}
+	if !reflect.DeepEqual(requests[1]["input"], expectedinput) || requests[1]["instructions"] != "Be brief." {
+		t.Errorf("Expected the call and its output, with the system prompt as instructions, got %+v", requests[1])
+	}
+}
+
+func TestResponsesJsonExtractor(t *testing.T) {
+	content, calls, err := ResponsesJsonExtractor(io.NopCloser(strings.NewReader(
+		`{"id": "resp_1", "status": "failed", "output": [], "error": {"code": "server_error", "message": "Try again"}}`)))
+	if err == nil || !strings.Contains(err.Error(), "Try again") {
+		t.Errorf("Expected the response's error, got '%s', %+v, %v", content, calls, err)
+	}
+
+	//// Cut short at max_output_tokens, the text so far is still returned
+	content, _, err = ResponsesJsonExtractor(io.NopCloser(strings.NewReader(`{"id": "resp_2", "status": "incomplete",
+		"incomplete_details": {"reason": "max_output_tokens"},
+		"output": [{"type": "message", "role": "assistant", "content": [{"type": "output_text", "text": "It's sun"}]}]}`)))
+	if !errors.Is(err, ErrResponseIncomplete) || !strings.Contains(err.Error(), "max_output_tokens") || content != "It's sun" {
+		t.Errorf("Expected the truncated text with ErrResponseIncomplete, got '%s', %v", content, err)
+	}
+
+	content, _, err = ResponsesJsonExtractor(io.NopCloser(strings.NewReader(`{"id": "resp_3", "status": "completed",
+		"output": [{"type": "message", "role": "assistant", "content": [{"type": "refusal", "refusal": "I can't help with that."}]}]}`)))
+	if !errors.Is(err, ErrRefusal) || !strings.Contains(err.Error(), "I can't help with that.") {
+		t.Errorf("Expected ErrRefusal with the explanation, got '%s', %v", content, err)
+	}
+
+	if _, _, err = ResponsesJsonExtractor(io.NopCloser(strings.NewReader(`{"id": "resp_4", "status": "failed", "output": []}`))); err == nil {
+		t.Error("Expected an error for a failed response without error details")
+	}
+
+	body := &closeRecorder{Reader: strings.NewReader(testResponsesMessage)}
+	if _, _, err = ResponsesJsonExtractor(body); err != nil || !body.closed {
+		t.Errorf("Expected the reader to be closed, got %v", err)
+	}
+
+	_, _, err = ResponsesJsonExtractor(io.NopCloser(strings.NewReader(`{"output": [`)))
+	var decodeerr *DecodeError
+	if !errors.As(err, &decodeerr) || decodeerr.Extractor != "ResponsesJsonExtractor" {
+		t.Errorf("Expected a DecodeError, got %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package hf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Build the parameters for a tool from the fields of the struct T, so the arguments the model
+// returns can be unmarshalled straight into a T (see FunctionCall.UnmarshalArguments).
+//
+// Field names come from the json tag. A field is required unless its json tag has omitempty,
+// and fields tagged json:"-" or unexported are skipped. The hf tag adds to the schema, with
+// directives separated by ";":
+//
+//	Unit string `json:"unit" hf:"description,The temperature unit;enum,celsius,fahrenheit"`
+//
+// Go types map to "string", "number" (all ints and floats), "boolean", "array" (slices and
+// arrays) and "object" (structs). Other types, such as maps and interfaces, return an error.
+func SchemaFromStruct[T any]() (*ToolFunctionParameters, error) {
+	typ := reflect.TypeFor[T]()
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("schema must be built from a struct, got %s", typ)
+	}
+	object, err := newStructSchema(typ, map[reflect.Type]bool{})
+	if err != nil {
+		return nil, err
+	}
+	params := &ToolFunctionParameters{
+		Type:       "object",
+		Properties: make(map[string]ToolFunctionParameterProperties),
+		Required:   object.Required,
+	}
+	for name, properties := range object.Properties {
+		params.Properties[name] = *properties
+	}
+	return params, nil
+}
+
+var timeType = reflect.TypeFor[time.Time]()
+
+func newTypeSchema(typ reflect.Type, visiting map[reflect.Type]bool) (*ToolFunctionParameterProperties, error) {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	if typ == timeType {
+		//// Marshals to an RFC 3339 string
+		return &ToolFunctionParameterProperties{Type: "string"}, nil
+	}
+	switch typ.Kind() {
+	case reflect.String:
+		return &ToolFunctionParameterProperties{Type: "string"}, nil
+	case reflect.Bool:
+		return &ToolFunctionParameterProperties{Type: "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return &ToolFunctionParameterProperties{Type: "number"}, nil
+	case reflect.Slice, reflect.Array:
+		if typ.Elem().Kind() == reflect.Uint8 {
+			//// []byte marshals to a base64 string
+			return &ToolFunctionParameterProperties{Type: "string"}, nil
+		}
+		items, err := newTypeSchema(typ.Elem(), visiting)
+		if err != nil {
+			return nil, err
+		}
+		return &ToolFunctionParameterProperties{Type: "array", Items: items}, nil
+	case reflect.Struct:
+		return newStructSchema(typ, visiting)
+	}
+	return nil, fmt.Errorf("unsupported type %s", typ)
+}
+
+func newStructSchema(typ reflect.Type, visiting map[reflect.Type]bool) (*ToolFunctionParameterProperties, error) {
+	if visiting[typ] {
+		return nil, fmt.Errorf("recursive type %s", typ)
+	}
+	visiting[typ] = true
+	defer delete(visiting, typ)
+
+	object := &ToolFunctionParameterProperties{
+		Type:       "object",
+		Properties: make(map[string]*ToolFunctionParameterProperties),
+	}
+	for _, field := range reflect.VisibleFields(typ) {
+		if len(field.Index) > 1 {
+			//// Promoted fields are added with their embedded struct below
+			continue
+		}
+		if !field.IsExported() && !field.Anonymous {
+			continue
+		}
+		jsontag := field.Tag.Get("json")
+		if jsontag == "-" {
+			continue
+		}
+		name, jsonopts, _ := strings.Cut(jsontag, ",")
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			for embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				//// Embedded structs are flattened, as encoding/json does
+				inner, err := newStructSchema(embedded, visiting)
+				if err != nil {
+					return nil, err
+				}
+				for childname, properties := range inner.Properties {
+					object.Properties[childname] = properties
+				}
+				object.Required = append(object.Required, inner.Required...)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		properties, err := newTypeSchema(field.Type, visiting)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		if err := applySchemaTag(properties, field.Tag.Get("hf")); err != nil {
+			return nil, fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		object.Properties[name] = properties
+		if !strings.Contains(","+jsonopts+",", ",omitempty,") {
+			object.Required = append(object.Required, name)
+		}
+	}
+	return object, nil
+}
+
+func applySchemaTag(properties *ToolFunctionParameterProperties, tag string) error {
+	if tag == "" {
+		return nil
+	}
+	for _, directive := range strings.Split(tag, ";") {
+		key, value, _ := strings.Cut(directive, ",")
+		switch key {
+		case "description":
+			properties.Description = value
+		case "enum":
+			if properties.Type != "string" {
+				return fmt.Errorf("enum is only supported on strings, not %s", properties.Type)
+			}
+			properties.Enum = strings.Split(value, ",")
+		default:
+			return fmt.Errorf("unknown hf tag directive '%s'", key)
+		}
+	}
+	return nil
+}
+
+var (
+	contextType = reflect.TypeFor[context.Context]()
+	errorType   = reflect.TypeFor[error]()
+)
+
+// Build a tool from a function, along with a dispatcher that calls the function with the arguments
+// from a FunctionCall (see FunctionCall.ArgumentsMap). fn must return (string, error) and may take
+// a context.Context as its first parameter. The dispatcher has no context of its own, so fn is
+// called with context.Background().
+//
+// Go can't tell us the names of the parameters, so paramnames gives one name per parameter
+// (not counting the context). The parameter types map to the schema as in SchemaFromStruct,
+// and pointer parameters are optional - they're nil when the argument is missing.
+func ToolFromFunc(name, description string, paramnames []string, fn interface{}) (Tool, func(map[string]any) (string, error), error) {
+	fnvalue := reflect.ValueOf(fn)
+	if fnvalue.Kind() != reflect.Func || fnvalue.IsNil() {
+		return Tool{}, nil, fmt.Errorf("tool %s must be built from a function, got %T", name, fn)
+	}
+	fntype := fnvalue.Type()
+	if fntype.IsVariadic() {
+		return Tool{}, nil, fmt.Errorf("tool %s: variadic functions are not supported", name)
+	}
+	if fntype.NumOut() != 2 || fntype.Out(0).Kind() != reflect.String || fntype.Out(1) != errorType {
+		return Tool{}, nil, fmt.Errorf("tool %s: function must return (string, error), got %s", name, fntype)
+	}
+	first := 0
+	if fntype.NumIn() > 0 && fntype.In(0) == contextType {
+		first = 1
+	}
+	if fntype.NumIn()-first != len(paramnames) {
+		return Tool{}, nil, fmt.Errorf("tool %s: function takes %d parameters, got %d names",
+			name, fntype.NumIn()-first, len(paramnames))
+	}
+
+	params := make([]ToolParameter, 0, len(paramnames))
+	schemas := make(map[string]ToolFunctionParameterProperties)
+	for i, paramname := range paramnames {
+		if _, ok := schemas[paramname]; ok || paramname == "" {
+			return Tool{}, nil, fmt.Errorf("tool %s: parameter name '%s' is empty or repeated", name, paramname)
+		}
+		paramtype := fntype.In(first + i)
+		properties, err := newTypeSchema(paramtype, map[reflect.Type]bool{})
+		if err != nil {
+			return Tool{}, nil, fmt.Errorf("tool %s: parameter %s: %w", name, paramname, err)
+		}
+		schemas[paramname] = *properties
+		params = append(params, ToolParameter{
+			Name:     paramname,
+			Required: paramtype.Kind() != reflect.Pointer,
+		})
+	}
+
+	tool := NewTool(name, description, params)
+	if tool.Function.Parameters != nil {
+		//// NewTool only knows flat types, so swap in the full schemas
+		tool.Function.Parameters.Properties = schemas
+	}
+
+	dispatch := func(args map[string]any) (string, error) {
+		in := make([]reflect.Value, 0, fntype.NumIn())
+		if first == 1 {
+			in = append(in, reflect.ValueOf(context.Background()))
+		}
+		for i, paramname := range paramnames {
+			paramtype := fntype.In(first + i)
+			value := reflect.New(paramtype)
+			arg, ok := args[paramname]
+			if !ok && paramtype.Kind() != reflect.Pointer {
+				return "", fmt.Errorf("tool %s: missing required argument %s", name, paramname)
+			}
+			if ok {
+				//// Round trip through JSON, so the argument gets the same conversion as UnmarshalArguments
+				data, err := json.Marshal(arg)
+				if err != nil {
+					return "", fmt.Errorf("tool %s: argument %s: %w", name, paramname, err)
+				}
+				if err := json.Unmarshal(data, value.Interface()); err != nil {
+					return "", fmt.Errorf("tool %s: argument %s: %w", name, paramname, err)
+				}
+			}
+			in = append(in, value.Elem())
+		}
+		out := fnvalue.Call(in)
+		err, _ := out[1].Interface().(error)
+		return out[0].String(), err
+	}
+	return tool, dispatch, nil
+}
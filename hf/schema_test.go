@@ -0,0 +1,219 @@
+package hf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testLocation struct {
+	City    string `json:"city" hf:"description,The city name"`
+	Country string `json:"country,omitempty"`
+}
+
+type testWeatherArgs struct {
+	Location testLocation `json:"location"`
+	Unit     string       `json:"unit" hf:"description,The temperature unit;enum,celsius,fahrenheit"`
+	Days     int          `json:"days,omitempty"`
+	Hourly   bool         `json:"hourly"`
+	Tags     []string     `json:"tags,omitempty"`
+	Since    *time.Time   `json:"since,omitempty"`
+	Ignored  string       `json:"-"`
+	internal string
+}
+
+func TestSchemaFromStruct(t *testing.T) {
+	params, err := SchemaFromStruct[testWeatherArgs]()
+	if err != nil {
+		t.Fatalf("SchemaFromStruct returned error: %v", err)
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		t.Fatalf("Failed to marshal schema: %v", err)
+	}
+	expected := `{
+		"type": "object",
+		"properties": {
+			"location": {
+				"type": "object",
+				"properties": {
+					"city": {"type": "string", "description": "The city name"},
+					"country": {"type": "string"}
+				},
+				"required": ["city"]
+			},
+			"unit": {"type": "string", "description": "The temperature unit", "enum": ["celsius", "fahrenheit"]},
+			"days": {"type": "number"},
+			"hourly": {"type": "boolean"},
+			"tags": {"type": "array", "items": {"type": "string"}},
+			"since": {"type": "string"}
+		},
+		"required": ["location", "unit", "hourly"],
+		"additionalProperties": false
+	}`
+	if equal, err := compareJsonStrings(string(data), expected); err != nil || !equal {
+		t.Errorf("Unexpected schema:\n%s", data)
+	}
+
+	//// The generated schema validates arguments for the struct
+	tool := Tool{Type: "function", Function: Function{Name: "get_weather", Parameters: params}}
+	call := newTestFunctionCall("get_weather", `{"location":{"city":"Paris"},"unit":"kelvin","hourly":true}`)
+	if err := call.ValidateAgainst(tool); err == nil || !strings.Contains(err.Error(), "unit") {
+		t.Errorf("Expected an enum violation for unit, got %v", err)
+	}
+}
+
+type testEmbedded struct {
+	Id string `json:"id"`
+}
+
+type testWithEmbedded struct {
+	testEmbedded
+	Name string `json:"name"`
+}
+
+func TestSchemaFromStructEmbedded(t *testing.T) {
+	params, err := SchemaFromStruct[*testWithEmbedded]()
+	if err != nil {
+		t.Fatalf("SchemaFromStruct returned error: %v", err)
+	}
+	if _, ok := params.Properties["id"]; !ok {
+		t.Errorf("Expected the embedded field to be flattened, got %v", params.Properties)
+	}
+	if len(params.Required) != 2 {
+		t.Errorf("Expected 2 required fields, got %v", params.Required)
+	}
+}
+
+type testRecursive struct {
+	Children []testRecursive `json:"children"`
+}
+
+func TestSchemaFromStructErrors(t *testing.T) {
+	if _, err := SchemaFromStruct[string](); err == nil {
+		t.Error("Expected an error for a non struct type")
+	}
+	if _, err := SchemaFromStruct[struct {
+		Lookup map[string]string `json:"lookup"`
+	}](); err == nil || !strings.Contains(err.Error(), "Lookup") {
+		t.Errorf("Expected an error naming the map field, got %v", err)
+	}
+	if _, err := SchemaFromStruct[struct {
+		Count int `json:"count" hf:"enum,1,2"`
+	}](); err == nil {
+		t.Error("Expected an error for an enum on a number")
+	}
+	if _, err := SchemaFromStruct[struct {
+		Name string `json:"name" hf:"title,Name"`
+	}](); err == nil {
+		t.Error("Expected an error for an unknown hf tag directive")
+	}
+	if _, err := SchemaFromStruct[testRecursive](); err == nil {
+		t.Error("Expected an error for a recursive type")
+	}
+}
+
+func TestToolFromFunc(t *testing.T) {
+	var gotctx context.Context
+	weather := func(ctx context.Context, location testLocation, days int, unit *string) (string, error) {
+		gotctx = ctx
+		u := "celsius"
+		if unit != nil {
+			u = *unit
+		}
+		return fmt.Sprintf("%s %d %s", location.City, days, u), nil
+	}
+	tool, dispatch, err := ToolFromFunc("get_weather", "Get the weather forecast", []string{"location", "days", "unit"}, weather)
+	if err != nil {
+		t.Fatalf("ToolFromFunc returned error: %v", err)
+	}
+	data, err := json.Marshal(tool)
+	if err != nil {
+		t.Fatalf("Failed to marshal tool: %v", err)
+	}
+	expected := `{
+		"type": "function",
+		"function": {
+			"name": "get_weather",
+			"description": "Get the weather forecast",
+			"parameters": {
+				"type": "object",
+				"properties": {
+					"location": {
+						"type": "object",
+						"properties": {
+							"city": {"type": "string", "description": "The city name"},
+							"country": {"type": "string"}
+						},
+						"required": ["city"]
+					},
+					"days": {"type": "number"},
+					"unit": {"type": "string"}
+				},
+				"required": ["location", "days"],
+				"additionalProperties": false
+			}
+		}
+	}`
+	if equal, err := compareJsonStrings(string(data), expected); err != nil || !equal {
+		t.Errorf("Unexpected tool:\n%s", data)
+	}
+
+	call := newTestFunctionCall("get_weather", `{"location":{"city":"Paris"},"days":3}`)
+	args, err := call.ArgumentsMap()
+	if err != nil {
+		t.Fatalf("ArgumentsMap returned error: %v", err)
+	}
+	result, err := dispatch(args)
+	if err != nil {
+		t.Fatalf("dispatch returned error: %v", err)
+	}
+	if result != "Paris 3 celsius" {
+		t.Errorf("Unexpected result '%s'", result)
+	}
+	if gotctx == nil {
+		t.Error("Expected the function to get a context")
+	}
+
+	if _, err := dispatch(map[string]any{"location": map[string]any{"city": "Paris"}}); err == nil || !strings.Contains(err.Error(), "days") {
+		t.Errorf("Expected an error for the missing days argument, got %v", err)
+	}
+	if _, err := dispatch(map[string]any{"location": "Paris", "days": 3}); err == nil {
+		t.Error("Expected an error for a location of the wrong type")
+	}
+}
+
+func TestToolFromFuncError(t *testing.T) {
+	failure := errors.New("service unavailable")
+	_, dispatch, err := ToolFromFunc("lookup", "Look something up", []string{"query"}, func(query string) (string, error) {
+		return "", failure
+	})
+	if err != nil {
+		t.Fatalf("ToolFromFunc returned error: %v", err)
+	}
+	if _, err := dispatch(map[string]any{"query": "x"}); !errors.Is(err, failure) {
+		t.Errorf("Expected the function's error, got %v", err)
+	}
+
+	invalid := map[string]struct {
+		names []string
+		fn    interface{}
+	}{
+		"not a function": {nil, "lookup"},
+		"nil function":   {nil, (func() (string, error))(nil)},
+		"wrong returns":  {[]string{"query"}, func(query string) string { return "" }},
+		"too few names":  {nil, func(query string) (string, error) { return "", nil }},
+		"repeated name":  {[]string{"a", "a"}, func(a, b string) (string, error) { return "", nil }},
+		"unsupported":    {[]string{"lookup"}, func(lookup map[string]string) (string, error) { return "", nil }},
+		"variadic":       {[]string{"queries"}, func(queries ...string) (string, error) { return "", nil }},
+	}
+	for name, test := range invalid {
+		if _, _, err := ToolFromFunc("lookup", "", test.names, test.fn); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
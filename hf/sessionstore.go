@@ -0,0 +1,149 @@
+package hf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Returned by SessionStore.Load for a session that hasn't been saved, or has been deleted
+var ErrSessionNotFound = errors.New("session not found")
+
+// Keeps conversation histories by session ID, e.g. to continue a conversation after a restart
+type SessionStore interface {
+	Save(id string, history []Message) error
+	Load(id string) ([]Message, error)
+	Delete(id string) error
+}
+
+// A SessionStore for a single process, e.g. for tests. The histories are copied in and out, calls
+// and all, so changing a saved or loaded history doesn't change the stored one.
+type InMemorySessionStore struct {
+	lock     sync.Mutex
+	sessions map[string][]Message
+}
+
+func NewInMemorySessionStore() *InMemorySessionStore {
+	return &InMemorySessionStore{
+		sessions: make(map[string][]Message),
+	}
+}
+
+func (s *InMemorySessionStore) Save(id string, history []Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions[id] = cloneHistory(history)
+	return nil
+}
+
+func (s *InMemorySessionStore) Load(id string) ([]Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	history, found := s.sessions[id]
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	return cloneHistory(history), nil
+}
+
+func (s *InMemorySessionStore) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+// A copy of history that shares nothing with it but the calls' descriptions
+func cloneHistory(history []Message) []Message {
+	cloned := slices.Clone(history)
+	for i := range cloned {
+		cloned[i].ToolCalls = slices.Clone(cloned[i].ToolCalls)
+		if cloned[i].FunctionCall != nil {
+			call := *cloned[i].FunctionCall
+			cloned[i].FunctionCall = &call
+		}
+	}
+	return cloned
+}
+
+// A SessionStore that keeps each session in a JSON file of its own in dir, which is created on
+// the first save. Session IDs are escaped for the file names, so any ID is safe to use.
+type JSONFileSessionStore struct {
+	dir string
+}
+
+func NewJSONFileSessionStore(dir string) *JSONFileSessionStore {
+	return &JSONFileSessionStore{dir: dir}
+}
+
+func (s *JSONFileSessionStore) path(id string) (string, error) {
+	if id == "" {
+		return "", errors.New("empty session id")
+	}
+	return filepath.Join(s.dir, url.PathEscape(id)+".json"), nil
+}
+
+// Write the history to a temporary file and rename it over the session's file, so a failed save
+// leaves the last one intact
+func (s *JSONFileSessionStore) Save(id string, history []Message) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(history)
+	if err != nil {
+		return fmt.Errorf("error encoding session %s: %w", id, err)
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".session-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *JSONFileSessionStore) Load(id string) ([]Message, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	history := make([]Message, 0)
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, fmt.Errorf("error decoding session %s: %w", id, err)
+	}
+	return history, nil
+}
+
+func (s *JSONFileSessionStore) Delete(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
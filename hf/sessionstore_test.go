@@ -0,0 +1,87 @@
+package hf
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testSessionHistory() []Message {
+	call := newTestFunctionCall("get_user_weather", `{"location":"London"}`)
+	return []Message{
+		{Role: string(ROLE_SYSTEM), Content: "You are an assistant."},
+		{Role: string(ROLE_USER), Content: "What's the weather in London?"},
+		NewAssistantToolCallMessage([]FunctionCall{call}),
+		{Role: string(ROLE_TOOL), Content: `{"weather": "sunny"}`, ToolCallId: call.Id},
+		{Role: string(ROLE_AGENT), Content: "It's sunny."},
+	}
+}
+
+func testSessionStore(t *testing.T, store SessionStore) {
+	history := testSessionHistory()
+	if _, err := store.Load("user/1"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Expected ErrSessionNotFound before saving, got %v", err)
+	}
+	if err := store.Save("user/1", history); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if err := store.Save("user/2", history[:2]); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	loaded, err := store.Load("user/1")
+	if err != nil || !reflect.DeepEqual(loaded, history) {
+		t.Fatalf("Expected the saved history %+v, got %+v, %v", history, loaded, err)
+	}
+
+	//// Saving again replaces the history
+	history = append(history, Message{Role: string(ROLE_USER), Content: "And tomorrow?"})
+	if err := store.Save("user/1", history); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	loaded, err = store.Load("user/1")
+	if err != nil || len(loaded) != 6 {
+		t.Errorf("Expected the replaced history, got %+v, %v", loaded, err)
+	}
+	loaded[0].Content = "changed"
+	loaded[2].ToolCalls[0].Function.Arguments = "changed"
+	history[2].ToolCalls[0].Id = "changed"
+	reloaded, _ := store.Load("user/1")
+	if reloaded[0].Content != "You are an assistant." || reloaded[2].ToolCalls[0].Function.Arguments == "changed" ||
+		reloaded[2].ToolCalls[0].Id == "changed" {
+		t.Errorf("Expected changing a saved or loaded history not to change the stored one, got %+v", reloaded)
+	}
+
+	if err := store.Delete("user/1"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	if _, err := store.Load("user/1"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Expected ErrSessionNotFound after deleting, got %v", err)
+	}
+	if err := store.Delete("user/1"); err != nil {
+		t.Errorf("Expected deleting a missing session to succeed, got %v", err)
+	}
+	if loaded, err := store.Load("user/2"); err != nil || len(loaded) != 2 {
+		t.Errorf("Expected the other session to be kept, got %+v, %v", loaded, err)
+	}
+}
+
+func TestInMemorySessionStore(t *testing.T) {
+	testSessionStore(t, NewInMemorySessionStore())
+}
+
+func TestJSONFileSessionStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sessions")
+	store := NewJSONFileSessionStore(dir)
+	testSessionStore(t, store)
+
+	//// The ID is escaped, so it can't reach outside the directory
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 || entries[0].Name() != "user%2F2.json" {
+		t.Errorf("Expected one file for the remaining session, got %v, %v", entries, err)
+	}
+	if err := store.Save("", nil); err == nil {
+		t.Error("Expected an error for an empty session id")
+	}
+}
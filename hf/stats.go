@@ -0,0 +1,147 @@
+package hf
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counts and latencies of the requests sent by an adaptor, see Adaptor.Stats. Latency is measured
+// from sending the request, including any retries, to extracting the response.
+type AdaptorStats struct {
+	RequestCount    int64
+	ErrorCount      int64
+	TotalLatency    time.Duration
+	MinLatency      time.Duration /// 0 until a request has completed
+	MaxLatency      time.Duration
+	LastError       error /// nil if no request has failed
+	LastRequestTime time.Time
+}
+
+// The average latency, or 0 if no request has completed
+func (s AdaptorStats) MeanLatency() time.Duration {
+	if s.RequestCount == 0 {
+		return 0
+	}
+	return s.TotalLatency / time.Duration(s.RequestCount)
+}
+
+// Updated after each request. The counters are atomic so recording a request only takes the lock
+// for the last error and time.
+type adaptorStats struct {
+	requests     atomic.Int64
+	errors       atomic.Int64
+	totallatency atomic.Int64
+	minlatency   atomic.Int64 /// 0 until a request has completed
+	maxlatency   atomic.Int64
+
+	lock        sync.Mutex
+	lasterror   error
+	lastrequest time.Time
+}
+
+func (s *adaptorStats) record(start time.Time, err error) {
+	latency := int64(time.Since(start))
+	s.requests.Add(1)
+	s.totallatency.Add(latency)
+	for {
+		min := s.minlatency.Load()
+		if (min != 0 && min <= latency) || s.minlatency.CompareAndSwap(min, latency) {
+			break
+		}
+	}
+	for {
+		max := s.maxlatency.Load()
+		if max >= latency || s.maxlatency.CompareAndSwap(max, latency) {
+			break
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err != nil {
+		s.errors.Add(1)
+		s.lasterror = err
+	}
+	s.lastrequest = start
+}
+
+func (s *adaptorStats) snapshot() AdaptorStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return AdaptorStats{
+		RequestCount:    s.requests.Load(),
+		ErrorCount:      s.errors.Load(),
+		TotalLatency:    time.Duration(s.totallatency.Load()),
+		MinLatency:      time.Duration(s.minlatency.Load()),
+		MaxLatency:      time.Duration(s.maxlatency.Load()),
+		LastError:       s.lasterror,
+		LastRequestTime: s.lastrequest,
+	}
+}
+
+func (s *adaptorStats) reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests.Store(0)
+	s.errors.Store(0)
+	s.totallatency.Store(0)
+	s.minlatency.Store(0)
+	s.maxlatency.Store(0)
+	s.lasterror = nil
+	s.lastrequest = time.Time{}
+}
+
+// The counts and latencies of the requests sent since the adaptor was created or ResetStats was
+// called. A lightweight alternative to exporting metrics. Clones keep their own stats.
+func (c *Adaptor) Stats() AdaptorStats {
+	return c.stats.snapshot()
+}
+
+func (c *Adaptor) ResetStats() {
+	c.stats.reset()
+}
+
+// Tokens used by the requests sent by an adaptor, see Adaptor.TotalTokensUsed
+type TokenUsage struct {
+	PromptTokens     int64
+	CompletionTokens int64
+}
+
+func (u TokenUsage) Total() int64 {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+type tokenUsage struct {
+	prompttokens     atomic.Int64
+	completiontokens atomic.Int64
+}
+
+// Add the usage from an OpenAI style response body. Best effort - bodies without usage add nothing.
+func (u *tokenUsage) add(data []byte) {
+	resp := struct {
+		Usage Usage `json:"usage"`
+	}{}
+	_ = json.Unmarshal(data, &resp)
+	u.addUsage(resp.Usage)
+}
+
+func (u *tokenUsage) addUsage(usage Usage) {
+	u.prompttokens.Add(int64(usage.PromptTokens))
+	u.completiontokens.Add(int64(usage.CompletionTokens))
+}
+
+// The prompt and completion tokens used by the requests sent since the adaptor was created or
+// ResetTokenUsage was called, as reported in the responses' usage. Clones keep their own count.
+func (c *Adaptor) TotalTokensUsed() TokenUsage {
+	return TokenUsage{
+		PromptTokens:     c.usage.prompttokens.Load(),
+		CompletionTokens: c.usage.completiontokens.Load(),
+	}
+}
+
+func (c *Adaptor) ResetTokenUsage() {
+	c.usage.prompttokens.Store(0)
+	c.usage.completiontokens.Store(0)
+}
@@ -0,0 +1,115 @@
+package hf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAdaptorStats(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 3 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	if stats := adaptor.Stats(); stats.RequestCount != 0 || !stats.LastRequestTime.IsZero() {
+		t.Fatalf("Expected empty stats, got %+v", stats)
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		adaptor.SendRequest("Hello")
+	}
+	stats := adaptor.Stats()
+	if stats.RequestCount != 3 || stats.ErrorCount != 1 {
+		t.Errorf("Expected 3 requests and 1 error, got %+v", stats)
+	}
+	if stats.LastError == nil {
+		t.Errorf("Expected the last error to be set")
+	}
+	if stats.MinLatency <= 0 || stats.MinLatency > stats.MaxLatency || stats.TotalLatency < stats.MaxLatency {
+		t.Errorf("Expected consistent latencies, got %+v", stats)
+	}
+	if stats.MeanLatency() != stats.TotalLatency/3 {
+		t.Errorf("Expected mean latency %v, got %v", stats.TotalLatency/3, stats.MeanLatency())
+	}
+	if stats.LastRequestTime.Before(start) {
+		t.Errorf("Expected the last request time after %v, got %v", start, stats.LastRequestTime)
+	}
+
+	if clone := adaptor.Clone(); clone.Stats().RequestCount != 0 {
+		t.Errorf("Expected the clone to have its own stats, got %+v", clone.Stats())
+	}
+
+	adaptor.ResetStats()
+	if stats := adaptor.Stats(); stats != (AdaptorStats{}) {
+		t.Errorf("Expected reset stats, got %+v", stats)
+	}
+}
+
+func TestAdaptorStatsConcurrent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			adaptor.SendRequest("Hello")
+			adaptor.Stats()
+		}()
+	}
+	wg.Wait()
+	if stats := adaptor.Stats(); stats.RequestCount != 20 || stats.ErrorCount != 0 {
+		t.Errorf("Expected 20 requests without errors, got %+v", stats)
+	}
+}
+
+func TestTotalTokensUsed(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if requests.Add(1) == 3 {
+			//// No usage reported
+			w.Write([]byte(testChatResponse))
+			return
+		}
+		w.Write([]byte(`{"id":"chatcmpl-1","choices":[{"index":0,"message":{"role":"assistant","content":"Hello"},` +
+			`"finish_reason":"stop"}],"usage":{"prompt_tokens":12,"completion_tokens":5,"total_tokens":17}}`))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+	for i := 0; i < 3; i++ {
+		if _, err := adaptor.SendRequest("Hello"); err != nil {
+			t.Fatalf("SendRequest returned error: %v", err)
+		}
+	}
+	usage := adaptor.TotalTokensUsed()
+	if usage != (TokenUsage{PromptTokens: 24, CompletionTokens: 10}) {
+		t.Errorf("Expected 24 prompt and 10 completion tokens, got %+v", usage)
+	}
+	if usage.Total() != 34 {
+		t.Errorf("Expected 34 tokens in total, got %d", usage.Total())
+	}
+
+	adaptor.ResetTokenUsage()
+	if usage := adaptor.TotalTokensUsed(); usage.Total() != 0 {
+		t.Errorf("Expected no tokens after a reset, got %+v", usage)
+	}
+}
@@ -0,0 +1,445 @@
+package hf
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ////////////////////////////////////////////////////////////////
+//
+//	OpenAI style streamed (SSE) chat completions
+//
+// ////////////////////////////////////////////////////////////////
+
+const streamDone = "[DONE]"
+
+// Reads the data of each event from a server sent events stream. Lines are buffered, so a line
+// split across reads (or network packets) is reassembled before it is parsed.
+type sseScanner struct {
+	reader *bufio.Reader
+	done   bool
+}
+
+func newSSEScanner(r io.Reader) *sseScanner {
+	return &sseScanner{
+		reader: bufio.NewReader(r),
+	}
+}
+
+// The data of the next event, with multiple data lines joined by "\n". Returns io.EOF after the
+// [DONE] event, or at the end of the stream. The [DONE] event ends the stream as soon as its
+// line is read, with or without a trailing newline or blank line, as some servers hold the
+// connection open after sending it.
+func (s *sseScanner) Next() (string, error) {
+	if s.done {
+		return "", io.EOF
+	}
+	data := make([]string, 0, 1)
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		eof := err != nil
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "":
+			//// A blank line ends the event
+			if len(data) > 0 {
+				return s.dispatch(data)
+			}
+		case strings.HasPrefix(line, "data:"):
+			value := strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+			if value == streamDone && len(data) == 0 {
+				s.done = true
+				return "", io.EOF
+			}
+			data = append(data, value)
+		}
+		//// Anything else is a comment (":") or a field we have no use for (event, id, retry)
+
+		if eof {
+			if len(data) > 0 {
+				//// The stream ended without the blank line, the event is still complete
+				return s.dispatch(data)
+			}
+			s.done = true
+			return "", io.EOF
+		}
+	}
+}
+
+func (s *sseScanner) dispatch(data []string) (string, error) {
+	event := strings.Join(data, "\n")
+	if event == streamDone {
+		s.done = true
+		return "", io.EOF
+	}
+	return event, nil
+}
+
+// One data event of a stream, e.g. data: {"id":"...","choices":[{"index":0,"delta":{"content":"Hel"}}]}
+type StreamChunk struct {
+	Id                string `json:"id"`
+	Object            string `json:"object"`
+	Created           int    `json:"created"`
+	Model             string `json:"model"`
+	SystemFingerprint string `json:"system_fingerprint"`
+	Choices           []struct {
+		Index        int         `json:"index"`
+		Delta        StreamDelta `json:"delta"`
+		FinishReason string      `json:"finish_reason"` /// empty until the last chunk
+	} `json:"choices"`
+	Usage *Usage `json:"usage,omitempty"` /// only sent on the last chunk, and only by some providers
+}
+
+// The fragment of the message carried by a chunk
+type StreamDelta struct {
+	Role      string          `json:"role,omitempty"`
+	Content   string          `json:"content,omitempty"`
+	ToolCalls []ToolCallDelta `json:"tool_calls,omitempty"`
+	//// The model's reasoning, sent by reasoning models (e.g. DeepSeek-R1 on vLLM) in deltas
+	//// before or between the content deltas
+	ReasoningContent string `json:"reasoning_content,omitempty"`
+}
+
+// A fragment of a tool call. Usually only the first fragment of a call carries the Id, Type and
+// Name - the rest carry the Index and the next piece of the Arguments.
+type ToolCallDelta struct {
+	Index    int    `json:"index"`
+	Id       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments,omitempty"`
+	} `json:"function"`
+}
+
+// Assembles the deltas of a stream into a complete response
+type DeltaAccumulator struct {
+	meta         ResponseMeta
+	content      strings.Builder
+	reasoning    strings.Builder
+	toolcalls    []*FunctionCall
+	arguments    []*strings.Builder
+	finishreason string
+	usage        Usage
+
+	onpartial  func(map[string]any) /// nil unless OnPartialJSON is used
+	partialcut int                  /// the length of the content last parsed for onpartial
+}
+
+// Call fn with the content parsed so far each time another value of a streamed JSON object (as asked
+// for with WithJSONMode) is complete, e.g. to render the object as it arrives. See ParsePartialJSON.
+func (a *DeltaAccumulator) OnPartialJSON(fn func(map[string]any)) {
+	a.onpartial = fn
+}
+
+// Add the first choice of a chunk, along with the chunk's meta, finish reason and usage
+func (a *DeltaAccumulator) AddChunk(chunk StreamChunk) error {
+	if chunk.Id != "" {
+		a.meta = ResponseMeta{
+			Id:                chunk.Id,
+			Created:           chunk.Created,
+			Model:             chunk.Model,
+			SystemFingerprint: chunk.SystemFingerprint,
+		}
+	}
+	if chunk.Usage != nil {
+		a.usage = *chunk.Usage
+	}
+	if len(chunk.Choices) == 0 {
+		return nil
+	}
+	if chunk.Choices[0].FinishReason != "" {
+		a.finishreason = chunk.Choices[0].FinishReason
+	}
+	return a.Add(chunk.Choices[0].Delta)
+}
+
+// Append the content and reasoning of the delta, each to its own, and merge its tool call fragments
+// into the calls seen so far
+func (a *DeltaAccumulator) Add(delta StreamDelta) error {
+	a.content.WriteString(delta.Content)
+	a.reasoning.WriteString(delta.ReasoningContent)
+	if a.onpartial != nil && delta.Content != "" {
+		candidate, cut := partialJSON(a.content.String())
+		if cut > a.partialcut {
+			partial := make(map[string]any)
+			if json.Unmarshal([]byte(candidate), &partial) == nil {
+				a.partialcut = cut
+				a.onpartial(partial)
+			}
+		}
+	}
+
+	for _, tcdelta := range delta.ToolCalls {
+		i, err := a.toolCallIndex(tcdelta)
+		if err != nil {
+			return err
+		}
+		call := a.toolcalls[i]
+		if tcdelta.Id != "" {
+			call.Id = tcdelta.Id
+		}
+		if tcdelta.Type != "" {
+			call.Type = tcdelta.Type
+		}
+		if tcdelta.Function.Name != "" {
+			call.Function.Name = tcdelta.Function.Name
+		}
+		a.arguments[i].WriteString(tcdelta.Function.Arguments)
+	}
+	return nil
+}
+
+// Match the fragment to a call by its id, or failing that by its index
+func (a *DeltaAccumulator) toolCallIndex(tcdelta ToolCallDelta) (int, error) {
+	if tcdelta.Id != "" {
+		for i, call := range a.toolcalls {
+			if call.Id == tcdelta.Id {
+				return i, nil
+			}
+		}
+	}
+	if tcdelta.Index < 0 || tcdelta.Index > len(a.toolcalls) {
+		return 0, fmt.Errorf("tool call delta index %d out of sequence, have %d tool calls", tcdelta.Index, len(a.toolcalls))
+	}
+	if tcdelta.Index == len(a.toolcalls) {
+		a.toolcalls = append(a.toolcalls, &FunctionCall{})
+		a.arguments = append(a.arguments, &strings.Builder{})
+		return tcdelta.Index, nil
+	}
+	if tcdelta.Id != "" && a.toolcalls[tcdelta.Index].Id != "" {
+		return 0, fmt.Errorf("tool call delta %s conflicts with tool call %s at index %d",
+			tcdelta.Id, a.toolcalls[tcdelta.Index].Id, tcdelta.Index)
+	}
+	return tcdelta.Index, nil
+}
+
+// The assembled response. Fails if a tool call has no name or its arguments are not valid JSON,
+// which usually means the stream was cut short.
+func (a *DeltaAccumulator) Finish() (ExtractedResponse, error) {
+	extracted := ExtractedResponse{
+		ResponseMeta: a.meta,
+		Content:      a.content.String(),
+		Reasoning:    a.reasoning.String(),
+		FinishReason: a.finishreason,
+		Usage:        a.usage,
+	}
+	for i, call := range a.toolcalls {
+		fc := *call
+		fc.Function.Arguments = a.arguments[i].String()
+		if fc.Function.Name == "" {
+			return extracted, fmt.Errorf("tool call %d (%s) has no function name", i, fc.Id)
+		}
+		if fc.Function.Arguments != "" && !json.Valid([]byte(fc.Function.Arguments)) {
+			return extracted, fmt.Errorf("tool call %d (%s) has incomplete arguments: %s", i, fc.Id, fc.Function.Arguments)
+		}
+		extracted.FunctionCalls = append(extracted.FunctionCalls, fc)
+	}
+	return extracted, nil
+}
+
+// Parse the start of a JSON object that is still being streamed. Only complete values are included -
+// strings once they are closed, and numbers, true, false and null once what follows them shows they
+// have ended - along with the objects and arrays they are in, so each parse of a growing stream has
+// everything the one before it had. Returns false if there is nothing to parse yet, or the content
+// isn't the start of a JSON object.
+func ParsePartialJSON(content string) (map[string]any, bool) {
+	candidate, cut := partialJSON(content)
+	if cut < 0 {
+		return nil, false
+	}
+	partial := make(map[string]any)
+	if json.Unmarshal([]byte(candidate), &partial) != nil {
+		return nil, false
+	}
+	return partial, true
+}
+
+// The longest prefix of content that ends with a complete value, with the objects and arrays it
+// leaves open closed, and the length of that prefix. The length is -1 if there is no such prefix.
+func partialJSON(content string) (string, int) {
+	type container struct {
+		close     byte
+		expectkey bool /// the next string in an object is a key
+	}
+	stack := make([]container, 0)
+	cut, closers := -1, ""
+	mark := func(pos int) {
+		cut = pos
+		closing := make([]byte, 0, len(stack))
+		for i := len(stack) - 1; i >= 0; i-- {
+			closing = append(closing, stack[i].close)
+		}
+		closers = string(closing)
+	}
+
+	start := strings.IndexFunc(content, func(r rune) bool { return !unicode.IsSpace(r) })
+	if start < 0 || content[start] != '{' {
+		return "", -1
+	}
+	instring, escaped, iskey := false, false, false
+	for i := start; i < len(content); i++ {
+		c := content[i]
+		if instring {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				instring = false
+				if !iskey {
+					mark(i + 1)
+				}
+			}
+			continue
+		}
+		switch c {
+		case '{':
+			stack = append(stack, container{close: '}', expectkey: true})
+			mark(i + 1)
+		case '[':
+			stack = append(stack, container{close: ']'})
+			mark(i + 1)
+		case '}', ']':
+			if len(stack) == 0 || stack[len(stack)-1].close != c {
+				return "", -1
+			}
+			stack = stack[:len(stack)-1]
+			mark(i + 1)
+			if len(stack) == 0 {
+				return content[start:cut], cut
+			}
+		case '"':
+			instring = true
+			iskey = len(stack) > 0 && stack[len(stack)-1].expectkey
+		case ':':
+			if len(stack) > 0 {
+				stack[len(stack)-1].expectkey = false
+			}
+		case ',':
+			if len(stack) > 0 && stack[len(stack)-1].close == '}' {
+				stack[len(stack)-1].expectkey = true
+			}
+		case ' ', '\t', '\r', '\n':
+		default:
+			//// A number or literal, which is only known to be complete once something follows it
+			end := strings.IndexAny(content[i:], ",}] \t\r\n")
+			if end < 0 {
+				return content[start:cut] + closers, cut
+			}
+			mark(i + end)
+			i += end - 1
+		}
+	}
+	return content[start:cut] + closers, cut
+}
+
+// Stream the response to message, writing the content to w as it arrives and flushing w after each
+// write if it is an http.Flusher, e.g. for a CLI or an HTTP handler that passes the stream on.
+// Returns the whole content. A failed write cancels the stream. Tool calls made by the model are
+// not written or returned, use SendRequestWithHistory when the model is to call tools. Nor is the
+// reasoning of a reasoning model, which WithReasoningContent returns.
+func (c *Adaptor) SendRequestStreamTo(w io.Writer, message string, history []Message, tools []Tool,
+	opts ...RequestOption) (string, error) {
+
+	c.autoWarmup()
+	rc := c.newRequestConfig(opts)
+	messages := make([]Message, 0, len(history)+3)
+	messages = c.withBaseInstruct(messages, history, rc)
+	messages = append(messages, Message{
+		Role: string(ROLE_USER), Content: html.UnescapeString(message),
+	})
+	reqData, err := c.newAIRequest(messages, tools, rc)
+	if err != nil {
+		return "", err
+	}
+	reqData.Stream = true
+
+	start := time.Now()
+	content, err := c.streamTo(w, reqData, rc)
+	c.stats.record(start, err)
+	return content, err
+}
+
+func (c *Adaptor) streamTo(w io.Writer, reqData AIRequest, rc *requestConfig) (string, error) {
+	//// Stop reading, and close the connection, as soon as a write fails
+	ctx, cancel := context.WithCancel(rc.ctx)
+	defer cancel()
+	streamrc := *rc
+	streamrc.ctx = ctx
+	streamrc.stream = true
+	resp, model, err := c.sendWithFallback(reqData, &streamrc)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	flusher, _ := w.(http.Flusher)
+	write := func(content string) error {
+		if _, err := io.WriteString(w, content); err != nil {
+			return fmt.Errorf("error writing stream: %w", err)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+	if rc.assistantprefix != "" {
+		if err := write(rc.assistantprefix); err != nil {
+			return "", err
+		}
+	}
+
+	accumulator := DeltaAccumulator{}
+	if rc.onpartialjson != nil {
+		accumulator.OnPartialJSON(rc.onpartialjson)
+	}
+	scanner := newSSEScanner(resp.Body)
+	for {
+		data, err := scanner.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("error reading stream: %w", err)
+		}
+		chunk := StreamChunk{}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return "", fmt.Errorf("error decoding stream chunk %q: %w", data, err)
+		}
+		if err := accumulator.AddChunk(chunk); err != nil {
+			return "", err
+		}
+		if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
+			if err := write(chunk.Choices[0].Delta.Content); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	extracted, err := accumulator.Finish()
+	if err != nil {
+		return "", err
+	}
+	extracted.RequestModel = model
+	c.storeResponseMeta(extracted.ResponseMeta, rc)
+	if rc.reasoning != nil {
+		*rc.reasoning = extracted.Reasoning
+	}
+	c.usage.addUsage(extracted.Usage)
+	return rc.assistantprefix + extracted.Content, nil
+}
@@ -0,0 +1,520 @@
+package hf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestDeltaAccumulatorContent(t *testing.T) {
+	chunks := []string{
+		`{"id":"chatcmpl-1","created":1718000000,"model":"test-model","choices":[{"index":0,"delta":{"role":"assistant","content":""}}]}`,
+		`{"id":"chatcmpl-1","created":1718000000,"model":"test-model","choices":[{"index":0,"delta":{"content":"The capital "}}]}`,
+		`{"id":"chatcmpl-1","created":1718000000,"model":"test-model","choices":[{"index":0,"delta":{"content":"of France "}}]}`,
+		`{"id":"chatcmpl-1","created":1718000000,"model":"test-model","choices":[{"index":0,"delta":{"content":"is Paris."},"finish_reason":"stop"}],` +
+			`"usage":{"prompt_tokens":12,"completion_tokens":7,"total_tokens":19}}`,
+	}
+
+	acc := &DeltaAccumulator{}
+	for _, data := range chunks {
+		chunk := StreamChunk{}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("Failed to decode chunk: %v", err)
+		}
+		if err := acc.AddChunk(chunk); err != nil {
+			t.Fatalf("AddChunk returned error: %v", err)
+		}
+	}
+	extracted, err := acc.Finish()
+	if err != nil {
+		t.Fatalf("Finish returned error: %v", err)
+	}
+	if extracted.Content != "The capital of France is Paris." {
+		t.Errorf("Unexpected content '%s'", extracted.Content)
+	}
+	if extracted.Id != "chatcmpl-1" || extracted.FinishReason != "stop" || extracted.Usage.TotalTokens != 19 {
+		t.Errorf("Unexpected extracted response: %+v", extracted)
+	}
+	if extracted.FunctionCalls != nil {
+		t.Errorf("Expected no function calls, got %+v", extracted.FunctionCalls)
+	}
+}
+
+func TestDeltaAccumulatorToolCalls(t *testing.T) {
+	chunks := []string{
+		`{"choices":[{"index":0,"delta":{"role":"assistant","tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_user_weather","arguments":""}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"loca"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"id":"call_2","type":"function","function":{"name":"get_time","arguments":"{}"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"tion\": \"Lon"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","function":{"arguments":"don\"}"}}]},"finish_reason":"tool_calls"}]}`,
+	}
+
+	acc := &DeltaAccumulator{}
+	for _, data := range chunks {
+		chunk := StreamChunk{}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("Failed to decode chunk: %v", err)
+		}
+		if err := acc.AddChunk(chunk); err != nil {
+			t.Fatalf("AddChunk returned error: %v", err)
+		}
+	}
+	extracted, err := acc.Finish()
+	if err != nil {
+		t.Fatalf("Finish returned error: %v", err)
+	}
+	if len(extracted.FunctionCalls) != 2 {
+		t.Fatalf("Expected 2 function calls, got %d", len(extracted.FunctionCalls))
+	}
+	first := extracted.FunctionCalls[0]
+	if first.Id != "call_1" || first.Type != "function" || first.Function.Name != "get_user_weather" {
+		t.Errorf("Unexpected first function call: %+v", first)
+	}
+	if first.Function.Arguments != `{"location": "London"}` {
+		t.Errorf("Unexpected first function call arguments: %s", first.Function.Arguments)
+	}
+	second := extracted.FunctionCalls[1]
+	if second.Id != "call_2" || second.Function.Name != "get_time" || second.Function.Arguments != "{}" {
+		t.Errorf("Unexpected second function call: %+v", second)
+	}
+	if extracted.FinishReason != "tool_calls" {
+		t.Errorf("Expected finish reason 'tool_calls', got '%s'", extracted.FinishReason)
+	}
+}
+
+func TestDeltaAccumulatorIncompleteToolCall(t *testing.T) {
+	acc := &DeltaAccumulator{}
+	delta := StreamDelta{ToolCalls: []ToolCallDelta{{Index: 0, Id: "call_1"}}}
+	delta.ToolCalls[0].Function.Name = "get_user_weather"
+	delta.ToolCalls[0].Function.Arguments = `{"location": "Lon`
+	if err := acc.Add(delta); err != nil {
+		t.Fatalf("Add returned error: %v", err)
+	}
+	if _, err := acc.Finish(); err == nil {
+		t.Error("Expected an error for truncated tool call arguments, got nil")
+	}
+
+	outofsequence := StreamDelta{ToolCalls: []ToolCallDelta{{Index: 5}}}
+	if err := acc.Add(outofsequence); err == nil {
+		t.Error("Expected an error for an out of sequence tool call index, got nil")
+	}
+}
+
+// Returns the stream in pieces, split at the given offsets, one piece per Read
+type splitReader struct {
+	pieces []string
+}
+
+func newSplitReader(stream string, offsets ...int) *splitReader {
+	r := &splitReader{}
+	last := 0
+	for _, offset := range offsets {
+		r.pieces = append(r.pieces, stream[last:offset])
+		last = offset
+	}
+	r.pieces = append(r.pieces, stream[last:])
+	return r
+}
+
+func (r *splitReader) Read(p []byte) (int, error) {
+	if len(r.pieces) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.pieces[0])
+	r.pieces[0] = r.pieces[0][n:]
+	if r.pieces[0] == "" {
+		r.pieces = r.pieces[1:]
+	}
+	return n, nil
+}
+
+func readAllEvents(t *testing.T, r io.Reader) []string {
+	scanner := newSSEScanner(r)
+	events := make([]string, 0)
+	for {
+		event, err := scanner.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next returned error: %v", err)
+		}
+		events = append(events, event)
+	}
+	if _, err := scanner.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected io.EOF once the stream has ended, got %v", err)
+	}
+	return events
+}
+
+func TestDeltaAccumulatorPartialJSON(t *testing.T) {
+	content := `{"title": "Paris", "population": 2102650, "tags": ["capital", "france"], "mayor": {"name": "Anne \"H\"", "since": 2014}, "river": null}`
+	partials := make([]map[string]any, 0)
+	accumulator := DeltaAccumulator{}
+	accumulator.OnPartialJSON(func(partial map[string]any) {
+		partials = append(partials, partial)
+	})
+	//// Fragments of 3 bytes split every token somewhere
+	for i := 0; i < len(content); i += 3 {
+		if err := accumulator.Add(StreamDelta{Content: content[i:min(i+3, len(content))]}); err != nil {
+			t.Fatalf("Add returned error: %v", err)
+		}
+	}
+
+	if len(partials) < 5 {
+		t.Fatalf("Expected a partial object for each completed value, got %v", partials)
+	}
+	//// Each partial has everything the one before it had, and is itself complete JSON
+	for i := 1; i < len(partials); i++ {
+		if !containsPartial(partials[i], partials[i-1]) {
+			t.Errorf("Expected partial %d to extend %v, got %v", i, partials[i-1], partials[i])
+		}
+	}
+	for _, partial := range partials {
+		if title, ok := partial["title"]; ok && title != "Paris" {
+			t.Errorf("Expected only the complete title, got %q", title)
+		}
+		if population, ok := partial["population"]; ok && population != 2102650.0 {
+			t.Errorf("Expected only the complete population, got %v", population)
+		}
+	}
+	expected := make(map[string]any)
+	json.Unmarshal([]byte(content), &expected)
+	if !reflect.DeepEqual(partials[len(partials)-1], expected) {
+		t.Errorf("Expected the last partial to be the whole object %v, got %v", expected, partials[len(partials)-1])
+	}
+}
+
+// Whether every value in before is in after, with arrays and objects allowed to have grown
+func containsPartial(after, before any) bool {
+	switch before := before.(type) {
+	case map[string]any:
+		after, ok := after.(map[string]any)
+		if !ok {
+			return false
+		}
+		for key, value := range before {
+			if !containsPartial(after[key], value) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		after, ok := after.([]any)
+		if !ok || len(after) < len(before) {
+			return false
+		}
+		for i := range before {
+			if !containsPartial(after[i], before[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(after, before)
+}
+
+func TestParsePartialJSON(t *testing.T) {
+	tests := []struct {
+		content  string
+		expected map[string]any
+		ok       bool
+	}{
+		{"", nil, false},
+		{"Sure, here it is", nil, false},
+		{" {", map[string]any{}, true},
+		{`{"na`, map[string]any{}, true},
+		{`{"name": "Par`, map[string]any{}, true},
+		{`{"name": "Paris", "age": 12`, map[string]any{"name": "Paris"}, true},
+		{`{"name": "Paris", "age": 12,`, map[string]any{"name": "Paris", "age": 12.0}, true},
+		{`{"ok": tr`, map[string]any{}, true},
+		{`{"tags": ["a", "b`, map[string]any{"tags": []any{"a"}}, true},
+		{`{"a": {"b": [1, {"c": "}]"`, map[string]any{"a": map[string]any{"b": []any{1.0, map[string]any{"c": "}]"}}}}, true},
+		{`{"a": 1} trailing`, map[string]any{"a": 1.0}, true},
+	}
+	for _, tt := range tests {
+		partial, ok := ParsePartialJSON(tt.content)
+		if ok != tt.ok || !reflect.DeepEqual(partial, tt.expected) {
+			t.Errorf("ParsePartialJSON(%q): expected %v, %v, got %v, %v", tt.content, tt.expected, tt.ok, partial, ok)
+		}
+	}
+}
+
+// A server that streams the content in pieces, one event per piece, then [DONE]
+func newStreamServer(t *testing.T, pieces []string) (*httptest.Server, *AIRequest) {
+	reqData := &AIRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(reqData)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i, piece := range pieces {
+			chunk := `{"id":"chatcmpl-1","model":"test-model","choices":[{"index":0,"delta":{"content":` + strconv.Quote(piece) + `}}]`
+			if i == len(pieces)-1 {
+				chunk += `,"usage":{"prompt_tokens":12,"completion_tokens":7,"total_tokens":19}`
+			}
+			fmt.Fprintf(w, "data: %s}\n\n", chunk)
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(server.Close)
+	return server, reqData
+}
+
+func TestSendRequestStreamTo(t *testing.T) {
+	server, reqData := newStreamServer(t, []string{"The capital ", "of France ", "is Paris."})
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+
+	buffer := &bytes.Buffer{}
+	content, err := adaptor.SendRequestStreamTo(buffer, "What is the capital of France?", nil, nil)
+	if err != nil {
+		t.Fatalf("SendRequestStreamTo returned error: %v", err)
+	}
+	if content != "The capital of France is Paris." || buffer.String() != content {
+		t.Errorf("Expected the content returned and written, got '%s' and '%s'", content, buffer.String())
+	}
+	if !reqData.Stream {
+		t.Error("Expected the request to ask for a stream")
+	}
+	if adaptor.LastResponseMeta().Id != "chatcmpl-1" || adaptor.TotalTokensUsed().Total() != 19 {
+		t.Errorf("Expected the meta and usage from the stream, got %+v, %+v", adaptor.LastResponseMeta(), adaptor.TotalTokensUsed())
+	}
+
+	recorder := httptest.NewRecorder()
+	if _, err := adaptor.SendRequestStreamTo(recorder, "What is the capital of France?", nil, nil); err != nil {
+		t.Fatalf("SendRequestStreamTo returned error: %v", err)
+	}
+	if !recorder.Flushed || recorder.Body.String() != "The capital of France is Paris." {
+		t.Errorf("Expected the flushed content, got flushed %v, '%s'", recorder.Flushed, recorder.Body.String())
+	}
+}
+
+type failingWriter struct {
+	writes int
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes > 1 {
+		return 0, errWriteFailed
+	}
+	return len(p), nil
+}
+
+func TestSendRequestStreamToWriteError(t *testing.T) {
+	server, _ := newStreamServer(t, []string{"The capital ", "of France ", "is Paris."})
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+
+	writer := &failingWriter{}
+	_, err := adaptor.SendRequestStreamTo(writer, "What is the capital of France?", nil, nil)
+	if !errors.Is(err, errWriteFailed) {
+		t.Errorf("Expected the write error, got %v", err)
+	}
+	if writer.writes != 2 {
+		t.Errorf("Expected the stream to stop at the failed write, got %d writes", writer.writes)
+	}
+}
+
+func TestSSEScannerSplitReads(t *testing.T) {
+	stream := ": keep-alive\n\n" +
+		"data: {\"content\":\"Hel\"}\n\n" +
+		"event: message\r\ndata: {\"content\":\"lo\"}\r\n\r\n" +
+		"data: first line\ndata: second line\n\n" +
+		"data: [DONE]\n\n" +
+		"data: after done\n\n"
+	expected := []string{`{"content":"Hel"}`, `{"content":"lo"}`, "first line\nsecond line"}
+
+	//// Split mid prefix, mid JSON, between \r and \n, mid [DONE] and one byte at a time
+	readers := map[string]io.Reader{
+		"whole":    strings.NewReader(stream),
+		"mid line": newSplitReader(stream, 17, 22, 30, 60, 61, 78, 110, 126),
+		"one byte": iotest.OneByteReader(strings.NewReader(stream)),
+	}
+	for name, r := range readers {
+		events := readAllEvents(t, r)
+		if !reflect.DeepEqual(events, expected) {
+			t.Errorf("%s: expected events %q, got %q", name, expected, events)
+		}
+	}
+}
+
+func TestSSEScannerDoneWithoutNewline(t *testing.T) {
+	streams := []string{
+		"data: {\"a\":1}\n\ndata: [DONE]",
+		"data: {\"a\":1}\n\ndata:[DONE]\n",
+		"data: {\"a\":1}\n\ndata: [DONE]\r\n",
+	}
+	for _, stream := range streams {
+		events := readAllEvents(t, newSplitReader(stream, len(stream)-3))
+		if len(events) != 1 || events[0] != `{"a":1}` {
+			t.Errorf("%q: expected one event, got %q", stream, events)
+		}
+	}
+}
+
+func TestSSEScannerDoneHeldOpen(t *testing.T) {
+	//// The server sends [DONE] but keeps the connection open - Next must not wait for more
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write([]byte("data: {\"a\":1}\n\ndata: [DONE]\n"))
+
+	scanner := newSSEScanner(pr)
+	if event, err := scanner.Next(); err != nil || event != `{"a":1}` {
+		t.Fatalf("Expected the first event, got '%s', %v", event, err)
+	}
+	if _, err := scanner.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected io.EOF after [DONE], got %v", err)
+	}
+}
+
+func TestSSEScannerTruncated(t *testing.T) {
+	//// No blank line or [DONE] - the final event is still returned
+	events := readAllEvents(t, newSplitReader("data: {\"a\":1}\n\ndata: {\"b\"", 20))
+	expected := []string{`{"a":1}`, `{"b"`}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected events %q, got %q", expected, events)
+	}
+
+	scanner := newSSEScanner(iotest.ErrReader(io.ErrUnexpectedEOF))
+	if _, err := scanner.Next(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected the read error, got %v", err)
+	}
+}
+
+func TestDeltaAccumulatorReasoning(t *testing.T) {
+	chunks := []string{
+		`{"id":"chatcmpl-1","choices":[{"index":0,"delta":{"role":"assistant","reasoning_content":"The user asks "}}]}`,
+		`{"id":"chatcmpl-1","choices":[{"index":0,"delta":{"reasoning_content":"about France."}}]}`,
+		`{"id":"chatcmpl-1","choices":[{"index":0,"delta":{"content":"The capital "}}]}`,
+		`{"id":"chatcmpl-1","choices":[{"index":0,"delta":{"reasoning_content":" Paris, not Lyon."}}]}`,
+		`{"id":"chatcmpl-1","choices":[{"index":0,"delta":{"content":"is Paris.","reasoning_content":""},"finish_reason":"stop"}]}`,
+	}
+	acc := &DeltaAccumulator{}
+	for _, data := range chunks {
+		chunk := StreamChunk{}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("Failed to decode chunk: %v", err)
+		}
+		if err := acc.AddChunk(chunk); err != nil {
+			t.Fatalf("AddChunk returned error: %v", err)
+		}
+	}
+	extracted, err := acc.Finish()
+	if err != nil {
+		t.Fatalf("Finish returned error: %v", err)
+	}
+	if extracted.Content != "The capital is Paris." {
+		t.Errorf("Expected only the content deltas in the content, got '%s'", extracted.Content)
+	}
+	if extracted.Reasoning != "The user asks about France. Paris, not Lyon." {
+		t.Errorf("Expected only the reasoning deltas in the reasoning, got '%s'", extracted.Reasoning)
+	}
+}
+
+func TestSendRequestStreamToReasoning(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, delta := range []string{
+			`{"reasoning_content":"Thinking..."}`,
+			`{"content":"Paris"}`,
+			`{"reasoning_content":" done."}`,
+			`{"content":"."}`,
+		} {
+			fmt.Fprintf(w, "data: {\"id\":\"chatcmpl-1\",\"choices\":[{\"index\":0,\"delta\":%s}]}\n\n", delta)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+
+	buffer := &bytes.Buffer{}
+	reasoning := ""
+	content, err := adaptor.SendRequestStreamTo(buffer, "What is the capital of France?", nil, nil,
+		WithReasoningContent(&reasoning))
+	if err != nil {
+		t.Fatalf("SendRequestStreamTo returned error: %v", err)
+	}
+	if content != "Paris." || buffer.String() != "Paris." {
+		t.Errorf("Expected only the content returned and written, got '%s' and '%s'", content, buffer.String())
+	}
+	if reasoning != "Thinking... done." {
+		t.Errorf("Expected the reasoning, got '%s'", reasoning)
+	}
+}
+
+// Closes written on the first write
+type firstWriteSignal struct {
+	buffer  bytes.Buffer
+	once    sync.Once
+	written chan struct{}
+}
+
+func (w *firstWriteSignal) Write(p []byte) (int, error) {
+	defer w.once.Do(func() { close(w.written) })
+	return w.buffer.Write(p)
+}
+
+func TestSendRequestStreamToNotBuffered(t *testing.T) {
+	writer := &firstWriteSignal{written: make(chan struct{})}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, `data: {"id":"chatcmpl-1","choices":[{"index":0,"delta":{"content":"Hello"}}]}`+"\n\n")
+		w.(http.Flusher).Flush()
+		//// The rest only comes once the first chunk has been passed on
+		select {
+		case <-writer.written:
+		case <-time.After(5 * time.Second):
+			t.Error("Expected the first chunk to be written before the stream ended")
+		}
+		fmt.Fprint(w, `data: {"id":"chatcmpl-1","choices":[{"index":0,"delta":{"content":" world"}}]}`+"\n\ndata: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	decided := false
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithRetryDecider(func(resp *http.Response) (bool, time.Duration) {
+			decided = true
+			return DefaultRetryDecider(resp)
+		}),
+		WithResponseChecksum("X-Response-SHA256"))
+	content, err := adaptor.SendRequestStreamTo(writer, "Hi", nil, nil)
+	if err != nil {
+		t.Fatalf("SendRequestStreamTo returned error: %v", err)
+	}
+	if content != "Hello world" || writer.buffer.String() != content {
+		t.Errorf("Expected the content returned and written, got '%s' and '%s'", content, writer.buffer.String())
+	}
+	if decided {
+		t.Error("Expected the streamed 200 not to be passed to the retry decider")
+	}
+}
+
+func TestSendRequestStreamToPartialJSON(t *testing.T) {
+	server, _ := newStreamServer(t, []string{`{"city": "Pa`, `ris", "rank"`, `: 1, "tags": ["capital"]}`})
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1)
+
+	partials := make([]map[string]any, 0)
+	_, err := adaptor.SendRequestStreamTo(io.Discard, "Describe Paris", nil, nil, WithJSONMode(),
+		WithPartialJSON(func(partial map[string]any) {
+			partials = append(partials, partial)
+		}))
+	if err != nil {
+		t.Fatalf("SendRequestStreamTo returned error: %v", err)
+	}
+	expected := map[string]any{"city": "Paris", "rank": 1.0, "tags": []any{"capital"}}
+	if len(partials) < 2 || !reflect.DeepEqual(partials[len(partials)-1], expected) {
+		t.Errorf("Expected partial objects ending with %v, got %v", expected, partials)
+	}
+}
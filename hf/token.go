@@ -0,0 +1,57 @@
+package hf
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Fetches a new API token (e.g. a short lived OAuth token) and when it expires
+type TokenRefresher func(ctx context.Context) (string, time.Time, error)
+
+type tokenSource struct {
+	refresher TokenRefresher
+	buffer    time.Duration /// refresh this long before the token expires
+
+	lock   sync.Mutex
+	token  string
+	expiry time.Time
+	group  singleflight.Group
+}
+
+func newTokenSource(refresher TokenRefresher, buffer time.Duration) *tokenSource {
+	return &tokenSource{
+		refresher: refresher,
+		buffer:    buffer,
+	}
+}
+
+// The current token, refreshed first if it is about to expire. Concurrent callers that all see
+// an expiring token share a single call to the refresher.
+func (ts *tokenSource) Token(ctx context.Context) (string, error) {
+	ts.lock.Lock()
+	token, expiry := ts.token, ts.expiry
+	ts.lock.Unlock()
+	if token != "" && time.Until(expiry) > ts.buffer {
+		return token, nil
+	}
+
+	refreshed, err, _ := ts.group.Do("token", func() (any, error) {
+		token, expiry, err := ts.refresher(ctx)
+		if err != nil {
+			return "", fmt.Errorf("error refreshing API token: %w", err)
+		}
+		ts.lock.Lock()
+		defer ts.lock.Unlock()
+		ts.token = token
+		ts.expiry = expiry
+		return token, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return refreshed.(string), nil
+}
@@ -0,0 +1,122 @@
+package hf
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenRefresherSingleFlight(t *testing.T) {
+	var lock sync.Mutex
+	keys := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		keys[r.Header.Get("Authorization")]++
+		lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	refresher := func(ctx context.Context) (string, time.Time, error) {
+		calls.Add(1)
+		<-release
+		return "fresh-token", time.Now().Add(time.Hour), nil
+	}
+	adaptor := NewAdaptor(server.URL, "static-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithTokenRefresher(refresher))
+	//// Seed a token that is inside the refresh buffer
+	adaptor.tokens.token = "stale-token"
+	adaptor.tokens.expiry = time.Now().Add(10 * time.Second)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := adaptor.SendRequest("Hi")
+			errs <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("SendRequest returned error: %v", err)
+		}
+	}
+
+	if calls.Load() != 1 {
+		t.Errorf("Expected the refresher to be called once, got %d", calls.Load())
+	}
+	if keys["Bearer fresh-token"] != 10 || len(keys) != 1 {
+		t.Errorf("Expected every request to use the fresh token, got %v", keys)
+	}
+
+	//// The refreshed token is cached
+	if _, err := adaptor.SendRequest("Hi"); err != nil {
+		t.Fatalf("SendRequest returned error: %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected the cached token to be reused, refresher called %d times", calls.Load())
+	}
+}
+
+func TestTokenRefresherError(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer server.Close()
+
+	refusal := errors.New("identity provider unavailable")
+	adaptor := NewAdaptor(server.URL, "", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithTokenRefresher(func(ctx context.Context) (string, time.Time, error) {
+			return "", time.Time{}, refusal
+		}))
+	_, err := adaptor.SendRequest("Hi")
+	if !errors.Is(err, refusal) {
+		t.Fatalf("Expected the refresher error, got %v", err)
+	}
+	if requests.Load() != 0 {
+		t.Errorf("Expected no request to be sent, got %d", requests.Load())
+	}
+}
+
+func TestWithTokenRefreshBuffer(t *testing.T) {
+	var calls atomic.Int32
+	ts := newTokenSource(func(ctx context.Context) (string, time.Time, error) {
+		calls.Add(1)
+		return "token", time.Now().Add(time.Minute), nil
+	}, 30*time.Second)
+	WithTokenRefreshBuffer(2 * time.Minute)(&BaseAdaptor{tokens: ts})
+
+	for i := 0; i < 2; i++ {
+		if _, err := ts.Token(context.Background()); err != nil {
+			t.Fatalf("Token returned error: %v", err)
+		}
+	}
+	if calls.Load() != 2 {
+		t.Errorf("Expected a token inside the buffer to be refreshed each time, got %d calls", calls.Load())
+	}
+
+	//// The buffer can come before the refresher, and is kept by a clone
+	adaptor := NewBaseAdaptor("http://localhost", "", "test-model", 1,
+		WithTokenRefreshBuffer(2*time.Minute), WithTokenRefresher(ts.refresher))
+	if adaptor.tokens.buffer != 2*time.Minute {
+		t.Errorf("Expected a 2m buffer, got %s", adaptor.tokens.buffer)
+	}
+	if cl := adaptor.clone(nil); cl.tokens.buffer != 2*time.Minute {
+		t.Errorf("Expected the clone to keep the 2m buffer, got %s", cl.tokens.buffer)
+	}
+}
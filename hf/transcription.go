@@ -0,0 +1,67 @@
+package hf
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// An adaptor for speech recognition (ASR) models, e.g. Whisper, that take audio and return
+// {"text": "..."}
+type TranscriptionAdaptor struct {
+	*BaseAdaptor
+}
+
+// Requests are encoded with BinaryEncoder unless another encoder is set with WithRequestEncoder
+func NewTranscriptionAdaptor(apiurl, apikey, model string, maxretries int, opts ...Option) *TranscriptionAdaptor {
+	ad := &TranscriptionAdaptor{
+		BaseAdaptor: NewBaseAdaptor(apiurl, apikey, model, maxretries, opts...),
+	}
+	if ad.encoder == nil {
+		ad.encoder = BinaryEncoder{}
+	}
+	return ad
+}
+
+// The audio with parameters, as the HF inference API takes it
+type TranscriptionRequest struct {
+	Inputs     string         `json:"inputs"` /// the audio, base64 encoded
+	Parameters map[string]any `json:"parameters,omitempty"`
+}
+
+// Transcribe the audio, which is in the format contentType, e.g. audio/flac or audio/wav. Without
+// params the audio is sent as it is, otherwise it is sent base64 encoded in a TranscriptionRequest.
+// The audio is read in full first, so it can be sent again if the request is retried.
+func (c *TranscriptionAdaptor) Transcribe(audio io.Reader, contentType string, params map[string]any) (string, error) {
+	data, err := io.ReadAll(audio)
+	if err != nil {
+		return "", fmt.Errorf("error reading audio: %w", err)
+	}
+	var req any = BinaryRequest{Data: data, ContentType: contentType}
+	if len(params) > 0 {
+		req = TranscriptionRequest{
+			Inputs:     base64.StdEncoding.EncodeToString(data),
+			Parameters: params,
+		}
+	}
+	resp, err := c.sendWithRetry(context.Background(), req, c.newRequestConfig(nil))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading response: %w", err)
+	}
+	transcript := struct {
+		Text string `json:"text"`
+	}{}
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&transcript)
+	if err != nil {
+		return "", newDecodeError("Transcribe", body, err)
+	}
+	return transcript.Text, nil
+}
@@ -0,0 +1,78 @@
+package hf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTranscriptionAdaptor(t *testing.T) {
+	audio := []byte("fLaC\x00\x00\x00\x22 audio frames")
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if r.Header.Get("Authorization") != "Bearer test-key" {
+			t.Errorf("Expected the API key, got %s", r.Header.Get("Authorization"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		switch r.Header.Get("Content-Type") {
+		case "audio/flac":
+			//// The model is loading on the first attempt
+			if attempts == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if !bytes.Equal(body, audio) {
+				t.Errorf("Expected the raw audio, got %q", body)
+			}
+			w.Write([]byte(`{"text": " Hello world."}`))
+		case "application/json":
+			req := TranscriptionRequest{}
+			json.Unmarshal(body, &req)
+			decoded, _ := base64.StdEncoding.DecodeString(req.Inputs)
+			if !bytes.Equal(decoded, audio) || req.Parameters["return_timestamps"] != true {
+				t.Errorf("Expected the base64 audio and parameters, got %+v", req)
+			}
+			w.Write([]byte(`{"text": " Hello world.", "chunks": []}`))
+		default:
+			t.Errorf("Unexpected content type %s", r.Header.Get("Content-Type"))
+		}
+	}))
+	defer server.Close()
+
+	adaptor := NewTranscriptionAdaptor(server.URL, "test-key", "openai/whisper-large-v3", 2,
+		WithServiceUnavailableDelay(time.Millisecond))
+	text, err := adaptor.Transcribe(bytes.NewReader(audio), "audio/flac", nil)
+	if err != nil || text != " Hello world." {
+		t.Fatalf("Expected the transcript, got '%s', %v", text, err)
+	}
+	if attempts != 2 {
+		t.Errorf("Expected the audio to be sent again after a 503, got %d attempts", attempts)
+	}
+
+	text, err = adaptor.Transcribe(bytes.NewReader(audio), "audio/flac", map[string]any{"return_timestamps": true})
+	if err != nil || text != " Hello world." {
+		t.Fatalf("Expected the transcript with parameters, got '%s', %v", text, err)
+	}
+}
+
+func TestTranscriptionAdaptorBadResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"text": `))
+	}))
+	defer server.Close()
+
+	adaptor := NewTranscriptionAdaptor(server.URL, "test-key", "openai/whisper-large-v3", 1)
+	_, err := adaptor.Transcribe(strings.NewReader("audio"), "", nil)
+	decodeerr := &DecodeError{}
+	if err == nil || !strings.Contains(err.Error(), "Transcribe") || !errors.As(err, &decodeerr) {
+		t.Errorf("Expected a DecodeError, got %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package hf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// Check the call's arguments against the tool's schema - required parameters must be present,
+// values must match the declared type and enum values must be one of the allowed values.
+// All violations are returned together (joined) rather than just the first.
+func (fc FunctionCall) ValidateAgainst(tool Tool) error {
+	if fc.Function.Name != tool.Function.Name {
+		return fmt.Errorf("function call %s does not match tool %s", fc.Function.Name, tool.Function.Name)
+	}
+	args := make(map[string]any)
+	if fc.Function.Arguments != "" {
+		if err := fc.UnmarshalArguments(&args); err != nil {
+			return err
+		}
+	}
+	params := tool.Function.Parameters
+	if params == nil {
+		if len(args) > 0 {
+			return fmt.Errorf("function %s takes no arguments, got %d", tool.Function.Name, len(args))
+		}
+		return nil
+	}
+
+	violations := make([]error, 0)
+	for _, name := range params.Required {
+		if _, ok := args[name]; !ok {
+			violations = append(violations, fmt.Errorf("missing required argument %s", name))
+		}
+	}
+	for name, value := range args {
+		properties, ok := params.Properties[name]
+		if !ok {
+			if !params.AdditionalProperties {
+				violations = append(violations, fmt.Errorf("unexpected argument %s", name))
+			}
+			continue
+		}
+		violations = append(violations, validateValue("argument", name, value, &properties)...)
+	}
+	return errors.Join(violations...)
+}
+
+// Check value against schema. kind names what is checked in the errors, e.g. argument.
+func validateValue(kind, path string, value any, schema *ToolFunctionParameterProperties) []error {
+	if len(schema.AnyOf) > 0 || len(schema.OneOf) > 0 {
+		return validateAlternatives(kind, path, value, schema)
+	}
+	if !matchesType(value, schema.Type) {
+		return []error{fmt.Errorf("%s %s should be of type %s, got %s", kind, path, schema.Type, jsonTypeName(value))}
+	}
+
+	violations := make([]error, 0)
+	if len(schema.Enum) > 0 {
+		str, ok := value.(string)
+		if !ok || !slices.Contains(schema.Enum, str) {
+			violations = append(violations, fmt.Errorf("%s %s must be one of %v, got %v", kind, path, schema.Enum, value))
+		}
+	}
+	switch v := value.(type) {
+	case []any:
+		if schema.Items != nil {
+			for i, item := range v {
+				violations = append(violations, validateValue(kind, fmt.Sprintf("%s[%d]", path, i), item, schema.Items)...)
+			}
+		}
+	case map[string]any:
+		for _, name := range schema.Required {
+			if _, ok := v[name]; !ok {
+				violations = append(violations, fmt.Errorf("missing required %s %s.%s", kind, path, name))
+			}
+		}
+		for name, child := range v {
+			if childschema, ok := schema.Properties[name]; ok {
+				violations = append(violations, validateValue(kind, path+"."+name, child, childschema)...)
+			}
+		}
+	}
+	return violations
+}
+
+func validateAlternatives(kind, path string, value any, schema *ToolFunctionParameterProperties) []error {
+	alternatives := schema.AnyOf
+	if len(alternatives) == 0 {
+		alternatives = schema.OneOf
+	}
+	matches := 0
+	for _, alt := range alternatives {
+		if len(validateValue(kind, path, value, alt)) == 0 {
+			matches++
+		}
+	}
+	if matches == 0 {
+		return []error{fmt.Errorf("%s %s does not match any of the allowed schemas", kind, path)}
+	}
+	if len(schema.OneOf) > 0 && matches > 1 {
+		return []error{fmt.Errorf("%s %s matches more than one oneOf schema", kind, path)}
+	}
+	return nil
+}
+
+func matchesType(value any, schematype string) bool {
+	switch schematype {
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer", "int":
+		num, ok := value.(float64)
+		return ok && num == math.Trunc(num)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "null":
+		return value == nil
+	}
+	//// Unknown or unset types are not checked
+	return true
+}
+
+func jsonTypeName(value any) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// Check that the content is JSON matching schema, see WithResponseSchema
+func validateResponse(content string, schema *ToolFunctionParameterProperties) error {
+	var value any
+	if err := json.Unmarshal([]byte(content), &value); err != nil {
+		return fmt.Errorf("response is not valid JSON: %w", err)
+	}
+	return errors.Join(validateValue("field", "response", value, schema)...)
+}
@@ -0,0 +1,87 @@
+package hf
+
+import (
+	"strings"
+	"testing"
+)
+
+func newTestFunctionCall(name, arguments string) FunctionCall {
+	fc := FunctionCall{Id: "call_1", Type: "function"}
+	fc.Function.Name = name
+	fc.Function.Arguments = arguments
+	return fc
+}
+
+func TestFunctionCallValidateAgainst(t *testing.T) {
+	tool := NewTool("get_current_weather", "Get the current weather", []ToolParameter{
+		{Name: "location", Type: "string", Required: true},
+		{Name: "unit", Type: "string", Enum: []string{"celsius", "fahrenheit"}},
+		{Name: "days", Type: "integer"},
+		{Name: "hourly", Type: "boolean"},
+		{Name: "fields", Type: "array", ItemType: "string"},
+	})
+
+	valid := newTestFunctionCall("get_current_weather",
+		`{"location": "London", "unit": "celsius", "days": 3, "hourly": true, "fields": ["wind", "rain"]}`)
+	if err := valid.ValidateAgainst(tool); err != nil {
+		t.Errorf("Expected valid arguments, got %v", err)
+	}
+
+	invalid := newTestFunctionCall("get_current_weather",
+		`{"unit": "kelvin", "days": 1.5, "hourly": "yes", "fields": ["wind", 2]}`)
+	err := invalid.ValidateAgainst(tool)
+	if err == nil {
+		t.Fatal("Expected validation errors, got nil")
+	}
+	for _, expected := range []string{
+		"missing required argument location",
+		"argument unit must be one of [celsius fahrenheit]",
+		"argument days should be of type integer",
+		"argument hourly should be of type boolean",
+		"argument fields[1] should be of type string",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error to contain '%s', got:\n%v", expected, err)
+		}
+	}
+
+	wrongname := newTestFunctionCall("get_forecast", `{"location": "London"}`)
+	if err := wrongname.ValidateAgainst(tool); err == nil {
+		t.Error("Expected an error for a mismatched function name, got nil")
+	}
+
+	malformed := newTestFunctionCall("get_current_weather", `{"location": `)
+	if err := malformed.ValidateAgainst(tool); err == nil {
+		t.Error("Expected an error for malformed arguments, got nil")
+	}
+}
+
+func TestFunctionCallValidateAgainstNested(t *testing.T) {
+	tool := NewTool("create_event", "Create a calendar event", []ToolParameter{
+		{Name: "location", Type: "object", Required: true, Children: []ToolParameter{
+			{Name: "city", Type: "string", Required: true},
+		}},
+	})
+	tool.Function.Parameters.Properties["attendee"] = ToolFunctionParameterProperties{
+		AnyOf: []*ToolFunctionParameterProperties{{Type: "string"}, {Type: "integer"}},
+	}
+
+	valid := newTestFunctionCall("create_event", `{"location": {"city": "Paris"}, "attendee": 42}`)
+	if err := valid.ValidateAgainst(tool); err != nil {
+		t.Errorf("Expected valid arguments, got %v", err)
+	}
+
+	invalid := newTestFunctionCall("create_event", `{"location": {}, "attendee": true}`)
+	err := invalid.ValidateAgainst(tool)
+	if err == nil {
+		t.Fatal("Expected validation errors, got nil")
+	}
+	for _, expected := range []string{
+		"missing required argument location.city",
+		"argument attendee does not match any of the allowed schemas",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error to contain '%s', got:\n%v", expected, err)
+		}
+	}
+}
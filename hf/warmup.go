@@ -0,0 +1,53 @@
+package hf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Warms the endpoint up before the adaptor's first request, see WithAutoWarmup
+type autoWarmup struct {
+	ctx     context.Context
+	message string
+
+	once sync.Once
+}
+
+// Send a short request with msg and wait for the endpoint to answer it, retrying while the model is
+// loading (503) as any request would. For endpoints that load the model on the first request, so
+// that a user's first request doesn't time out. Returns nil once the endpoint answers with 200.
+func (c *Adaptor) Warmup(ctx context.Context, msg string) error {
+	rc := c.newRequestConfig([]RequestOption{WithContext(ctx)})
+	maxtokens := 1
+	rc.generationParameters().MaxTokens = &maxtokens
+	reqData, err := c.newAIRequest([]Message{{Role: string(ROLE_USER), Content: msg}}, nil, rc)
+	if err != nil {
+		return err
+	}
+	resp, err := c.sendWithRetry(ctx, reqData, rc)
+	if err != nil {
+		return fmt.Errorf("error warming up: %w", err)
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return fmt.Errorf("error warming up: %w", err)
+	}
+	return nil
+}
+
+// Warm up before the first request, if WithAutoWarmup is used. Requests that arrive during the warm up
+// wait for it. It is only tried once - a failure is logged, and requests go ahead without it.
+func (c *Adaptor) autoWarmup() {
+	warmup := c.warmup
+	if warmup == nil {
+		return
+	}
+	warmup.once.Do(func() {
+		if err := c.Warmup(warmup.ctx, warmup.message); err != nil {
+			c.logger().Warn("warm up failed", "err", err)
+		}
+	})
+}
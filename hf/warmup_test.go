@@ -0,0 +1,142 @@
+package hf
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Answers 503 to the first `loading` requests, as an endpoint does while the model loads
+func newColdServer(t *testing.T, loading int) (*httptest.Server, func() []AIRequest) {
+	var lock sync.Mutex
+	requests := make([]AIRequest, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqData := AIRequest{}
+		json.NewDecoder(r.Body).Decode(&reqData)
+		lock.Lock()
+		requests = append(requests, reqData)
+		count := len(requests)
+		lock.Unlock()
+		if count <= loading {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []AIRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]AIRequest(nil), requests...)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	server, requests := newColdServer(t, 2)
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 3,
+		WithServiceUnavailableDelay(time.Millisecond))
+	if err := adaptor.Warmup(context.Background(), "ping"); err != nil {
+		t.Fatalf("Expected the warm up to succeed once the model loaded, got %v", err)
+	}
+	sent := requests()
+	if len(sent) != 3 {
+		t.Fatalf("Expected 2 retries then success, got %d requests", len(sent))
+	}
+	last := sent[2]
+	if len(last.Messages) != 1 || last.Messages[0].Content != "ping" || last.MaxTokens == nil ||
+		*last.MaxTokens != 1 {
+		t.Errorf("Expected a short request with only the warm up message, got %+v", last)
+	}
+	if stats := adaptor.Stats(); stats.RequestCount != 0 {
+		t.Errorf("Expected the warm up not to count as a request, got %+v", stats)
+	}
+
+	//// Still loading when the retries run out
+	server, _ = newColdServer(t, 10)
+	adaptor = NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithServiceUnavailableDelay(time.Millisecond))
+	if err := adaptor.Warmup(context.Background(), "ping"); err == nil {
+		t.Error("Expected an error from an endpoint that is still loading")
+	}
+}
+
+func TestWithAutoWarmup(t *testing.T) {
+	server, requests := newColdServer(t, 1)
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 2,
+		WithServiceUnavailableDelay(time.Millisecond), WithAutoWarmup(context.Background(), "ping"))
+	if len(requests()) != 0 {
+		t.Fatal("Expected no request before the first send")
+	}
+	for i := 0; i < 2; i++ {
+		content, err := adaptor.SendRequest("Hi")
+		if err != nil || content != "Hello" {
+			t.Fatalf("Expected 'Hello', got '%s', %v", content, err)
+		}
+	}
+	sent := requests()
+	if len(sent) != 4 {
+		t.Fatalf("Expected a warm up with a retry then 2 requests, got %d requests", len(sent))
+	}
+	for i, req := range sent {
+		last := req.Messages[len(req.Messages)-1].Content
+		if (i < 2 && last != "ping") || (i >= 2 && last != "Hi") {
+			t.Errorf("Expected the warm up before the requests, request %d was %q", i, last)
+		}
+	}
+
+	//// A failed warm up doesn't stop the requests, and isn't tried again
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	server, requests = newColdServer(t, 0)
+	adaptor = NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 2,
+		WithAutoWarmup(ctx, "ping"))
+	for i := 0; i < 2; i++ {
+		if _, err := adaptor.SendRequest("Hi"); err != nil {
+			t.Fatalf("Expected the request to succeed without the warm up, got %v", err)
+		}
+	}
+	if len(requests()) != 2 {
+		t.Errorf("Expected only the requests to be sent, got %d", len(requests()))
+	}
+}
+
+func TestWithAutoWarmupConcurrentFailure(t *testing.T) {
+	var lock sync.Mutex
+	pings := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqData := AIRequest{}
+		json.NewDecoder(r.Body).Decode(&reqData)
+		if reqData.Messages[len(reqData.Messages)-1].Content == "ping" {
+			lock.Lock()
+			pings++
+			lock.Unlock()
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testChatResponse))
+	}))
+	defer server.Close()
+
+	adaptor := NewAdaptor(server.URL, "test-key", "test-model", "You are an assistant.", OpenAIJsonExtractor, 1,
+		WithAutoWarmup(context.Background(), "ping"))
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := adaptor.SendRequest("Hi"); err != nil {
+				t.Errorf("Expected the request to succeed without the warm up, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if pings != 1 {
+		t.Errorf("Expected the failed warm up to be sent once, got %d", pings)
+	}
+}